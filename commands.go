@@ -0,0 +1,308 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/arcanist"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/watcher"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit statuses for the commands that run to completion.
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// runOnce mirrors a single repo (and optionally a single review in it) a single time.
+//
+// The arguments are the path of the repo, optionally followed by the revision of the review.
+// The returned value is the exit status for the process.
+func runOnce(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		logger.Errorf("Usage: %s [flags] once <repo path> [<review revision>]", os.Args[0])
+		return exitUsage
+	}
+	repo, err := repository.NewGitRepo(args[0])
+	if err != nil {
+		logger.Errorf("%q is not a git repo: %v", args[0], err)
+		return exitUsage
+	}
+	var revision string
+	if len(args) == 2 {
+		revision = args[1]
+	}
+	if err := mirror.Once(repo, revision, *syncToRemote); err != nil {
+		logger.Errorf("Failed to mirror %s: %v", repo.GetPath(), err)
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// runDaemon mirrors every repo under the search directory, forever.
+func runDaemon() {
+	if *webhookAddr != "" {
+		if *webhookKey == "" {
+			logger.Fatalf("An HMAC key is required in order to accept webhooks")
+		}
+		go serveWebhooks(*webhookAddr, *webhookKey)
+	}
+	queue := watcher.NewQueue()
+	startWorkers(queue, *concurrency)
+	var repoWatcher *watcher.Watcher
+	if *watch {
+		// The watcher queues each repo when it changes, so the periodic sync is only a safety net
+		// for changes that it misses (e.g. notes that were fetched from a remote).
+		var err error
+		repoWatcher, err = watcher.New()
+		orFatalf(err)
+		go repoWatcher.Run(queue)
+	}
+
+	// We want to always start processing new repos that are added after the binary has started,
+	// so we need to run the findRepos method in an infinite loop. Each repo may have its own
+	// sync period, so we search as often as the shortest one, and only queue the repos that are due.
+	period := time.Duration(mirrorConfig.MinSyncPeriod()) * time.Second
+	ticker := time.Tick(period)
+	lastQueued := make(map[string]time.Time)
+	for {
+		repos, err := findRepos()
+		if err != nil {
+			// Keep mirroring the repos we already know about until the search succeeds.
+			logger.Errorf("Failed to search %s for repos: %v", *searchDir, err)
+			repos = getKnownRepos()
+		} else {
+			setKnownRepos(repos)
+		}
+		now := time.Now()
+		for _, repo := range repos {
+			if !mirror.Enabled(repo) {
+				continue
+			}
+			if repoWatcher != nil {
+				if err := repoWatcher.Watch(repo); err != nil {
+					logger.Errorf("Failed to watch the repo %s: %v", repo.GetPath(), err)
+				}
+			}
+			// The ticker may fire slightly early, so we allow for half of its period.
+			repoPeriod := time.Duration(mirror.SyncPeriod(repo)) * time.Second
+			if last, ok := lastQueued[repo.GetPath()]; ok && now.Sub(last)+period/2 < repoPeriod {
+				continue
+			}
+			lastQueued[repo.GetPath()] = now
+			queue.Add(repo)
+		}
+		<-ticker
+	}
+}
+
+// reposFromArgs returns the repos at the given paths, or every repo under the search directory if there are none.
+func reposFromArgs(paths []string) ([]repository.Repo, error) {
+	if len(paths) == 0 {
+		return findRepos()
+	}
+	var repos []repository.Repo
+	for _, path := range paths {
+		repo, err := repository.NewGitRepo(path)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a git repo: %v", path, err)
+		}
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+// runStatus prints how far each of the repos at the given paths has been mirrored.
+func runStatus(args []string) int {
+	repos, err := reposFromArgs(args)
+	if err != nil {
+		logger.Error(err.Error())
+		return exitUsage
+	}
+	status := exitSuccess
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, repo := range repos {
+		repoStatus, err := mirror.Status(repo)
+		if err != nil {
+			logger.Errorf("Failed to read the status of %s: %v", repo.GetPath(), err)
+			status = exitFailure
+			continue
+		}
+		state := "up to date"
+		if repoStatus.MirroredStateHash == "" {
+			state = "never mirrored"
+		} else if !repoStatus.UpToDate() {
+			state = "changed since last mirrored"
+		}
+		fmt.Fprintf(w, "%s\t(%s)\n", repoStatus.Path, state)
+		if len(repoStatus.Reviews) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "  REVIEW\tREVISION\tCLOSED\tCOMMENTS\tDESCRIPTION\n")
+		for _, r := range repoStatus.Reviews {
+			differentialRevision := "-"
+			if r.DifferentialID != "" {
+				differentialRevision = "D" + r.DifferentialID
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%t\t%d/%d\t%s\n", r.Revision, differentialRevision, r.Closed,
+				r.LinkedComments, r.Comments, r.Description)
+		}
+	}
+	w.Flush()
+	return status
+}
+
+// runResync forgets what has been recorded about a single review, and then mirrors it again.
+//
+// The arguments are the revision of the review, optionally followed by the path of its repo.
+// If the repo is not given, then every repo under the search directory is searched for the review.
+func runResync(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		logger.Errorf("Usage: %s [flags] resync <review revision> [<repo path>]", os.Args[0])
+		return exitUsage
+	}
+	revision := args[0]
+	repos, err := reposFromArgs(args[1:])
+	if err != nil {
+		logger.Error(err.Error())
+		return exitUsage
+	}
+	for _, repo := range repos {
+		if r, err := review.GetSummary(repo, revision); err != nil || r == nil {
+			continue
+		}
+		if err := mirror.Resync(repo, revision, *syncToRemote); err != nil {
+			logger.Errorf("Failed to resync the review %s in %s: %v", revision, repo.GetPath(), err)
+			return exitFailure
+		}
+		return exitSuccess
+	}
+	logger.Errorf("There is no review for the revision %q", revision)
+	return exitUsage
+}
+
+// runBackfill imports the history of the closed revisions in Phabricator into each of the repos at the given paths.
+func runBackfill(args []string) int {
+	repos, err := reposFromArgs(args)
+	if err != nil {
+		logger.Error(err.Error())
+		return exitUsage
+	}
+	status := exitSuccess
+	for _, repo := range repos {
+		logger.Infof("Backfilling %s", repo.GetPath())
+		if err := mirror.Backfill(repo, *syncToRemote); err != nil {
+			logger.Errorf("Failed to backfill %s: %v", repo.GetPath(), err)
+			status = exitFailure
+		}
+	}
+	return status
+}
+
+// runDoctor checks that everything the mirror depends on is available, and prints the results.
+func runDoctor() int {
+	status := exitSuccess
+	check := func(name string, f func() (string, error)) bool {
+		result, err := f()
+		if err != nil {
+			fmt.Printf("[FAIL] %s: %v\n", name, err)
+			status = exitFailure
+			return false
+		}
+		fmt.Printf("[ OK ] %s: %s\n", name, result)
+		return true
+	}
+	skip := func(name, reason string) {
+		fmt.Printf("[SKIP] %s: %s\n", name, reason)
+	}
+
+	check("git", func() (string, error) {
+		version, err := exec.Command("git", "--version").Output()
+		return strings.TrimSpace(string(version)), err
+	})
+	if *useArc {
+		check("arc", func() (string, error) {
+			return exec.LookPath("arc")
+		})
+	} else {
+		skip("arc", "only needed with --use_arc")
+	}
+
+	configOK := check("config", func() (string, error) {
+		var err error
+		mirrorConfig, err = loadConfig()
+		if *configFile == "" {
+			return "no config file, so every repo uses the command line flags", err
+		}
+		return fmt.Sprintf("%d repo overrides in %s", len(mirrorConfig.Repos), *configFile), err
+	})
+	credentialsOK := configOK
+	if !*useArc && configOK {
+		credentialsOK = check("Conduit credentials", func() (string, error) {
+			conduit, err := newConduit(mirrorConfig.Settings)
+			if err != nil {
+				return "", err
+			}
+			arcanist.SetConduit(conduit)
+			return "using " + conduit.(*arcanist.Conduit).URI, nil
+		})
+	}
+	if credentialsOK {
+		check("user.whoami", func() (string, error) {
+			userName, err := arcanist.WhoAmI()
+			return "mirroring as " + userName, err
+		})
+	} else {
+		skip("user.whoami", "no Conduit credentials")
+	}
+
+	if *phabricatorDBDSN != "" {
+		check("Phabricator database", func() (string, error) {
+			return "connected", arcanist.CheckTransactionDatabase(*phabricatorDBDSN)
+		})
+	} else {
+		skip("Phabricator database", "comments are read with transaction.search")
+	}
+
+	if *stateFile != "" {
+		check("state file", func() (string, error) {
+			_, err := state.NewFileStore(*stateFile)
+			return *stateFile, err
+		})
+	} else {
+		skip("state file", "the state is only kept in memory, so comments may be mirrored again after a restart")
+	}
+
+	check("repos", func() (string, error) {
+		if _, err := os.Stat(*searchDir); err != nil {
+			return "", err
+		}
+		repos, err := findRepos()
+		return fmt.Sprintf("found %d under %s", len(repos), *searchDir), err
+	})
+	return status
+}
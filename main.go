@@ -18,17 +18,46 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/akatrevorjay/git-appraise/repository"
 	"github.com/akatrevorjay/git-phabricator-mirror/mirror"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/arcanist"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/config"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/discovery"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/dryrun"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/queue"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/watcher"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/webhook"
 	"github.com/op/go-logging"
+	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 var searchDir = flag.String("search_dir", "/var/repo", "Directory under which to search for git repos")
 var syncToRemote = flag.Bool("sync_to_remote", false, "Sync the local repos (including git notes) to their remotes")
 var syncPeriod = flag.Int("sync_period", 30, "Expected number of seconds between subsequent syncs of a repo.")
+var watch = flag.Bool("watch", false, "Watch the git-notes refs of each repo, and mirror a repo as soon as they change")
+var fullSyncPeriod = flag.Int("full_sync_period", 600, "Number of seconds between syncs of every repo when watching for changes")
+var arcrcPath = flag.String("arcrc", arcanist.DefaultArcrcPath(), "Arcanist config file from which to read the Phabricator URI and Conduit token")
+var phabricatorURI = flag.String("phabricator_uri", os.Getenv("PHABRICATOR_URI"), "Phabricator instance to use, overriding the default from the arcrc file")
+var conduitToken = flag.String("conduit_token", os.Getenv("CONDUIT_TOKEN"), "Conduit API token to use, overriding the one from the arcrc file")
+var useArc = flag.Bool("use_arc", false, "Issue Conduit calls by running \"arc call-conduit\" rather than over HTTP")
+var stateFile = flag.String("state_file", state.DefaultPath(), "File in which to persist the mirror state across restarts. If empty, the state is only kept in memory, and comments may be mirrored again after a restart")
+var webhookAddr = flag.String("webhook_addr", "", "Address (e.g. \":8080\") on which to listen for Phabricator webhooks. If empty, webhooks are not accepted")
+var webhookKey = flag.String("webhook_hmac_key", os.Getenv("PHABRICATOR_WEBHOOK_HMAC_KEY"), "HMAC key with which Phabricator signs its webhooks")
+var concurrency = flag.Int("concurrency", 4, "Maximum number of repos, and of revisions reported by webhooks, to mirror at the same time")
+var verbosity = flag.Int("v", 1, "Logging verbosity: 0 for only warnings and errors, 1 to also include informational messages, and 2 to also include debugging messages")
+var includeRepos = flag.String("include", "", "Comma-separated glob patterns of the repos to mirror, either absolute or relative to the search directory. If empty, every repo is mirrored")
+var excludeRepos = flag.String("exclude", "", "Comma-separated glob patterns of the repos, or directories, under the search directory not to mirror")
+var rescanPeriod = flag.Int("rescan_period", 300, "Number of seconds between searches of the search directory for new repos")
+var configFile = flag.String("config", "", "YAML file with the settings for every repo, and overrides for specific repos")
+var dryRun = flag.Bool("dry_run", false, "Print the changes that would be made to Phabricator and to the git-notes of each repo as lines of JSON, rather than making them")
+var importRevisions = flag.Bool("import_revisions", false, "Import open revisions that were created directly in Phabricator into the repos that contain their commits, as git-appraise reviews")
+var phabricatorDBDSN = flag.String("phabricator_db_dsn", os.Getenv("PHABRICATOR_DB_DSN"), "MySQL DSN (e.g. \"user:password@tcp(host:3306)/\") of the Phabricator database, from which to read review comments rather than over Conduit")
 
 var logger = logging.MustGetLogger("mirror")
 
@@ -54,26 +83,88 @@ func orErrorf(err error) {
 	logger.Errorf("Error: %s", err.Error())
 }
 
-func findRepos(searchDir string) ([]repository.Repo, error) {
-	// This method finds repos by recursively traversing the given directory,
-	// and looking for any git repos.
-	var repos []repository.Repo
-	filepath.Walk(searchDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// splitPatterns splits a comma-separated list of patterns.
+func splitPatterns(patterns string) []string {
+	var result []string
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			result = append(result, pattern)
 		}
-		if info.IsDir() {
-			gitRepo, err := repository.NewGitRepo(path)
-			if err == nil {
-				repos = append(repos, gitRepo)
-				// Since we have found a git repo, we don't need to
-				// traverse any of its child directories.
-				return filepath.SkipDir
+	}
+	return result
+}
+
+// repoFinder finds the repos under the search directory.
+var repoFinder *discovery.Finder
+
+// findRepos returns the repos under the search directory, reusing the previous results until they are due to be rescanned.
+func findRepos() ([]repository.Repo, error) {
+	if repoFinder == nil {
+		repoFinder = discovery.NewFinder(*searchDir, splitPatterns(*includeRepos), splitPatterns(*excludeRepos),
+			time.Duration(*rescanPeriod)*time.Second)
+	}
+	return repoFinder.Find()
+}
+
+// startWorkers starts the given number of workers, each of which mirrors the repos taken from the given queue.
+func startWorkers(queue *watcher.Queue, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				repo, ok := queue.Next()
+				if !ok {
+					return
+				}
+				if err := mirror.Repo(repo, *syncToRemote); err != nil {
+					logger.Errorf("Failed to mirror the repo %s: %v", repo.GetPath(), err)
+				}
+				queue.Done(repo)
 			}
-		}
-		return nil
-	})
-	return repos, nil
+		}()
+	}
+}
+
+// knownRepos holds the repos found by the latest search of the search directory.
+var knownRepos []repository.Repo
+var knownReposMutex sync.Mutex
+
+func setKnownRepos(repos []repository.Repo) {
+	knownReposMutex.Lock()
+	defer knownReposMutex.Unlock()
+	knownRepos = repos
+}
+
+func getKnownRepos() []repository.Repo {
+	knownReposMutex.Lock()
+	defer knownReposMutex.Unlock()
+	return knownRepos
+}
+
+// startWebhookWorkers starts the given number of workers, each of which mirrors the revisions taken from the given queue.
+func startWebhookWorkers(revisions *queue.Queue, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				revisionPHID, ok := revisions.Next()
+				if !ok {
+					return
+				}
+				if err := mirror.Revision(getKnownRepos(), revisionPHID, *syncToRemote); err != nil {
+					logger.Errorf("Failed to mirror the revision %s: %v", revisionPHID, err)
+				}
+				revisions.Done(revisionPHID)
+			}
+		}()
+	}
+}
+
+// serveWebhooks listens for Phabricator webhooks, and mirrors the comments of each revision they report.
+func serveWebhooks(addr, key string) {
+	revisions := queue.New()
+	startWebhookWorkers(revisions, *concurrency)
+	handler := webhook.NewHandler(key, revisions.Add)
+	logger.Infof("Listening for webhooks on %s", addr)
+	orFatalf(http.ListenAndServe(addr, handler))
 }
 
 // InitLoggers initialize loggers
@@ -89,6 +180,9 @@ func InitLoggers(verbosity int) (err error) {
 	leveledBackend := logging.AddModuleLevel(formatter)
 
 	switch {
+	case verbosity <= 0:
+		logging.SetLevel(logging.WARNING, "")
+		leveledBackend.SetLevel(logging.WARNING, "")
 	case verbosity == 1:
 		logging.SetLevel(logging.INFO, "")
 		leveledBackend.SetLevel(logging.INFO, "")
@@ -101,24 +195,128 @@ func InitLoggers(verbosity int) (err error) {
 	return
 }
 
-func main() {
-	InitLoggers(9)
+// setupStore configures the store in which the mirror records its progress.
+func setupStore() {
+	if *stateFile != "" {
+		newStore := state.NewFileStore
+		if *dryRun {
+			newStore = state.NewReadOnlyFileStore
+		}
+		store, err := newStore(*stateFile)
+		orFatalf(err)
+		mirror.SetStore(store)
+	} else {
+		logger.Warningf("No state file was given, so the links between mirrored comments will be lost on restart, " +
+			"after which comments that Phabricator has reformatted may be mirrored again")
+	}
+}
+
+// mirrorConfig holds the settings for each repo, as read from the config file and command line flags.
+var mirrorConfig *config.Config
 
+// loadConfig reads the config file, using the command line flags for any global settings that it does not set.
+func loadConfig() (*config.Config, error) {
+	defaults := mirror.DefaultSettings()
+	defaults.PhabricatorURI = *phabricatorURI
+	defaults.ConduitToken = *conduitToken
+	defaults.SyncPeriod = *syncPeriod
+	if *importRevisions {
+		defaults.ImportRevisions = importRevisions
+	}
+	if *watch {
+		// The watcher queues each repo when it changes, so the periodic sync is only a safety net.
+		defaults.SyncPeriod = *fullSyncPeriod
+	}
+	if *configFile == "" {
+		return config.New(defaults), nil
+	}
+	return config.Load(*configFile, defaults)
+}
+
+// newConduit returns a Conduit client for the Phabricator instance described by the given settings.
+func newConduit(settings config.Settings) (arcanist.ConduitCaller, error) {
+	if *useArc {
+		return nil, fmt.Errorf("Mirroring into %s requires the native Conduit client, rather than --use_arc", settings.PhabricatorURI)
+	}
+	conduit, err := arcanist.NewConduitFromArcrc(*arcrcPath, settings.PhabricatorURI, settings.ConduitToken)
+	if err != nil {
+		return nil, err
+	}
+	if timeout := settings.Timeout(); timeout > 0 {
+		conduit.Client.Timeout = timeout
+	}
+	return conduit, nil
+}
+
+// setup configures the mirror using the command line flags.
+func setup() {
+	var err error
+	mirrorConfig, err = loadConfig()
+	orFatalf(err)
+	mirror.SetConfig(mirrorConfig, newConduit)
+	if !*useArc {
+		conduit, err := newConduit(mirrorConfig.Settings)
+		orFatalf(err)
+		arcanist.SetConduit(conduit)
+	}
+	if *phabricatorDBDSN != "" {
+		orFatalf(arcanist.UseTransactionDatabase(*phabricatorDBDSN))
+	}
+	setupStore()
+	if *dryRun {
+		mirror.SetDryRun(dryrun.NewPlan(os.Stdout))
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] [<command> [<args>]]
+
+Commands:
+  daemon                             Mirror every repo under the search directory, forever (the default).
+  once <repo> [<review>]             Mirror a single repo, or a single review in it, and then exit.
+  status [<repo>...]                 Print how far each repo and review has been mirrored.
+  resync <review> [<repo>]           Forget what has been recorded about a review, and mirror it again.
+  backfill [<repo>...]               Import the history of closed revisions into git-appraise.
+  doctor                             Check that the environment is set up correctly.
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
 	flag.Parse()
-	// We want to always start processing new repos that are added after the binary has started,
-	// so we need to run the findRepos method in an infinite loop.
-
-	ticker := time.Tick(time.Duration(*syncPeriod) * time.Second)
-	for {
-		repos, err := findRepos(*searchDir)
-		if err != nil {
-			logger.Panic(err.Error())
-		}
-		for _, repo := range repos {
-			mirror.Repo(repo, *syncToRemote)
-		}
-		if *syncToRemote {
-			<-ticker
-		}
+	InitLoggers(*verbosity)
+	if *concurrency < 1 {
+		logger.Fatalf("The concurrency must be at least 1, but was %d", *concurrency)
+	}
+
+	command, args := flag.Arg(0), flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	switch command {
+	case "", "daemon":
+		setup()
+		runDaemon()
+	case "once":
+		setup()
+		os.Exit(runOnce(args))
+	case "status":
+		setupStore()
+		os.Exit(runStatus(args))
+	case "resync":
+		setup()
+		os.Exit(runResync(args))
+	case "backfill":
+		setup()
+		os.Exit(runBackfill(args))
+	case "doctor":
+		os.Exit(runDoctor())
+	default:
+		logger.Errorf("Unknown command %q", command)
+		usage()
+		os.Exit(exitUsage)
 	}
 }
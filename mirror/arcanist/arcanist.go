@@ -14,15 +14,14 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-// Package arcanist contains methods for issuing API calls to Phabricator via the "arc" command-line tool.
+// Package arcanist contains methods for issuing API calls to Phabricator, either natively over
+// HTTP or via the "arc" command-line tool.
 package arcanist
 
 import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"os/exec"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -33,8 +32,9 @@ import (
 	"github.com/akatrevorjay/git-appraise/review/ci"
 	"github.com/akatrevorjay/git-appraise/review/comment"
 	"github.com/akatrevorjay/git-appraise/review/request"
-	review_utils "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
 	utils "github.com/akatrevorjay/git-appraise/utils"
+	review_utils "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
 )
 
 // commitHashType is a special string that Phabricator uses internally to distinguish
@@ -67,43 +67,49 @@ const (
 
 // Arcanist represents an instance of the "arcanist" command-line tool.
 type Arcanist struct {
+	// Conduit is used for every API call made by this Arcanist. If it is nil, then
+	// the ConduitCaller set by SetConduit is used instead.
+	Conduit ConduitCaller
+	// RepoDirPrefix is the parent directory in which Phabricator stores its repos.
+	// If it is empty, then defaultRepoDirPrefix is used instead.
+	RepoDirPrefix string
+	// Callsign is the identifier Phabricator uses for the repo. If it is empty, then
+	// it is guessed from the path of the repo relative to RepoDirPrefix.
+	Callsign string
+	// Reviewers are added to every Differential revision that is created.
+	Reviewers []string
 }
 
-// Filter processing of previously closed revisions.
-var closedRevisionsMap = make(map[string]bool)
+// store records the progress of the mirror, such as which revisions have already been closed.
+var store state.Store = state.NewMemoryStore()
 
-// runArcCommandOrDie runs the given Conduit API call using the "arc" command line tool.
-//
-// Any errors that could occur here would be a sign of something being seriously
-// wrong, so they are treated as fatal. This makes it more evident that something
-// has gone wrong when the command is manually run by a user, and gives further
-// operations a clean-slate when this is run by supervisord with automatic restarts.
-func runArcCommandOrDie(method string, request interface{}, response interface{}) {
-	cmd := exec.Command("arc", "call-conduit", method)
-	input, err := json.Marshal(request)
-	if err != nil {
-		orPanic(err)
-	}
-	logger.Infof("Running conduit request: %v %v", method, input)
-	cmd.Stdin = strings.NewReader(string(input))
+// SetStore replaces the Store used to record the progress of the mirror.
+func SetStore(s state.Store) {
+	store = s
+}
 
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	if err := cmd.Start(); err != nil {
-		orPanic(err)
+// conduit returns the ConduitCaller used for the API calls made by this Arcanist.
+func (arc Arcanist) conduit() ConduitCaller {
+	caller := arc.Conduit
+	if caller == nil {
+		caller = conduit
 	}
-	go func() {
-		time.Sleep(arcanistRequestTimeout)
-		cmd.Process.Kill()
-	}()
-	if err := cmd.Wait(); err != nil {
-		logger.Error("Error running", "arc", "call-conduit", method, string(input), stdout.String())
-		orPanic(err)
+	if plan != nil {
+		caller = dryRunCaller{caller: caller, plan: plan}
 	}
-	logger.Debugf("Received conduit response %s", prettyJSONString(stdout.Bytes()))
-	if err = json.Unmarshal(stdout.Bytes(), response); err != nil {
-		orPanic(err)
+	return caller
+}
+
+// callConduit runs the given Conduit API call using this Arcanist's ConduitCaller.
+//
+// The returned error only reflects failures to issue the call or decode its response;
+// API errors reported by Phabricator are left in the response for the caller to check.
+func (arc Arcanist) callConduit(method string, request interface{}, response interface{}) error {
+	logger.Infof("Running conduit request: %v %+v", method, request)
+	if err := arc.conduit().Call(method, request, response); err != nil {
+		return fmt.Errorf("Conduit request %s failed: %v", method, err)
 	}
+	return nil
 }
 
 func prettyJSONString(str []byte) string {
@@ -117,6 +123,16 @@ func prettyJSONString(str []byte) string {
 	return buf.String()
 }
 
+// contains reports whether the given list includes the given item.
+func contains(list []string, item string) bool {
+	for _, existing := range list {
+		if existing == item {
+			return true
+		}
+	}
+	return false
+}
+
 func abbreviateRefName(ref string) string {
 	if strings.HasPrefix(ref, "refs/heads/") {
 		return ref[len("refs/heads/"):]
@@ -125,17 +141,25 @@ func abbreviateRefName(ref string) string {
 }
 
 type DifferentialReview struct {
-	ID         string `json:"id,omitempty"`
-	PHID       string `json:"phid,omitempty"`
-	Title      string `json:"title,omitempty"`
-	Branch     string `json:"branch,omitempty"`
-	Status     string `json:"status,omitempty"`
-	StatusName string `json:"statusName,omitempty"`
-	AuthorPHID string `json:"authorPHID,omitempty"`
+	ID           string          `json:"id,omitempty"`
+	PHID         string          `json:"phid,omitempty"`
+	Title        string          `json:"title,omitempty"`
+	Summary      string          `json:"summary,omitempty"`
+	Branch       string          `json:"branch,omitempty"`
+	Status       string          `json:"status,omitempty"`
+	StatusName   string          `json:"statusName,omitempty"`
+	AuthorPHID   string          `json:"authorPHID,omitempty"`
 	ReviewersRaw json.RawMessage `json:"reviewers,omitempty"`
-	Reviewers  []string `json:"-"`
-	Hashes    [][]string        `json:"hashes,omitempty"`
-	Diffs     []string          `json:"diffs,omitempty"`
+	Reviewers    []string        `json:"-"`
+	Hashes       [][]string      `json:"hashes,omitempty"`
+	Diffs        []string        `json:"diffs,omitempty"`
+	CCs          []string        `json:"ccs,omitempty"`
+	Commits      []string        `json:"commits,omitempty"`
+	DateModified string          `json:"dateModified,omitempty"`
+	// RepositoryPHID identifies the repository that the revision is for, if it records one.
+	RepositoryPHID string `json:"repositoryPHID,omitempty"`
+	// arc is the Arcanist through which the revision was read, and is used for any further API calls about it.
+	arc Arcanist
 }
 
 // Used to avoid recursion in UnmarshalJSON below.
@@ -168,41 +192,24 @@ func (r *DifferentialReview) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-// GetFirstCommit returns the first commit that is included in the review
+// GetFirstCommit returns the revision of the git-appraise review that is linked to this revision
+//
+// Revisions that are not linked to any review (e.g. because they were created directly in
+// Phabricator) return the empty string.
 func (r DifferentialReview) GetFirstCommit(repo repository.Repo) string {
-	var commits []string
-	for _, hashPair := range r.Hashes {
-		// We only care about the hashes for commits, which have exactly two
-		// elements, the first of which is "gtcm".
-		if len(hashPair) == 2 && hashPair[0] == commitHashType {
-			commits = append(commits, hashPair[1])
-		}
-	}
-	var commitTimestamps []int
-	commitsByTimestamp := make(map[int]string)
-	for _, commit := range commits {
-		if _, err := repo.GetLastParent(commit); err == nil {
-			timeString, err1 := repo.GetCommitTime(commit)
-			timestamp, err2 := strconv.Atoi(timeString)
-			if err1 == nil && err2 == nil {
-				commitTimestamps = append(commitTimestamps, timestamp)
-				// If there are multiple, equally old commits, then the last one wins.
-				commitsByTimestamp[timestamp] = commit
-			}
-		}
+	if revision := findLinkedRevision(repo, r.ID); revision != "" {
+		return revision
 	}
-	if len(commitTimestamps) == 0 {
-		return ""
-	}
-	sort.Ints(commitTimestamps)
-	revision := commitsByTimestamp[commitTimestamps[0]]
-	return revision
+	return r.findUnlinkedReview(repo)
 }
 
-// queryRequest specifies filters for review queries. Specifically, CommitHashes filters
-// reviews to only those that contain the specified hashes, and Status filters reviews to
-// only those that match the given status (e.g. "status-any", "status-open", etc.)
+// queryRequest specifies filters for review queries. Specifically, IDs and PHIDs filter reviews to
+// only those with the given identifiers, CommitHashes filters reviews to only those that contain
+// the specified hashes, and Status filters reviews to only those that match the given
+// status (e.g. "status-any", "status-open", etc.)
 type queryRequest struct {
+	IDs          []int      `json:"ids,omitempty"`
+	PHIDs        []string   `json:"phids,omitempty"`
 	CommitHashes [][]string `json:"commitHashes,omitempty"`
 	Status       string     `json:"status,omitempty"`
 }
@@ -213,30 +220,164 @@ type queryResponse struct {
 	Response     []DifferentialReview `json:"response,omitempty"`
 }
 
-func (arc Arcanist) listDifferentialReviewsOrDie(revision string) []DifferentialReview {
-	request := queryRequest{
-		CommitHashes: [][]string{[]string{commitHashType, revision}},
-	}
+func (arc Arcanist) queryDifferentialReviews(request queryRequest) ([]DifferentialReview, error) {
 	var response queryResponse
-	runArcCommandOrDie("differential.query", request, &response)
-	return response.Response
+	if err := arc.callConduit("differential.query", request, &response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("Failed to query the differential revisions: %s", response.ErrorMessage)
+	}
+	for i := range response.Response {
+		response.Response[i].arc = arc
+	}
+	return response.Response, nil
 }
 
-func (arc Arcanist) ListOpenReviews(repo repository.Repo) []review_utils.PhabricatorReview {
+// listDifferentialReviews returns the Differential revisions for the review of the given revision.
+//
+// The review is matched to its revision using the link note written when the revision was created.
+// Reviews that were mirrored before we started writing link notes are matched by searching for
+// revisions that include the review's commit, after which they are linked to the first one found.
+func (arc Arcanist) listDifferentialReviews(repo repository.Repo, revision string) ([]DifferentialReview, error) {
+	var request queryRequest
+	if link := readLink(repo, revision); link != nil {
+		id, err := strconv.Atoi(link.RevisionID)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed differential revision ID %q linked to %s", link.RevisionID, revision)
+		}
+		request.IDs = []int{id}
+	} else {
+		request.CommitHashes = [][]string{[]string{commitHashType, revision}}
+	}
+	reviews, err := arc.queryDifferentialReviews(request)
+	if err != nil {
+		return nil, err
+	}
+	if len(reviews) == 0 {
+		return nil, nil
+	}
+	// Keep the link up to date with the latest diffs in the revision.
+	if err := recordLink(repo, revision, reviews[0]); err != nil {
+		return nil, err
+	}
+	return reviews[:1], nil
+}
+
+// LookupRevision returns the Differential revision with the given PHID, or nil if there is none.
+func (arc Arcanist) LookupRevision(revisionPHID string) (*DifferentialReview, error) {
+	reviews, err := arc.queryDifferentialReviews(queryRequest{PHIDs: []string{revisionPHID}})
+	if err != nil || len(reviews) == 0 {
+		return nil, err
+	}
+	return &reviews[0], nil
+}
+
+// FindReview returns the Differential revision linked to the review of the given revision, or nil if there is none.
+func (arc Arcanist) FindReview(repo repository.Repo, revision string) (review_utils.PhabricatorReview, error) {
+	reviews, err := arc.listDifferentialReviews(repo, revision)
+	if err != nil || len(reviews) == 0 {
+		return nil, err
+	}
+	return reviews[0], nil
+}
+
+func (arc Arcanist) ListOpenReviews(repo repository.Repo) ([]review_utils.PhabricatorReview, error) {
 	// TODO(ojarjur): Filter the query by the repo.
 	// As is, we simply return all open reviews for *any* repo, and then filter in
 	// the calling level.
 	request := queryRequest{
 		Status: "status-open",
 	}
-	var response queryResponse
-	runArcCommandOrDie("differential.query", request, &response)
+	differentialReviews, err := arc.queryDifferentialReviews(request)
+	if err != nil {
+		return nil, err
+	}
 	var reviews []review_utils.PhabricatorReview
-	for _, r := range response.Response {
+	for _, r := range differentialReviews {
 		reviews = append(reviews, r)
 	}
 	//utils.Dump(reviews)
-	return reviews
+	return reviews, nil
+}
+
+// revisionSearchRequest models the request format for Phabricator's differential.revision.search API method.
+type revisionSearchRequest struct {
+	Constraints struct {
+		Statuses        []string `json:"statuses,omitempty"`
+		RepositoryPHIDs []string `json:"repositoryPHIDs,omitempty"`
+	} `json:"constraints"`
+	Order string `json:"order,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+	After string `json:"after,omitempty"`
+}
+
+// revisionSearchResponse models the response format for Phabricator's differential.revision.search API method.
+type revisionSearchResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     struct {
+		Data []struct {
+			ID int `json:"id"`
+		} `json:"data"`
+		Cursor struct {
+			After *string `json:"after"`
+		} `json:"cursor"`
+	} `json:"response,omitempty"`
+}
+
+// ListClosedReviews returns a page of at most the given number of closed or abandoned reviews for
+// the given repo, starting after the given cursor, ordered from the most recently created.
+//
+// The revisions are listed with differential.revision.search, which can filter them by repository
+// and pages by revision ID, so that revisions closed during a backfill do not shift the later pages.
+// Their details are then read with differential.query, as for every other review.
+func (arc Arcanist) ListClosedReviews(repo repository.Repo, after string, limit int) ([]review_utils.PhabricatorReview, string, error) {
+	repositoryPHID, err := arc.repositoryPHID(repo)
+	if err != nil {
+		return nil, "", err
+	}
+	var request revisionSearchRequest
+	request.Constraints.Statuses = []string{"published", "abandoned"}
+	if repositoryPHID != "" {
+		request.Constraints.RepositoryPHIDs = []string{repositoryPHID}
+	}
+	request.Order = "newest"
+	request.Limit = limit
+	request.After = after
+	var response revisionSearchResponse
+	if err := arc.callConduit("differential.revision.search", request, &response); err != nil {
+		return nil, "", err
+	}
+	if response.Error != "" {
+		return nil, "", fmt.Errorf("Failed to search the differential revisions: %s", response.ErrorMessage)
+	}
+	var next string
+	if response.Response.Cursor.After != nil {
+		next = *response.Response.Cursor.After
+	}
+	var ids []int
+	for _, item := range response.Response.Data {
+		ids = append(ids, item.ID)
+	}
+	if len(ids) == 0 {
+		return nil, next, nil
+	}
+	differentialReviews, err := arc.queryDifferentialReviews(queryRequest{IDs: ids})
+	if err != nil {
+		return nil, "", err
+	}
+	byID := make(map[string]DifferentialReview)
+	for _, r := range differentialReviews {
+		byID[r.ID] = r
+	}
+	var reviews []review_utils.PhabricatorReview
+	for _, id := range ids {
+		if r, ok := byID[strconv.Itoa(id)]; ok {
+			reviews = append(reviews, r)
+		}
+	}
+	return reviews, next, nil
 }
 
 type revisionFields struct {
@@ -265,37 +406,77 @@ type createRevisionResponse struct {
 	Response     differentialRevision `json:"response,omitempty"`
 }
 
-func (arc Arcanist) createDifferentialRevision(repo repository.Repo, revision string, diffID int, req request.Request) (*differentialRevision, error) {
+// revisionTitleAndSummary returns the title and summary of the revision that mirrors a review with the given description.
+func revisionTitleAndSummary(description string) (string, string) {
 	// If the description is multiple lines, then treat the first as the title.
-	fields := revisionFields{Title: strings.Split(req.Description, "\n")[0]}
+	title := strings.Split(description, "\n")[0]
 	// Truncate the title if it is too long.
-	if len(fields.Title) > differentialTitleLengthLimit {
+	if len(title) > differentialTitleLengthLimit {
 		truncatedLimit := differentialTitleLengthLimit - 4
-		fields.Title = fields.Title[0:truncatedLimit] + "..."
+		title = title[0:truncatedLimit] + "..."
 	}
 	// If we modified the title from the description, then put the full description in the summary.
-	if fields.Title != req.Description {
-		fields.Summary = req.Description
+	if title != description {
+		return title, description
 	}
-	for _, reviewer := range req.Reviewers {
-		user, err := queryUser(reviewer)
+	return title, ""
+}
+
+// requestReviewers returns the reviewers for the revision that mirrors the given request,
+// which includes any reviewers configured for every revision.
+func (arc Arcanist) requestReviewers(req request.Request) []string {
+	reviewers := append([]string(nil), req.Reviewers...)
+	for _, reviewer := range arc.Reviewers {
+		if !contains(reviewers, reviewer) {
+			reviewers = append(reviewers, reviewer)
+		}
+	}
+	return reviewers
+}
+
+// userPHIDs returns the PHIDs of the given users, skipping any that are not known to Phabricator.
+func (arc Arcanist) userPHIDs(names []string) ([]string, error) {
+	var phids []string
+	for _, name := range names {
+		user, err := arc.queryUser(name)
 		if err != nil {
-			orPanic(err)
+			return nil, err
 		} else if user != nil {
-			fields.Reviewers = append(fields.Reviewers, user.PHID)
+			phids = append(phids, user.PHID)
 		}
 	}
+	return phids, nil
+}
+
+// requestFields returns the fields of the revision that mirrors the given request.
+func (arc Arcanist) requestFields(req request.Request) (revisionFields, error) {
+	var fields revisionFields
+	fields.Title, fields.Summary = revisionTitleAndSummary(req.Description)
+	reviewers, err := arc.userPHIDs(arc.requestReviewers(req))
+	if err != nil {
+		return fields, err
+	}
+	fields.Reviewers = reviewers
 	if req.Requester != "" {
-		user, err := queryUser(req.Requester)
+		ccs, err := arc.userPHIDs([]string{req.Requester})
 		if err != nil {
-			orPanic(err)
-		} else if user != nil {
-			fields.CCs = append(fields.CCs, user.PHID)
+			return fields, err
 		}
+		fields.CCs = ccs
+	}
+	return fields, nil
+}
+
+func (arc Arcanist) createDifferentialRevision(repo repository.Repo, revision string, diffID int, req request.Request) (*differentialRevision, error) {
+	fields, err := arc.requestFields(req)
+	if err != nil {
+		return nil, err
 	}
 	createRequest := createRevisionRequest{diffID, fields}
 	var createResponse createRevisionResponse
-	runArcCommandOrDie("differential.createrevision", createRequest, &createResponse)
+	if err := arc.callConduit("differential.createrevision", createRequest, &createResponse); err != nil {
+		return nil, err
+	}
 	if createResponse.Error != "" {
 		return nil, fmt.Errorf("Failed to create the differential revision: %s", createResponse.ErrorMessage)
 	}
@@ -328,26 +509,111 @@ type differentialCloseResponse struct {
 	ErrorMessage string `json:"errorMessage,omitempty"`
 }
 
-func (differentialReview DifferentialReview) close() {
+func (differentialReview DifferentialReview) close() error {
 	reviewID, err := strconv.Atoi(differentialReview.ID)
 	if err != nil {
-		orPanic(err)
+		return err
 	}
 	closeRequest := differentialCloseRequest{reviewID}
 	var closeResponse differentialCloseResponse
-	runArcCommandOrDie("differential.close", closeRequest, &closeResponse)
+	if err := differentialReview.arc.callConduit("differential.close", closeRequest, &closeResponse); err != nil {
+		return err
+	}
 	if closeResponse.Error != "" {
 		// This might happen if someone merged in a review that wasn't accepted yet, or if the review is not owned by the robot account.
 		logger.Infof(closeResponse.ErrorMessage)
 	}
+	return nil
+}
+
+func (differentialReview DifferentialReview) isAbandoned() bool {
+	return differentialReview.Status == differentialAbandonedStatus
+}
+
+// isOlderThan reports whether the revision was last modified before the given request was written.
+func (differentialReview DifferentialReview) isOlderThan(req request.Request) bool {
+	modified, err := strconv.ParseInt(differentialReview.DateModified, 10, 64)
+	if err != nil {
+		return false
+	}
+	requested, err := strconv.ParseInt(req.Timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	return modified < requested
 }
 
-func findCommitForDiff(diffIDString string) string {
+// performAction takes the given action (e.g. "abandon" or "reclaim") on the revision, with the given comment,
+// and reports whether Phabricator accepted it.
+func (differentialReview DifferentialReview) performAction(action, message string) (bool, error) {
+	request := createCommentRequest{
+		RevisionID: differentialReview.ID,
+		Message:    message,
+		Action:     action,
+	}
+	var response createCommentResponse
+	if err := differentialReview.arc.callConduit("differential.createcomment", request, &response); err != nil {
+		return false, err
+	}
+	if response.Error != "" {
+		// This might happen if the revision is not owned by the robot account (e.g. because it was imported),
+		// in which case retrying will not help.
+		logger.Infof("Failed to %s the differential revision %s: %s", action, differentialReview.ID, response.ErrorMessage)
+		return false, nil
+	}
+	return true, nil
+}
+
+// abandonAll abandons each of the given revisions that is still open, and records that the mirror abandoned them.
+func abandonAll(repo repository.Repo, revision string, differentialReviews []DifferentialReview, message string) error {
+	abandoned := false
+	for _, differentialReview := range differentialReviews {
+		if differentialReview.isClosed() {
+			continue
+		}
+		logger.Infof("Abandoning the differential revision %s: %s", differentialReview.ID, message)
+		performed, err := differentialReview.performAction("abandon", message)
+		if err != nil {
+			return err
+		}
+		abandoned = abandoned || performed
+	}
+	if !abandoned {
+		return nil
+	}
+	return store.MarkRevisionAbandoned(repo.GetPath(), revision, true)
+}
+
+// reclaimAll reclaims each of the given revisions that is abandoned, if either the mirror abandoned it,
+// or the review was revived after the revision was abandoned. The returned revisions reflect their new status.
+func reclaimAll(repo repository.Repo, revision string, differentialReviews []DifferentialReview, req request.Request) ([]DifferentialReview, error) {
+	abandonedByMirror := store.IsRevisionAbandoned(repo.GetPath(), revision)
+	var reclaimed []DifferentialReview
+	for _, differentialReview := range differentialReviews {
+		if differentialReview.isAbandoned() && (abandonedByMirror || differentialReview.isOlderThan(req)) {
+			logger.Infof("Reclaiming the differential revision %s, as the review %s is open again", differentialReview.ID, revision)
+			performed, err := differentialReview.performAction("reclaim", "Reclaimed, as the review is open again.")
+			if err != nil {
+				return nil, err
+			}
+			if performed {
+				differentialReview.Status = differentialNeedsReviewStatus
+			}
+		}
+		reclaimed = append(reclaimed, differentialReview)
+	}
+	if err := store.MarkRevisionAbandoned(repo.GetPath(), revision, false); err != nil {
+		return nil, err
+	}
+	return reclaimed, nil
+}
+
+func (arc Arcanist) findCommitForDiff(diffIDString string) string {
 	diffID, err := strconv.Atoi(diffIDString)
 	if err != nil {
 		return ""
 	}
-	diff, err := readDiff(diffID)
+	diff, err := arc.readDiff(diffID)
 	if err != nil {
 		return ""
 	}
@@ -362,6 +628,8 @@ type createCommentRequest struct {
 	Message       string `json:"content,omitempty"`
 	Action        string `json:"action,omitempty"`
 	AttachInlines bool   `json:"attach_inlines,omitempty"`
+	// CommentHash is the hash of the git-appraise comment being mirrored, and is not sent to Phabricator.
+	CommentHash string `json:"-"`
 }
 
 // createInlineRequest models the request format for
@@ -371,8 +639,12 @@ type createInlineRequest struct {
 	DiffID     string `json:"diffID,omitempty"`
 	FilePath   string `json:"filePath,omitempty"`
 	LineNumber uint32 `json:"lineNumber,omitempty"`
+	// LineLength is the number of lines after LineNumber that the comment also spans.
+	LineLength uint32 `json:"lineLength,omitempty"`
 	Content    string `json:"content,omitempty"`
 	IsNewFile  uint32 `json:"isNewFile"`
+	// CommentHash is the hash of the git-appraise comment being mirrored, and is not sent to Phabricator.
+	CommentHash string `json:"-"`
 }
 
 // createInlineResponse models the response format for
@@ -380,6 +652,9 @@ type createInlineRequest struct {
 type createInlineResponse struct {
 	Error        string `json:"error,omitempty"`
 	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     struct {
+		ID int `json:"id"`
+	} `json:"response,omitempty"`
 }
 
 // createCommentResponse models the response format for
@@ -389,52 +664,114 @@ type createCommentResponse struct {
 	ErrorMessage string `json:"errorMessage,omitempty"`
 }
 
-func overlapsAny(c comment.Comment, existingComments []comment.Comment) bool {
+// isMirrored determines if the given git-appraise comment already exists in Phabricator.
+//
+// Comments are matched using the links recorded whenever a comment is mirrored in either
+// direction. Comments that were mirrored before we started recording those links are matched
+// by comparing their contents with the existing comments, and then linked to the first match.
+func isMirrored(repoPath string, commentThread review.CommentThread, existingComments []review_utils.PhabricatorComment) bool {
+	if store.GetCommentPHID(repoPath, commentThread.Hash) != "" {
+		return true
+	}
 	for _, existing := range existingComments {
-		if review_utils.Overlaps(c, existing) {
+		if store.GetCommentHash(repoPath, existing.PHID) != "" {
+			// The existing comment is already linked to a different git-appraise comment.
+			continue
+		}
+		if review_utils.Overlaps(commentThread.Comment, existing.Comment) {
+			if err := store.LinkComment(repoPath, commentThread.Hash, existing.PHID); err != nil {
+				logger.Errorf("Failed to link the comment %s to %s: %v", commentThread.Hash, existing.PHID, err)
+			}
 			return true
 		}
 	}
 	return false
 }
 
-func (differentialReview DifferentialReview) buildCommentRequestsForThread(existingComments []comment.Comment, commentThread review.CommentThread, diffID, path string, lineNumber uint32) []createInlineRequest {
+// buildCommentRequestsForThread returns the requests to mirror the given inline comment thread, which
+// is a reply to the given parent comment (if any).
+//
+// Differential's API cannot create replies to inline comments, so each reply is posted as another
+// inline comment on the same lines as its parent, and refers to the parent as described by ReplyDescription.
+// Replies that were mirrored before they referred to their parents are still matched by their contents.
+func (differentialReview DifferentialReview) buildCommentRequestsForThread(repoPath string, existingComments []review_utils.PhabricatorComment, commentThread review.CommentThread, parent *comment.Comment, diffID, path string, lineNumber, lineLength uint32) []createInlineRequest {
 	var requests []createInlineRequest
-	if !overlapsAny(commentThread.Comment, existingComments) {
-		content := review_utils.QuoteDescription(commentThread.Comment)
+	located := commentThread
+	described := commentThread
+	if parent != nil {
+		if located.Comment.Location == nil {
+			// Replies are posted at the locations of their parents.
+			located.Comment.Location = parent.Location
+			described.Comment.Location = parent.Location
+		}
+		described.Comment.Description = review_utils.ReplyDescription(commentThread.Comment, *parent)
+	}
+	if !isMirrored(repoPath, described, existingComments) && !isMirrored(repoPath, located, existingComments) {
+		content := review_utils.QuoteDescription(described.Comment)
 		request := createInlineRequest{
 			RevisionID: differentialReview.ID,
 			DiffID:     diffID,
 			FilePath:   path,
 			LineNumber: lineNumber,
+			LineLength: lineLength,
 			// IsNewFile indicates if the comment is on the left-hand side (0) or the right-hand side (1).
 			// We always post comments to the right-hand side.
-			IsNewFile: 1,
-			Content:   content,
+			IsNewFile:   1,
+			Content:     content,
+			CommentHash: commentThread.Hash,
 		}
 		requests = append(requests, request)
 	}
 	for _, child := range commentThread.Children {
-		requests = append(requests, differentialReview.buildCommentRequestsForThread(existingComments, child, diffID, path, lineNumber)...)
+		requests = append(requests, differentialReview.buildCommentRequestsForThread(repoPath, existingComments, child, &located.Comment, diffID, path, lineNumber, lineLength)...)
 	}
 	return requests
 }
 
-func (differentialReview DifferentialReview) buildCommentRequests(commentThreads []review.CommentThread, existingComments []comment.Comment, commitToDiffMap map[string]string) ([]createInlineRequest, []createCommentRequest) {
+// topLevelCommentMessage returns the body of the Differential comment that mirrors the given
+// review-wide or commit-level git-appraise comment.
+func topLevelCommentMessage(c comment.Comment) string {
+	c.Description = review_utils.TopLevelDescription(c)
+	return review_utils.QuoteDescription(c)
+}
+
+// buildTopLevelCommentRequests returns the requests to mirror the given review-wide or commit-level
+// comment thread. Phabricator does not thread top-level comments, so replies are posted after their parents.
+func (differentialReview DifferentialReview) buildTopLevelCommentRequests(repoPath string, existingComments []review_utils.PhabricatorComment, commentThread review.CommentThread) []createCommentRequest {
+	var requests []createCommentRequest
+	if !isMirrored(repoPath, commentThread, existingComments) {
+		requests = append(requests, createCommentRequest{
+			RevisionID:  differentialReview.ID,
+			Message:     topLevelCommentMessage(commentThread.Comment),
+			Action:      "comment",
+			CommentHash: commentThread.Hash,
+		})
+	}
+	for _, child := range commentThread.Children {
+		requests = append(requests, differentialReview.buildTopLevelCommentRequests(repoPath, existingComments, child)...)
+	}
+	return requests
+}
+
+func (differentialReview DifferentialReview) buildCommentRequests(repoPath string, commentThreads []review.CommentThread, existingComments []review_utils.PhabricatorComment, commitToDiffMap map[string]string) ([]createInlineRequest, []createCommentRequest) {
 	var inlineRequests []createInlineRequest
 	var commentRequests []createCommentRequest
 
 	for _, c := range commentThreads {
 		if c.Comment.Location != nil && c.Comment.Location.Path != "" {
-			// TODO(ojarjur): Also mirror whole-review comments.
-			var lineNumber uint32 = 1
-			if c.Comment.Location.Range != nil {
-				lineNumber = c.Comment.Location.Range.StartLine
+			var lineNumber, lineLength uint32 = 1, 0
+			if r := c.Comment.Location.Range; r != nil {
+				lineNumber = r.StartLine
+				if r.EndLine > r.StartLine {
+					lineLength = r.EndLine - r.StartLine
+				}
 			}
 			diffID := commitToDiffMap[c.Comment.Location.Commit]
 			if diffID != "" {
-				inlineRequests = append(inlineRequests, differentialReview.buildCommentRequestsForThread(existingComments, c, diffID, c.Comment.Location.Path, lineNumber)...)
+				inlineRequests = append(inlineRequests, differentialReview.buildCommentRequestsForThread(repoPath, existingComments, c, nil, diffID, c.Comment.Location.Path, lineNumber, lineLength)...)
 			}
+		} else {
+			commentRequests = append(commentRequests, differentialReview.buildTopLevelCommentRequests(repoPath, existingComments, c)...)
 		}
 	}
 	if len(inlineRequests) > 0 {
@@ -502,11 +839,11 @@ func (arc Arcanist) mirrorStatusesForEachCommit(r review.Review, commitToDiffIDM
 	}
 }
 
-func (arc Arcanist) mirrorCommentsIntoReview(repo repository.Repo, differentialReview DifferentialReview, r review.Review) {
+func (arc Arcanist) mirrorCommentsIntoReview(repo repository.Repo, differentialReview DifferentialReview, r review.Review) error {
 	commitToDiffMap := make(map[string]string)
 	commitToDiffIDMap := make(map[string]int)
 	for _, diffIDString := range differentialReview.Diffs {
-		lastCommit := findCommitForDiff(diffIDString)
+		lastCommit := arc.findCommitForDiff(diffIDString)
 		commitToDiffMap[lastCommit] = diffIDString
 		diffID, err := strconv.Atoi(diffIDString)
 		if err == nil {
@@ -515,24 +852,78 @@ func (arc Arcanist) mirrorCommentsIntoReview(repo repository.Repo, differentialR
 	}
 	arc.mirrorStatusesForEachCommit(r, commitToDiffIDMap)
 
-	logger.Infof("Fuck r=%s", r)
-
-	existingComments := differentialReview.LoadComments()
-	inlineRequests, commentRequests := differentialReview.buildCommentRequests(r.Comments, existingComments, commitToDiffMap)
+	existingComments, err := differentialReview.LoadComments()
+	if err != nil {
+		return err
+	}
+	inlineRequests, commentRequests := differentialReview.buildCommentRequests(repo.GetPath(), r.Comments, existingComments, commitToDiffMap)
+	// The inline comments are only assigned PHIDs once they are published, so we
+	// keep track of their IDs until then.
+	commentHashesByID := make(map[int]string)
 	for _, request := range inlineRequests {
 		var response createInlineResponse
-		runArcCommandOrDie("differential.createinline", request, &response)
+		if err := arc.callConduit("differential.createinline", request, &response); err != nil {
+			return err
+		}
 		if response.Error != "" {
 			logger.Infof(response.ErrorMessage)
+		} else if request.CommentHash != "" {
+			commentHashesByID[response.Response.ID] = request.CommentHash
 		}
 	}
+	commentHashesByMessage := make(map[string][]string)
 	for _, request := range commentRequests {
 		var response createCommentResponse
-		runArcCommandOrDie("differential.createcomment", request, &response)
+		if err := arc.callConduit("differential.createcomment", request, &response); err != nil {
+			return err
+		}
 		if response.Error != "" {
 			logger.Infof(response.ErrorMessage)
+		} else if request.CommentHash != "" {
+			commentHashesByMessage[request.Message] = append(commentHashesByMessage[request.Message], request.CommentHash)
 		}
 	}
+	return differentialReview.linkPublishedComments(repo, commentHashesByID, commentHashesByMessage)
+}
+
+// linkPublishedComments links newly published Phabricator comments to the git-appraise comments they mirror.
+//
+// Inline comments are matched by their IDs. Top-level comments are not assigned an ID that we can read
+// when they are created, so they are matched by their contents with the published comments that are not yet linked.
+func (differentialReview DifferentialReview) linkPublishedComments(repo repository.Repo, commentHashesByID map[int]string, commentHashesByMessage map[string][]string) error {
+	if len(commentHashesByID) == 0 && len(commentHashesByMessage) == 0 {
+		return nil
+	}
+	publishedComments, err := differentialReview.readPublishedComments()
+	if err != nil {
+		return err
+	}
+	for _, published := range publishedComments {
+		commentHash, ok := commentHashesByID[published.ID]
+		if ok {
+			delete(commentHashesByID, published.ID)
+		} else if published.FileName == "" && len(commentHashesByMessage[published.Content]) > 0 {
+			if store.GetCommentHash(repo.GetPath(), published.PHID) != "" {
+				continue
+			}
+			commentHash = commentHashesByMessage[published.Content][0]
+			commentHashesByMessage[published.Content] = commentHashesByMessage[published.Content][1:]
+		} else {
+			continue
+		}
+		if err := store.LinkComment(repo.GetPath(), commentHash, published.PHID); err != nil {
+			return err
+		}
+	}
+	for id := range commentHashesByID {
+		logger.Warningf("Could not find the published comment %d in the differential revision %s", id, differentialReview.ID)
+	}
+	for _, commentHashes := range commentHashesByMessage {
+		for _, commentHash := range commentHashes {
+			logger.Warningf("Could not find the published comment for %s in the differential revision %s", commentHash, differentialReview.ID)
+		}
+	}
+	return nil
 }
 
 func generateUnitDiffProperty(report ci.Report) (string, error) {
@@ -607,61 +998,100 @@ func (arc Arcanist) reportLintResults(diffID int, lintResults []analyses.Analyze
 //
 // This consists of making sure the latest commit pushed to the review ref has a corresponding
 // diff in the differential review.
-func (arc Arcanist) updateReviewDiffs(repo repository.Repo, differentialReview DifferentialReview, headCommit string, req request.Request, r review.Review) {
+func (arc Arcanist) updateReviewDiffs(repo repository.Repo, differentialReview DifferentialReview, headCommit string, req request.Request, r review.Review) error {
 	if differentialReview.isClosed() {
-		return
+		return nil
+	}
+	if err := arc.updateFields(repo, differentialReview, r); err != nil {
+		return err
 	}
 
 	headRevision := headCommit
 	mergeBase, err := repo.MergeBase(req.TargetRef, headRevision)
 	if err != nil {
-		orPanic(err)
+		return err
 	}
 	for _, hashPair := range differentialReview.Hashes {
 		if len(hashPair) == 2 && hashPair[0] == commitHashType && hashPair[1] == headCommit {
 			// The review already has the hash of the HEAD commit, so we have nothing to do beyond mirroring comments
 			// and build status if applicable
-			arc.mirrorCommentsIntoReview(repo, differentialReview, r)
-			return
+			return arc.mirrorCommentsIntoReview(repo, differentialReview, r)
 		}
 	}
 
 	diff, err := arc.createDifferentialDiff(repo, mergeBase, headRevision, req, differentialReview.Diffs)
 	if err != nil {
-		orPanic(err)
+		return err
 	}
 	if diff == nil {
 		// This means that phabricator silently refused to create the diff. Just move on.
-		return
+		return nil
 	}
 
 	updateRequest := differentialUpdateRevisionRequest{ID: differentialReview.ID, DiffID: strconv.Itoa(diff.ID)}
 	var updateResponse differentialUpdateRevisionResponse
-	runArcCommandOrDie("differential.updaterevision", updateRequest, &updateResponse)
+	if err := arc.callConduit("differential.updaterevision", updateRequest, &updateResponse); err != nil {
+		return err
+	}
 	if updateResponse.Error != "" {
-		logger.Panic(updateResponse.ErrorMessage)
+		return fmt.Errorf("Failed to update the differential revision %s: %s", differentialReview.ID, updateResponse.ErrorMessage)
 	}
+	return nil
 }
 
 // EnsureRequestExists runs the "arcanist" command-line tool to create a Differential diff for the given request, if one does not already exist.
-func (arc Arcanist) EnsureRequestExists(repo repository.Repo, review review.Review) {
+func (arc Arcanist) EnsureRequestExists(repo repository.Repo, review review.Review) error {
 	revision := review.Revision
 	req := review.Request
 
 	// If this revision has been previously closed shortcut all processing
-	if closedRevisionsMap[revision] {
-		return
+	if store.IsRevisionClosed(repo.GetPath(), revision) {
+		return nil
+	}
+	existingReviews, err := arc.listDifferentialReviews(repo, revision)
+	if err != nil {
+		return err
 	}
-	existingReviews := arc.listDifferentialReviewsOrDie(revision)
 	if review.Submitted {
 		// The change has already been merged in, so we should simply close any open reviews.
 		for _, differentialReview := range existingReviews {
 			if !differentialReview.isClosed() {
-				differentialReview.close()
+				if err := differentialReview.close(); err != nil {
+					return err
+				}
+			}
+		}
+		return store.MarkRevisionClosed(repo.GetPath(), revision)
+	}
+
+	if review.IsAbandoned() {
+		// Revisions that were modified (e.g. reclaimed) after the review was abandoned are left open.
+		var olderReviews []DifferentialReview
+		for _, differentialReview := range existingReviews {
+			if differentialReview.isOlderThan(req) {
+				olderReviews = append(olderReviews, differentialReview)
 			}
 		}
-		closedRevisionsMap[revision] = true
-		return
+		return abandonAll(repo, revision, olderReviews, "Abandoned, as the review was abandoned.")
+	}
+
+	head, err := review.GetHeadCommit()
+	if err != nil {
+		if req.ReviewRef == "" {
+			return fmt.Errorf("Failed to read the head commit of the review %s: %v", revision, err)
+		}
+		if exists, refErr := repo.HasRef(req.ReviewRef); refErr != nil {
+			return refErr
+		} else if exists {
+			return fmt.Errorf("Failed to read the head commit of the review %s from %s: %v", revision, req.ReviewRef, err)
+		}
+		// The review ref has been deleted, but the change wasn't merged. The revisions are only abandoned
+		// once, so that anyone who reclaims them in Phabricator afterwards is not overruled by the mirror.
+		if store.IsRevisionAbandoned(repo.GetPath(), revision) {
+			return nil
+		}
+		message := fmt.Sprintf("Abandoned, as the review ref %s no longer exists.", req.ReviewRef)
+		return abandonAll(repo, revision, existingReviews, message)
 	}
 
 	base, err := review.GetBaseCommit()
@@ -670,45 +1100,61 @@ func (arc Arcanist) EnsureRequestExists(repo repository.Repo, review review.Revi
 		// (e.g. the revision already being merged in, or being dropped and garbage collected),
 		// but they all indicate that the review request is no longer valid.
 		logger.Infof("Ignoring review request '%v', because we could not compute a base commit", req)
-		return
-	}
-
-	head, err := review.GetHeadCommit()
-	if err != nil {
-		// The given review ref has been deleted (or never existed), but the change wasn't merged.
-		// TODO(ojarjur): We should mark the existing reviews as abandoned.
-		logger.Infof("Ignoring review because the review ref '%s' does not exist", req.ReviewRef)
-		return
+		return nil
 	}
 
 	if len(existingReviews) > 0 {
 		// The change is still pending, but we already have existing reviews, so we should just update those.
-		for _, existing := range existingReviews {
-			arc.updateReviewDiffs(repo, existing, head, req, review)
+		existingReviews, err = reclaimAll(repo, revision, existingReviews, req)
+		if err != nil {
+			return err
 		}
-		return
+		return arc.updateAllReviewDiffs(repo, existingReviews, head, req, review)
 	}
 
 	diff, err := arc.createDifferentialDiff(repo, base, revision, req, []string{})
 	if err != nil {
-		orPanic(err)
+		return err
 	}
 	if diff == nil {
 		// The revision is already merged in, ignore it.
-		return
+		return nil
 	}
 	rev, err := arc.createDifferentialRevision(repo, revision, diff.ID, req)
 	if err != nil {
-		orPanic(err)
+		return err
 	}
 	logger.Infof("Created diff %v and revision %v for the review of %s", diff, rev, revision)
+	if err := store.SetSyncedRequest(repo.GetPath(), revision, requestHash(req)); err != nil {
+		return err
+	}
+	if err := recordLink(repo, revision, DifferentialReview{ID: strconv.Itoa(rev.RevisionID), Diffs: []string{strconv.Itoa(diff.ID)}, arc: arc}); err != nil {
+		return err
+	}
 
 	// If the review already contains multiple commits by the time we mirror it, then
 	// we need to ensure that at least the first and last ones are added.
-	existingReviews = arc.listDifferentialReviewsOrDie(revision)
-	for _, existing := range existingReviews {
-		arc.updateReviewDiffs(repo, existing, head, req, review)
+	existingReviews, err = arc.listDifferentialReviews(repo, revision)
+	if err != nil {
+		return err
+	}
+	return arc.updateAllReviewDiffs(repo, existingReviews, head, req, review)
+}
+
+// updateAllReviewDiffs runs updateReviewDiffs on each of the given reviews.
+//
+// A failure to update one review does not prevent the others from being updated.
+func (arc Arcanist) updateAllReviewDiffs(repo repository.Repo, differentialReviews []DifferentialReview, headCommit string, req request.Request, r review.Review) error {
+	var firstErr error
+	for _, differentialReview := range differentialReviews {
+		if err := arc.updateReviewDiffs(repo, differentialReview, headCommit, req, r); err != nil {
+			logger.Errorf("Failed to update the differential revision %s: %v", differentialReview.ID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
+	return firstErr
 }
 
 // lookSoonRequest specifies a list of callsigns (repo identifier) for repos that have recently changed.
@@ -719,16 +1165,12 @@ type lookSoonRequest struct {
 // Refresh advises the review tool that the code being reviewed has changed, and to reload it.
 //
 // This corresponds to calling the diffusion.looksoon API.
-func (arc Arcanist) Refresh(repo repository.Repo) {
-	// We cannot determine the repo's callsign (the identifier Phabricator uses for the repo)
-	// in all cases, but we can figure it out in the case that the mirror runs on the same
-	// directories that Phabricator is using. In that scenario, the repo directories default
-	// to being named "/var/repo/<CALLSIGN>", so if the repo path starts with that prefix then
-	// we can try to strip out that prefix and use the rest as a callsign.
-	if strings.HasPrefix(repo.GetPath(), defaultRepoDirPrefix) {
-		possibleCallsign := strings.TrimPrefix(repo.GetPath(), defaultRepoDirPrefix)
-		request := lookSoonRequest{Callsigns: []string{possibleCallsign}}
-		response := make(map[string]interface{})
-		runArcCommandOrDie("diffusion.looksoon", request, &response)
+func (arc Arcanist) Refresh(repo repository.Repo) error {
+	callsign := arc.callsign(repo)
+	if callsign == "" {
+		return nil
 	}
+	request := lookSoonRequest{Callsigns: []string{callsign}}
+	response := make(map[string]interface{})
+	return arc.callConduit("diffusion.looksoon", request, &response)
 }
@@ -17,10 +17,14 @@ limitations under the License.
 package arcanist
 
 import (
+	"github.com/akatrevorjay/git-appraise/repository"
 	"github.com/akatrevorjay/git-appraise/review"
 	"github.com/akatrevorjay/git-appraise/review/analyses"
 	"github.com/akatrevorjay/git-appraise/review/ci"
 	"github.com/akatrevorjay/git-appraise/review/comment"
+	"github.com/akatrevorjay/git-appraise/review/request"
+	review_utils "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
 	"strings"
 	"testing"
 )
@@ -64,6 +68,7 @@ func TestGenerateCommentRequests(t *testing.T) {
 					Path:   "hello.txt",
 					Range: &comment.Range{
 						StartLine: 42,
+						EndLine:   45,
 					},
 				},
 				Description: "A line comment",
@@ -71,12 +76,23 @@ func TestGenerateCommentRequests(t *testing.T) {
 			},
 		},
 	}
-	inlineRequests, commentRequests := diffReview.buildCommentRequests(comments, nil, commitToDiffMap)
+	inlineRequests, commentRequests := diffReview.buildCommentRequests("/repo", comments, nil, commitToDiffMap)
 	if inlineRequests == nil || commentRequests == nil {
 		t.Errorf("Failed to build the comment requests: %v, %v", inlineRequests, commentRequests)
 	}
-	if len(commentRequests) != 1 || commentRequests[0].RevisionID != revisionID || commentRequests[0].Action != "comment" {
-		t.Errorf("Bad comment requests: %v", commentRequests)
+	if len(commentRequests) != 2 {
+		t.Fatalf("Unexpected number of comment requests: %v", commentRequests)
+	}
+	for _, r := range commentRequests {
+		if r.RevisionID != revisionID || r.Action != "comment" {
+			t.Errorf("Bad comment request: %v", r)
+		}
+	}
+	if commentRequests[0].Message != "example@example.com:\n\nA review comment" || commentRequests[0].AttachInlines {
+		t.Errorf("Unexpected review comment request: %v", commentRequests[0])
+	}
+	if !commentRequests[1].AttachInlines || commentRequests[1].Message != "" {
+		t.Errorf("Unexpected inline comment request: %v", commentRequests[1])
 	}
 	if len(inlineRequests) != 2 {
 		t.Errorf("Unexpected number of inline requests: %v", inlineRequests)
@@ -97,14 +113,207 @@ func TestGenerateCommentRequests(t *testing.T) {
 	}
 	firstInline := inlineRequests[0]
 	secondInline := inlineRequests[1]
-	if firstInline.DiffID != "1" || !strings.HasSuffix(firstInline.Content, "A file comment") || firstInline.LineNumber != 1 {
+	if firstInline.DiffID != "1" || !strings.HasSuffix(firstInline.Content, "A file comment") || firstInline.LineNumber != 1 || firstInline.LineLength != 0 {
 		t.Errorf("Unexpected first inline request: %v", firstInline)
 	}
-	if secondInline.DiffID != "2" || !strings.HasSuffix(secondInline.Content, "A line comment") || secondInline.LineNumber != 42 {
+	if secondInline.DiffID != "2" || !strings.HasSuffix(secondInline.Content, "A line comment") || secondInline.LineNumber != 42 || secondInline.LineLength != 3 {
 		t.Errorf("Unexpected second inline request: %v", secondInline)
 	}
 }
 
+func TestGenerateCommentRequestsSkipsMirroredComments(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	diffReview := DifferentialReview{ID: "testReview"}
+	commitToDiffMap := map[string]string{"ABCD": "1"}
+	location := &comment.Location{Commit: "ABCD", Path: "hello.txt"}
+	comments := []review.CommentThread{
+		review.CommentThread{
+			Hash:    "linked",
+			Comment: comment.Comment{Author: "example@example.com", Location: location, Description: "Edited in Phabricator"},
+		},
+		review.CommentThread{
+			Hash:    "legacy",
+			Comment: comment.Comment{Author: "example@example.com", Location: location, Description: "A legacy comment"},
+		},
+		review.CommentThread{
+			Hash:    "new",
+			Comment: comment.Comment{Author: "example@example.com", Location: location, Description: "A new comment"},
+		},
+	}
+	existingComments := []review_utils.PhabricatorComment{
+		review_utils.PhabricatorComment{
+			PHID:    "PHID-XCMT-1",
+			Comment: comment.Comment{Author: "mirror@example.com", Location: location, Description: "Rewritten by Remarkup"},
+		},
+		review_utils.PhabricatorComment{
+			PHID:    "PHID-XCMT-2",
+			Comment: comment.Comment{Author: "mirror@example.com", Location: location, Description: "example@example.com:\n\nA legacy comment"},
+		},
+	}
+	if err := store.LinkComment("/repo", "linked", "PHID-XCMT-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	inlineRequests, _ := diffReview.buildCommentRequests("/repo", comments, existingComments, commitToDiffMap)
+	if len(inlineRequests) != 1 || inlineRequests[0].CommentHash != "new" {
+		t.Errorf("Unexpected inline requests: %v", inlineRequests)
+	}
+	if phid := store.GetCommentPHID("/repo", "legacy"); phid != "PHID-XCMT-2" {
+		t.Errorf("The legacy comment was not linked: %q", phid)
+	}
+}
+
+func TestGenerateCommentRequestsForReplies(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	diffReview := DifferentialReview{ID: "testReview"}
+	commitToDiffMap := map[string]string{"ABCD": "1"}
+	location := &comment.Location{Commit: "ABCD", Path: "hello.txt", Range: &comment.Range{StartLine: 7}}
+	comments := []review.CommentThread{
+		review.CommentThread{
+			Hash:    "published",
+			Comment: comment.Comment{Author: "example@example.com", Location: location, Description: "Published"},
+			Children: []review.CommentThread{
+				review.CommentThread{
+					Hash:    "reply",
+					Comment: comment.Comment{Author: "other@example.com", Description: "A reply"},
+					Children: []review.CommentThread{
+						review.CommentThread{
+							Hash:    "nested",
+							Comment: comment.Comment{Author: "example@example.com", Description: "A nested reply"},
+						},
+					},
+				},
+			},
+		},
+		review.CommentThread{
+			Hash:    "new",
+			Comment: comment.Comment{Author: "example@example.com", Location: location, Description: "New"},
+			Children: []review.CommentThread{
+				review.CommentThread{
+					Hash:    "pending",
+					Comment: comment.Comment{Author: "other@example.com", Description: "A pending reply"},
+				},
+			},
+		},
+	}
+	if err := store.LinkComment("/repo", "published", "PHID-XCMT-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending reply was mirrored before replies referred to their parents.
+	existingComments := []review_utils.PhabricatorComment{
+		review_utils.PhabricatorComment{
+			PHID:    "PHID-XCMT-2",
+			Comment: comment.Comment{Author: "mirror@example.com", Location: location, Description: "other@example.com:\n\nA pending reply"},
+		},
+	}
+
+	inlineRequests, _ := diffReview.buildCommentRequests("/repo", comments, existingComments, commitToDiffMap)
+	expected := []struct {
+		hash, content string
+	}{
+		{"reply", "other@example.com:\n\nIn reply to example@example.com:\n> Published\n\nA reply"},
+		{"nested", "example@example.com:\n\nIn reply to other@example.com:\n> A reply\n\nA nested reply"},
+		{"new", "example@example.com:\n\nNew"},
+	}
+	if len(inlineRequests) != len(expected) {
+		t.Fatalf("Unexpected inline requests: %v", inlineRequests)
+	}
+	for i, request := range inlineRequests {
+		if request.CommentHash != expected[i].hash || request.Content != expected[i].content ||
+			request.FilePath != "hello.txt" || request.LineNumber != 7 {
+			t.Errorf("Unexpected inline request %d: %v", i, request)
+		}
+	}
+	if phid := store.GetCommentPHID("/repo", "pending"); phid != "PHID-XCMT-2" {
+		t.Errorf("The previously mirrored reply was not linked: %q", phid)
+	}
+}
+
+func TestMirrorTopLevelComments(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	diffReview := DifferentialReview{ID: "1", PHID: "PHID-DREV-1"}
+	resolved := true
+	comments := []review.CommentThread{
+		review.CommentThread{
+			Hash:    "lgtm",
+			Comment: comment.Comment{Author: "example@example.com", Resolved: &resolved},
+		},
+		review.CommentThread{
+			Hash:    "commit",
+			Comment: comment.Comment{Author: "example@example.com", Location: &comment.Location{Commit: "ABCD"}, Description: "Split this up"},
+			Children: []review.CommentThread{
+				review.CommentThread{
+					Hash:    "reply",
+					Comment: comment.Comment{Author: "other@example.com", Description: "Done"},
+				},
+			},
+		},
+		review.CommentThread{
+			Hash:    "mirrored",
+			Comment: comment.Comment{Author: "example@example.com", Description: "Already mirrored"},
+		},
+	}
+	if err := store.LinkComment("/repo", "mirrored", "PHID-XCMT-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	inlineRequests, commentRequests := diffReview.buildCommentRequests("/repo", comments, nil, nil)
+	if len(inlineRequests) != 0 || len(commentRequests) != 3 {
+		t.Fatalf("Unexpected requests: %v, %v", inlineRequests, commentRequests)
+	}
+	expected := []createCommentRequest{
+		{RevisionID: "1", Action: "comment", CommentHash: "lgtm", Message: "example@example.com:\n\nLGTM"},
+		{RevisionID: "1", Action: "comment", CommentHash: "commit", Message: "example@example.com:\n\n(On commit ABCD)\n\nSplit this up"},
+		{RevisionID: "1", Action: "comment", CommentHash: "reply", Message: "other@example.com:\n\nDone"},
+	}
+	for i, request := range commentRequests {
+		if request != expected[i] {
+			t.Errorf("Unexpected comment request %d: %v", i, request)
+		}
+	}
+
+	mock := newMockConduit(map[string][]string{
+		"transaction.search": []string{`{"response": {"data": [
+    {"phid": "PHID-XACT-3", "type": "comment", "authorPHID": "u1", "dateCreated": 3,
+     "comments": [{"id": 3, "phid": "PHID-XCMT-3", "removed": false, "content": {"raw": "other@example.com:\n\nDone"}}], "fields": {}},
+    {"phid": "PHID-XACT-2", "type": "comment", "authorPHID": "u1", "dateCreated": 2,
+     "comments": [{"id": 2, "phid": "PHID-XCMT-2", "removed": false, "content": {"raw": "example@example.com:\n\nLGTM"}}], "fields": {}}
+  ], "cursor": {"after": null}}}`},
+	})
+	withMockConduit(mock, func() {
+		commentHashesByMessage := map[string][]string{
+			expected[0].Message: []string{"lgtm"},
+			expected[2].Message: []string{"reply"},
+		}
+		if err := diffReview.linkPublishedComments(&repository.GitRepo{Path: "/repo"}, nil, commentHashesByMessage); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if phid := store.GetCommentPHID("/repo", "lgtm"); phid != "PHID-XCMT-2" {
+		t.Errorf("The LGTM was not linked: %q", phid)
+	}
+	if phid := store.GetCommentPHID("/repo", "reply"); phid != "PHID-XCMT-3" {
+		t.Errorf("The reply was not linked: %q", phid)
+	}
+
+	// Comments that were mirrored before their links were recorded are matched by their descriptions.
+	SetStore(state.NewMemoryStore())
+	existingComments := []review_utils.PhabricatorComment{
+		{PHID: "PHID-XCMT-4", Comment: comment.Comment{Author: "bot", Description: expected[0].Message}},
+		{PHID: "PHID-XCMT-5", Comment: comment.Comment{Author: "bot", Description: expected[1].Message}},
+		{PHID: "PHID-XCMT-6", Comment: comment.Comment{Author: "bot", Description: expected[2].Message}},
+		{PHID: "PHID-XCMT-7", Comment: comment.Comment{Author: "bot", Description: "example@example.com:\n\nAlready mirrored"}},
+	}
+	inlineRequests, commentRequests = diffReview.buildCommentRequests("/repo", comments, existingComments, nil)
+	if len(inlineRequests) != 0 || len(commentRequests) != 0 {
+		t.Errorf("Mirrored comments were mirrored again: %v, %v", inlineRequests, commentRequests)
+	}
+	if phid := store.GetCommentPHID("/repo", "commit"); phid != "PHID-XCMT-5" {
+		t.Errorf("The commit-level comment was not linked: %q", phid)
+	}
+}
+
 func TestGenerateUnitDiffProperty(t *testing.T) {
 	emptyReport := ci.Report{}
 	statusOnlyReport := ci.Report{
@@ -210,3 +419,69 @@ func TestGenerateLintDiffProperty(t *testing.T) {
 		t.Errorf("Wrong conversion for the non-trivial analysis results: %q", prop)
 	}
 }
+
+func TestRefreshUsesCallsign(t *testing.T) {
+	mock := newMockConduit(map[string][]string{
+		"diffusion.looksoon": []string{`{}`, `{}`},
+	})
+	withMockConduit(mock, func() {
+		if err := (Arcanist{Callsign: "APP"}).Refresh(&repository.GitRepo{Path: "/elsewhere/app"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := (Arcanist{RepoDirPrefix: "/srv/"}).Refresh(&repository.GitRepo{Path: "/srv/GUESS"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := (Arcanist{}).Refresh(&repository.GitRepo{Path: "/elsewhere/app"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	requests := mock.Requests["diffusion.looksoon"]
+	if len(requests) != 2 || requests[0] != `{"callsigns":["APP"]}` || requests[1] != `{"callsigns":["GUESS"]}` {
+		t.Errorf("Unexpected refresh requests: %v", requests)
+	}
+}
+
+func TestListClosedReviews(t *testing.T) {
+	mock := newMockConduit(map[string][]string{
+		"diffusion.repository.search":  []string{`{"response": {"data": [{"phid": "PHID-REPO-CLOSED"}]}}`},
+		"differential.revision.search": []string{`{"response": {"data": [{"id": 9}, {"id": 7}], "cursor": {"after": "7"}}}`},
+		"differential.query":           []string{`{"response": [{"id": "7", "reviewers": []}, {"id": "9", "reviewers": []}]}`},
+	})
+	var reviews []review_utils.PhabricatorReview
+	var next string
+	withMockConduit(mock, func() {
+		var err error
+		reviews, next, err = Arcanist{Callsign: "CLOSED"}.ListClosedReviews(repository.NewMockRepoForTest(), "10", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	searches := mock.Requests["differential.revision.search"]
+	if len(searches) != 1 || searches[0] != `{"constraints":{"statuses":["published","abandoned"],"repositoryPHIDs":["PHID-REPO-CLOSED"]},"order":"newest","limit":2,"after":"10"}` {
+		t.Errorf("Unexpected revision searches: %v", searches)
+	}
+	if len(reviews) != 2 || reviews[0].(DifferentialReview).ID != "9" || reviews[1].(DifferentialReview).ID != "7" || next != "7" {
+		t.Errorf("Unexpected closed reviews: %v, %q", reviews, next)
+	}
+}
+
+func TestCreateRevisionAddsReviewers(t *testing.T) {
+	mock := newMockConduit(map[string][]string{
+		"user.query": []string{
+			`{"response": [{"phid": "PHID-USER-REQUESTED", "userName": "requested-reviewer"}]}`,
+			`{"response": [{"phid": "PHID-USER-CONFIGURED", "userName": "configured-reviewer"}]}`,
+		},
+		"differential.createrevision": []string{`{"response": {"revisionid": 7}}`},
+	})
+	withMockConduit(mock, func() {
+		arc := Arcanist{Reviewers: []string{"requested-reviewer", "configured-reviewer"}}
+		req := request.Request{Description: "Title", Reviewers: []string{"requested-reviewer"}}
+		if _, err := arc.createDifferentialRevision(nil, "ABCD", 1, req); err != nil {
+			t.Fatal(err)
+		}
+	})
+	requests := mock.Requests["differential.createrevision"]
+	if len(requests) != 1 || !strings.Contains(requests[0], `"reviewerPHIDs":["PHID-USER-REQUESTED","PHID-USER-CONFIGURED"]`) {
+		t.Errorf("Unexpected revision requests: %v", requests)
+	}
+}
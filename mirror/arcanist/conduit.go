@@ -0,0 +1,243 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ConduitCaller issues calls against Phabricator's Conduit API.
+//
+// Responses are decoded using the same envelope that "arc call-conduit" prints, i.e. a JSON
+// object with "error", "errorMessage", and "response" fields, so that the request and response
+// types in this package do not depend on how the call was made.
+type ConduitCaller interface {
+	Call(method string, request interface{}, response interface{}) error
+}
+
+// conduit is the ConduitCaller used for every API call made by this package.
+var conduit ConduitCaller = arcCaller{}
+
+// SetConduit replaces the ConduitCaller used for all subsequent API calls.
+func SetConduit(caller ConduitCaller) {
+	conduit = caller
+}
+
+// arcCaller issues Conduit calls by running the "arc call-conduit" command.
+type arcCaller struct{}
+
+func (arcCaller) Call(method string, request interface{}, response interface{}) error {
+	cmd := exec.Command("arc", "call-conduit", method)
+	input, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = bytes.NewReader(input)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		time.Sleep(arcanistRequestTimeout)
+		cmd.Process.Kill()
+	}()
+	if err := cmd.Wait(); err != nil {
+		logger.Error("Error running", "arc", "call-conduit", method, string(input), stdout.String())
+		return err
+	}
+	logger.Debugf("Received conduit response %s", prettyJSONString(stdout.Bytes()))
+	return json.Unmarshal(stdout.Bytes(), response)
+}
+
+// Conduit is a native HTTP client for Phabricator's Conduit API.
+type Conduit struct {
+	// URI is the base URI of the Phabricator instance, e.g. "https://phabricator.example.com/".
+	URI string
+	// Token is the Conduit API token used to authenticate requests.
+	Token string
+	// Client is the HTTP client used to issue requests.
+	Client *http.Client
+}
+
+// NewConduit returns a Conduit client for the given Phabricator instance and API token.
+func NewConduit(uri, token string) *Conduit {
+	return &Conduit{
+		URI:    NormalizeConduitURI(uri),
+		Token:  token,
+		Client: &http.Client{Timeout: arcanistRequestTimeout},
+	}
+}
+
+// NormalizeConduitURI strips any trailing "api/" path from the given URI, and ensures it ends with a slash.
+//
+// Arcanist stores the hosts in the ".arcrc" file with the "api/" suffix, while its default
+// host setting omits it, so we normalize both to the same form.
+func NormalizeConduitURI(uri string) string {
+	uri = strings.TrimSuffix(uri, "/")
+	uri = strings.TrimSuffix(uri, "/api")
+	return uri + "/"
+}
+
+// conduitMeta carries the authentication parameters for a Conduit request.
+type conduitMeta struct {
+	Token string `json:"token,omitempty"`
+}
+
+// conduitResponse models the raw response envelope returned by the Conduit API.
+type conduitResponse struct {
+	Result    json.RawMessage `json:"result"`
+	ErrorCode *string         `json:"error_code"`
+	ErrorInfo *string         `json:"error_info"`
+}
+
+// arcResponse models the response envelope printed by "arc call-conduit".
+type arcResponse struct {
+	Error        string          `json:"error"`
+	ErrorMessage string          `json:"errorMessage"`
+	Response     json.RawMessage `json:"response"`
+}
+
+// buildParams merges the authentication parameters into the JSON-encoded request.
+func (c *Conduit) buildParams(request interface{}) ([]byte, error) {
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	params := make(map[string]interface{})
+	if err := json.Unmarshal(requestBytes, &params); err != nil {
+		return nil, fmt.Errorf("Conduit requests must be JSON objects: %s", string(requestBytes))
+	}
+	params["__conduit__"] = conduitMeta{Token: c.Token}
+	return json.Marshal(params)
+}
+
+// Call issues the given Conduit API method over HTTP, and decodes the result into response.
+func (c *Conduit) Call(method string, request interface{}, response interface{}) error {
+	params, err := c.buildParams(request)
+	if err != nil {
+		return err
+	}
+	form := url.Values{}
+	form.Set("params", string(params))
+	form.Set("output", "json")
+	form.Set("__conduit__", "1")
+
+	httpResponse, err := c.Client.PostForm(c.URI+"api/"+method, form)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("Conduit request %s failed with status %q: %s", method, httpResponse.Status, string(body))
+	}
+	logger.Debugf("Received conduit response %s", prettyJSONString(body))
+
+	var raw conduitResponse
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+	translated := arcResponse{Response: raw.Result}
+	if raw.ErrorCode != nil {
+		translated.Error = *raw.ErrorCode
+	}
+	if raw.ErrorInfo != nil {
+		translated.ErrorMessage = *raw.ErrorInfo
+	}
+	if len(translated.Response) == 0 {
+		translated.Response = json.RawMessage("null")
+	}
+	translatedBytes, err := json.Marshal(translated)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(translatedBytes, response)
+}
+
+// arcrc models the subset of the arcanist configuration file that we use.
+type arcrc struct {
+	Hosts map[string]struct {
+		Token string `json:"token"`
+	} `json:"hosts"`
+	Config struct {
+		Default string `json:"default"`
+	} `json:"config"`
+}
+
+// DefaultArcrcPath returns the location where arcanist looks for its configuration file.
+func DefaultArcrcPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".arcrc")
+}
+
+// readArcrc parses the arcanist configuration file at the given path.
+func readArcrc(path string) (*arcrc, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config arcrc
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse %q: %v", path, err)
+	}
+	return &config, nil
+}
+
+// NewConduitFromArcrc builds a Conduit client using the settings in the given ".arcrc" file.
+//
+// Either of the uri or token arguments may be empty, in which case the value is read from
+// the file. The URI defaults to the file's default host, and the token to the one stored
+// for that host.
+func NewConduitFromArcrc(path, uri, token string) (*Conduit, error) {
+	if uri == "" || token == "" {
+		config, err := readArcrc(path)
+		if err != nil {
+			return nil, err
+		}
+		if uri == "" {
+			uri = config.Config.Default
+		}
+		if uri == "" {
+			return nil, fmt.Errorf("No Phabricator URI specified, and %q does not set a default", path)
+		}
+		if token == "" {
+			for host, credentials := range config.Hosts {
+				if NormalizeConduitURI(host) == NormalizeConduitURI(uri) {
+					token = credentials.Token
+				}
+			}
+		}
+		if token == "" {
+			return nil, fmt.Errorf("No Conduit token for %q found in %q", uri, path)
+		}
+	}
+	return NewConduit(uri, token), nil
+}
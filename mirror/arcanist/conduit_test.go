@@ -0,0 +1,133 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestConduitServer(t *testing.T, token string, results map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.PostForm.Get("output") != "json" {
+			t.Errorf("Unexpected output format: %q", r.PostForm.Get("output"))
+		}
+		var params struct {
+			Conduit conduitMeta `json:"__conduit__"`
+		}
+		if err := json.Unmarshal([]byte(r.PostForm.Get("params")), &params); err != nil {
+			t.Fatal(err)
+		}
+		if params.Conduit.Token != token {
+			w.Write([]byte(`{"result":null,"error_code":"ERR-INVALID-AUTH","error_info":"Bad token"}`))
+			return
+		}
+		result, ok := results[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"result":` + result + `,"error_code":null,"error_info":null}`))
+	}))
+}
+
+func TestConduitCall(t *testing.T) {
+	server := newTestConduitServer(t, "api-token", map[string]string{
+		"/api/user.whoami": `{"phid":"PHID-USER-1","userName":"mirror"}`,
+		"/api/user.query":  `[{"phid":"PHID-USER-2","primaryEmail":"foo@bar.com"}]`,
+	})
+	defer server.Close()
+
+	c := NewConduit(server.URL+"/api/", "api-token")
+	var whoAmI whoAmIResponse
+	if err := c.Call("user.whoami", struct{}{}, &whoAmI); err != nil {
+		t.Fatal(err)
+	}
+	if whoAmI.Error != "" || whoAmI.Response.PHID != "PHID-USER-1" || whoAmI.Response.UserName != "mirror" {
+		t.Errorf("Unexpected user.whoami response: %v", whoAmI)
+	}
+
+	var query userQueryResponse
+	if err := c.Call("user.query", userQueryRequest{Emails: []string{"foo@bar.com"}}, &query); err != nil {
+		t.Fatal(err)
+	}
+	if len(query.Response) != 1 || query.Response[0].Email != "foo@bar.com" {
+		t.Errorf("Unexpected user.query response: %v", query)
+	}
+
+	if err := c.Call("differential.missing", struct{}{}, &query); err == nil {
+		t.Errorf("Expected an error for a failed HTTP request")
+	}
+
+	unauthorized := NewConduit(server.URL, "wrong-token")
+	var failed whoAmIResponse
+	if err := unauthorized.Call("user.whoami", struct{}{}, &failed); err != nil {
+		t.Fatal(err)
+	}
+	if failed.Error != "ERR-INVALID-AUTH" || failed.ErrorMessage != "Bad token" {
+		t.Errorf("Conduit error was not translated: %v", failed)
+	}
+}
+
+func TestNewConduitFromArcrc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arcrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".arcrc")
+	contents := `{
+  "hosts": {
+    "https://phabricator.example.com/api/": {"token": "api-default"},
+    "https://other.example.com/api/": {"token": "api-other"}
+  },
+  "config": {"default": "https://phabricator.example.com"}
+}`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewConduitFromArcrc(path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.URI != "https://phabricator.example.com/" || c.Token != "api-default" {
+		t.Errorf("Unexpected default conduit settings: %v", c)
+	}
+	c, err = NewConduitFromArcrc(path, "https://other.example.com/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.URI != "https://other.example.com/" || c.Token != "api-other" {
+		t.Errorf("Unexpected conduit settings: %v", c)
+	}
+	if _, err := NewConduitFromArcrc(path, "https://unknown.example.com/", ""); err == nil {
+		t.Errorf("Expected an error for a host with no credentials")
+	}
+	c, err = NewConduitFromArcrc(filepath.Join(dir, "missing"), "https://unknown.example.com/", "api-flag")
+	if err != nil || c.Token != "api-flag" {
+		t.Errorf("Explicit settings should not require an arcrc file: %v, %v", c, err)
+	}
+}
@@ -18,8 +18,9 @@ package arcanist
 
 // This is far from ideal.
 //
-// Phabricator does not currently provide any sort of API for quering the code review comments.
-// To work around this, we directly query the underlying database tables.
+// Older versions of Phabricator do not provide any sort of API for quering the code review comments.
+// To work around this, we can directly query the underlying database tables. Newer versions
+// provide the "transaction.search" API method, which is used by default (see transactions.go).
 //
 // There are three tables from which we need to read, all under the "phabricator_differential" schema:
 //  differential_transaction stores the top level code review actions, like commenting.
@@ -27,100 +28,43 @@ package arcanist
 //  differential_changeset stores the diffs against which a comment was made.
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
-	"github.com/akatrevorjay/git-appraise/review/comment"
-	"os/exec"
-	"strconv"
-	"strings"
 	"time"
+
+	"github.com/akatrevorjay/git-appraise/review/comment"
+	review_utils "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
+	// Register the MySQL driver used to connect to the Phabricator database.
+	_ "github.com/go-sql-driver/mysql"
 )
 
 const (
 	// SQL query for differential "transactions". These are atomic operations on a review.
-	selectTransactionsQueryTemplate = `
-select id, phid, authorPHID, dateCreated, transactionType, newValue, commentPHID
+	selectTransactionsQuery = `
+select phid, authorPHID, dateCreated, transactionType, newValue, commentPHID
   from phabricator_differential.differential_transaction
-	where objectPHID="%s"
-		and viewPolicy="public"
-		and (transactionType = "differential:action" or
-     transactionType = "differential:inline" or
-     transactionType = "core:comment")
-  order by id;`
+  where objectPHID = ?
+    and viewPolicy = 'public'
+    and transactionType in ('differential:action', 'differential:inline', 'core:comment')
+  order by id`
 	// SQL query for differential "transaction comments". These are always tied
 	// to a differential "transaction" and include the body of a review comment.
-	selectTransactionCommentsQueryTemplate = `
-select phid, changesetID, lineNumber, replyToCommentPHID
-	from phabricator_differential.differential_transaction_comment
-	where viewPolicy = "public" and transactionPHID = "%s";`
-	// SQL query for the contents of a differential "transaction comment". This
-	// is separated from the query for the other fields so that we don't have to
-	// worry about contents that include tabs, which mysql uses as the separator
-	// between multiple column values.
-	selectCommentContentsQueryTemplate = `
-select content from phabricator_differential.differential_transaction_comment
-	where phid = "%s";`
-	// SQL query to read the filename for a diff.
-	selectChangesetFilenameTemplate = `
-select filename from phabricator_differential.differential_changeset
-	where id = "%d";`
-	// SQL query to read the ID for a diff. We need this in order to be able
-	// to read the commit hash for a diff (which we do using the Differential API).
-	selectChangesetDiffTemplate = `
-select diffID from phabricator_differential.differential_changeset
-	where id = "%d";`
+	//
+	// The changeset is joined in so that we also read the filename and diff ID against
+	// which the comment was made. We need the diff ID in order to be able to read the
+	// commit hash for a diff (which we do using the Differential API).
+	selectTransactionCommentQuery = `
+select c.id, c.phid, c.lineNumber, c.lineLength, c.replyToCommentPHID, c.content, cs.filename, cs.diffID
+  from phabricator_differential.differential_transaction_comment c
+  left join phabricator_differential.differential_changeset cs on cs.id = c.changesetID
+  where c.viewPolicy = 'public' and c.transactionPHID = ?`
 
 	// Timeout used for all SQL queries
 	sqlQueryTimeout = 1 * time.Minute
 )
 
-// runRawSqlCommandOrDie runs the given SQL command with no additional formatting
-// included in the output.
-//
-// Any errors that could occur here would be a sign of something being seriously
-// wrong, so they are treated as fatal. This makes it more evident that something
-// has gone wrong when the command is manually run by a user, and gives further
-// operations a clean-slate when this is run by supervisord with automatic restarts.
-func runRawSqlCommandOrDie(command string) string {
-	cmd := exec.Command("mysql", "-Ns", "-r", "-e", command)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Start()
-	go func() {
-		time.Sleep(sqlQueryTimeout)
-		cmd.Process.Kill()
-	}()
-	if err := cmd.Wait(); err != nil {
-		logger.Infof("Ran SQL command: ", command)
-		orPanic(err)
-	}
-	result := strings.TrimSuffix(stdout.String(), "\n")
-	return result
-}
-
-// runRawSqlCommandOrDie runs the given SQL command.
-//
-// Any errors that could occur here would be a sign of something being seriously
-// wrong, so they are treated as fatal. This makes it more evident that something
-// has gone wrong when the command is manually run by a user, and gives further
-// operations a clean-slate when this is run by supervisord with automatic restarts.
-func runSqlCommandOrDie(command string) string {
-	cmd := exec.Command("mysql", "-Ns", "-e", command)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Start()
-	go func() {
-		time.Sleep(sqlQueryTimeout)
-		cmd.Process.Kill()
-	}()
-	if err := cmd.Wait(); err != nil {
-		logger.Infof("Ran SQL command: ", command)
-		orPanic(err)
-	}
-	result := strings.Trim(stdout.String(), "\n")
-	return result
-}
-
 // differentialDatabaseTransaction represents a user action on a code review.
 //
 // This includes things like approving or rejecting the change and commenting.
@@ -137,110 +81,233 @@ type differentialDatabaseTransaction struct {
 
 type ReadTransactions func(reviewID string) ([]differentialDatabaseTransaction, error)
 
-func readDatabaseTransactions(reviewID string) ([]differentialDatabaseTransaction, error) {
-	var transactions []differentialDatabaseTransaction
-	result := runSqlCommandOrDie(fmt.Sprintf(selectTransactionsQueryTemplate, reviewID))
-	if strings.Trim(result, " ") == "" {
-		// There were no matching transactions
-		return nil, nil
-	}
-	// result will be a line-separated list of query results, each of which has 7 columns.
-	for _, line := range strings.Split(result, "\n") {
-		lineParts := strings.Split(line, "\t")
-		if len(lineParts) != 7 {
-			return nil, fmt.Errorf("Unexpected number of transaction parts: %v", lineParts)
-		}
-		var transaction differentialDatabaseTransaction
-		transaction.PHID = lineParts[1]
-		transaction.AuthorPHID = lineParts[2]
-		timestamp, err := strconv.ParseUint(lineParts[3], 10, 32)
-		if err != nil {
-			return nil, err
-		}
-		transaction.DateCreated = uint32(timestamp)
-		transaction.Type = lineParts[4]
-		if lineParts[5] != "NULL" {
-			transaction.NewValue = &lineParts[5]
-		}
-		if lineParts[6] != "NULL" {
-			transaction.CommentPHID = &lineParts[6]
-		}
-		transactions = append(transactions, transaction)
-	}
-	return transactions, nil
-}
-
 // differentialDatabaseTransactionComment stores the actual contents of a code review comment.
 type differentialDatabaseTransactionComment struct {
-	PHID               string
-	Commit             string
-	FileName           string
-	LineNumber         uint32
+	ID         int
+	PHID       string
+	Commit     string
+	FileName   string
+	LineNumber uint32
+	// LineLength is the number of lines after LineNumber that the comment also spans.
+	LineLength         uint32
 	ReplyToCommentPHID *string
 	Content            string
 }
 
 type ReadTransactionComment func(transactionID string) (*differentialDatabaseTransactionComment, error)
 
-func readDatabaseTransactionComment(transactionID string) (*differentialDatabaseTransactionComment, error) {
-	result := runSqlCommandOrDie(fmt.Sprintf(selectTransactionCommentsQueryTemplate, transactionID))
-	// result will be a line separated list of query results, each of which includes 4 columns.
-	lines := strings.Split(result, "\n")
-	if len(lines) != 1 {
-		return nil, fmt.Errorf("Unexpected number of query results: %v", lines)
+// transactionDatabase reads review transactions directly from the Phabricator database.
+type transactionDatabase struct {
+	db                       *sql.DB
+	selectTransactions       *sql.Stmt
+	selectTransactionComment *sql.Stmt
+}
+
+// transactionDB is the database from which review transactions are read, or nil if they
+// should be read using the Conduit API.
+var transactionDB *transactionDatabase
+
+// UseTransactionDatabase connects to the Phabricator MySQL database with the given DSN,
+// and reads all subsequent review transactions from it rather than through Conduit.
+//
+// The DSN uses the format of the Go MySQL driver, e.g. "user:password@tcp(host:3306)/".
+func UseTransactionDatabase(dsn string) error {
+	database, err := openTransactionDatabase("mysql", dsn)
+	if err != nil {
+		return err
 	}
-	lineParts := strings.Split(lines[0], "\t")
-	if len(lineParts) != 4 {
-		return nil, fmt.Errorf("Unexpected size of query results: %v", lineParts)
+	transactionDB = database
+	return nil
+}
+
+// CheckTransactionDatabase verifies that we can connect to the Phabricator MySQL database with the given DSN.
+func CheckTransactionDatabase(dsn string) error {
+	database, err := openTransactionDatabase("mysql", dsn)
+	if err != nil {
+		return err
 	}
-	var comment differentialDatabaseTransactionComment
-	comment.PHID = lineParts[0]
-	if lineParts[1] != "NULL" {
-		changesetID, err := strconv.ParseUint(lineParts[1], 10, 32)
-		if err != nil {
+	defer database.db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), sqlQueryTimeout)
+	defer cancel()
+	return database.db.PingContext(ctx)
+}
+
+func openTransactionDatabase(driverName, dsn string) (*transactionDatabase, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	selectTransactions, err := db.Prepare(selectTransactionsQuery)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	selectTransactionComment, err := db.Prepare(selectTransactionCommentQuery)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &transactionDatabase{
+		db:                       db,
+		selectTransactions:       selectTransactions,
+		selectTransactionComment: selectTransactionComment,
+	}, nil
+}
+
+// nullableString returns a pointer to the given string's value, or nil if it is NULL.
+func nullableString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	value := s.String
+	return &value
+}
+
+// ReadTransactions reads all of the mirrored transactions for the given review, oldest first.
+func (database *transactionDatabase) ReadTransactions(reviewID string) ([]differentialDatabaseTransaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlQueryTimeout)
+	defer cancel()
+	rows, err := database.selectTransactions.QueryContext(ctx, reviewID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transactions []differentialDatabaseTransaction
+	for rows.Next() {
+		var transaction differentialDatabaseTransaction
+		var newValue, commentPHID sql.NullString
+		if err := rows.Scan(&transaction.PHID, &transaction.AuthorPHID, &transaction.DateCreated,
+			&transaction.Type, &newValue, &commentPHID); err != nil {
 			return nil, err
 		}
-		changesetResult := runSqlCommandOrDie(fmt.Sprintf(selectChangesetFilenameTemplate, changesetID))
-		// changesetResult should have a single query result, which only includes the filename.
-		comment.FileName = changesetResult
-		diffIDResult := runSqlCommandOrDie(fmt.Sprintf(selectChangesetDiffTemplate, changesetID))
-		diffID, err := strconv.Atoi(diffIDResult)
-		if err != nil {
-			logger.Infof(diffIDResult)
-			orPanic(err)
+		transaction.NewValue = nullableString(newValue)
+		transaction.CommentPHID = nullableString(commentPHID)
+		transactions = append(transactions, transaction)
+	}
+	return transactions, rows.Err()
+}
+
+// ReadTransactionComment reads the comment attached to the given transaction.
+func (database *transactionDatabase) ReadTransactionComment(transactionID string) (*differentialDatabaseTransactionComment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlQueryTimeout)
+	defer cancel()
+	rows, err := database.selectTransactionComment.QueryContext(ctx, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []differentialDatabaseTransactionComment
+	var diffIDs []sql.NullInt64
+	for rows.Next() {
+		var c differentialDatabaseTransactionComment
+		var replyToCommentPHID, fileName sql.NullString
+		var diffID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.PHID, &c.LineNumber, &c.LineLength, &replyToCommentPHID, &c.Content, &fileName, &diffID); err != nil {
+			return nil, err
 		}
-		diff, err := readDiff(diffID)
+		c.ReplyToCommentPHID = nullableString(replyToCommentPHID)
+		c.FileName = fileName.String
+		comments = append(comments, c)
+		diffIDs = append(diffIDs, diffID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(comments) != 1 {
+		return nil, fmt.Errorf("Unexpected number of comments for transaction %q: %d", transactionID, len(comments))
+	}
+	c := comments[0]
+	if diffIDs[0].Valid {
+		// The database belongs to the default Phabricator instance.
+		diff, err := Arcanist{}.readDiff(int(diffIDs[0].Int64))
 		if err != nil {
-			orPanic(err)
+			return nil, err
+		}
+		if diff != nil {
+			c.Commit = diff.findLastCommit()
 		}
-		comment.Commit = diff.findLastCommit()
 	}
-	lineNumber, err := strconv.ParseUint(lineParts[2], 10, 32)
+	return &c, nil
+}
+
+// transactionReaders returns the functions used to read the transactions for the review.
+//
+// The transaction database, if configured, is only used for the default Phabricator instance.
+func (review DifferentialReview) transactionReaders() (ReadTransactions, ReadTransactionComment) {
+	if transactionDB != nil && review.arc.Conduit == nil {
+		return transactionDB.ReadTransactions, transactionDB.ReadTransactionComment
+	}
+	reader := newConduitTransactionReader(review.arc)
+	return reader.ReadTransactions, reader.ReadTransactionComment
+}
+
+// LoadComments takes in a DifferentialReview and returns the associated comments.
+func (review DifferentialReview) LoadComments() ([]review_utils.PhabricatorComment, error) {
+	readTransactions, readTransactionComment := review.transactionReaders()
+	return LoadComments(review, readTransactions, readTransactionComment, review.arc.lookupUser)
+}
+
+// readPublishedComments returns the review's published comments, in the order they were made.
+func (review DifferentialReview) readPublishedComments() ([]*differentialDatabaseTransactionComment, error) {
+	readTransactions, readTransactionComment := review.transactionReaders()
+	transactions, err := readTransactions(review.PHID)
 	if err != nil {
 		return nil, err
 	}
-	comment.LineNumber = uint32(lineNumber)
-	if lineParts[3] != "NULL" {
-		comment.ReplyToCommentPHID = &lineParts[3]
+	var comments []*differentialDatabaseTransactionComment
+	for _, transaction := range transactions {
+		if transaction.CommentPHID == nil {
+			continue
+		}
+		transactionComment, err := readTransactionComment(transaction.PHID)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, transactionComment)
 	}
-	// The next SQL command is structured to return a single result with a single column, so we
-	// don't need to parse it in any way.
-	comment.Content = runRawSqlCommandOrDie(fmt.Sprintf(selectCommentContentsQueryTemplate, comment.PHID))
-	return &comment, nil
+	return comments, nil
 }
 
-// LoadComments takes in a DifferentialReview and returns the associated comments.
-func (review DifferentialReview) LoadComments() []comment.Comment {
-	return LoadComments(review, readDatabaseTransactions, readDatabaseTransactionComment, lookupUser)
+// actionDescriptions maps the actions stored in "differential:action" transactions, other than
+// accepting and rejecting a revision, to the descriptions of the comments that we mirror them as.
+//
+// Some actions have been renamed in Phabricator over time, so both names are included.
+var actionDescriptions = map[string]string{
+	"resign":         "Resigned as a reviewer of this revision.",
+	"abandon":        "Abandoned this revision.",
+	"reclaim":        "Reclaimed this revision.",
+	"rethink":        "Planned changes to this revision.",
+	"request_review": "Requested a review of this revision.",
+	"claim":          "Commandeered this revision.",
+	"commandeer":     "Commandeered this revision.",
+	"commit":         "Closed this revision.",
+	"close":          "Closed this revision.",
+	"reopen":         "Reopened this revision.",
 }
 
-func LoadComments(review DifferentialReview, readTransactions ReadTransactions, readTransactionComment ReadTransactionComment, lookupUser UserLookup) []comment.Comment {
+// describeAction returns the comment description for the given JSON-encoded action, or the
+// empty string for actions that we do not describe.
+func describeAction(action string) string {
+	var name string
+	if err := json.Unmarshal([]byte(action), &name); err != nil {
+		return ""
+	}
+	return actionDescriptions[name]
+}
+
+// LoadComments reads the transactions for the given review, and converts them into git-appraise comments.
+//
+// Each comment is identified by the PHID of its Phabricator comment, or by the PHID of its
+// transaction for actions (such as accepting a revision) that do not have a comment.
+func LoadComments(review DifferentialReview, readTransactions ReadTransactions, readTransactionComment ReadTransactionComment, lookupUser UserLookup) ([]review_utils.PhabricatorComment, error) {
 
 	allTransactions, err := readTransactions(review.PHID)
 	if err != nil {
-		orPanic(err)
+		return nil, err
 	}
-	var comments []comment.Comment
+	var comments []review_utils.PhabricatorComment
 	commentsByPHID := make(map[string]comment.Comment)
 	rejectionCommentsByUser := make(map[string][]string)
 
@@ -248,7 +315,10 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 	for _, transaction := range allTransactions {
 		author, err := lookupUser(transaction.AuthorPHID)
 		if err != nil {
-			orPanic(err)
+			return nil, err
+		}
+		if author == nil {
+			return nil, fmt.Errorf("Unknown author %q for transaction %q", transaction.AuthorPHID, transaction.PHID)
 		}
 		c := comment.Comment{
 			Author:    author.Email,
@@ -259,11 +329,12 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 		} else {
 			c.Author = author.UserName
 		}
+		phid := transaction.PHID
 
 		if transaction.CommentPHID != nil {
 			transactionComment, err := readTransactionComment(transaction.PHID)
 			if err != nil {
-				orPanic(err)
+				return nil, err
 			}
 			if transactionComment.FileName != "" {
 				c.Location = &comment.Location{
@@ -274,16 +345,20 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 					c.Location.Range = &comment.Range{
 						StartLine: transactionComment.LineNumber,
 					}
+					if transactionComment.LineLength != 0 {
+						c.Location.Range.EndLine = transactionComment.LineNumber + transactionComment.LineLength
+					}
 				}
 			}
 			c.Description = transactionComment.Content
+			phid = transactionComment.PHID
 			if transactionComment.ReplyToCommentPHID != nil {
 				// We assume that the parent has to have been processed before the child,
 				// and enforce that by ordering the transactions in our queries.
 				if replyTo, ok := commentsByPHID[*transactionComment.ReplyToCommentPHID]; ok {
 					parentHash, err := replyTo.Hash()
 					if err != nil {
-						orPanic(err)
+						return nil, err
 					}
 					c.Parent = parentHash
 				}
@@ -306,12 +381,17 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 						Resolved:  &resolved,
 						Parent:    rejectionCommentHash,
 					}
-					comments = append(comments, approveComment)
+					comments = append(comments, review_utils.PhabricatorComment{
+						PHID:    transaction.PHID + "/" + rejectionCommentHash,
+						Comment: approveComment,
+					})
 					logger.Infof("LOADCOMMENTS: Received approval. Adding child comment %v with parent hash %x", approveComment, rejectionCommentHash)
 				}
 			} else if action == "\"reject\"" {
 				resolved = false
 				c.Resolved = &resolved
+			} else if description := describeAction(action); description != "" && c.Description == "" {
+				c.Description = description
 			}
 
 		}
@@ -320,14 +400,14 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 		// This results in a lot of empty top-level comments, which we do not want to mirror.
 		// To work around this, we only return comments that are non-empty.
 		if c.Parent != "" || c.Location != nil || c.Description != "" || c.Resolved != nil {
-			comments = append(comments, c)
-			commentsByPHID[transaction.PHID] = c
+			comments = append(comments, review_utils.PhabricatorComment{PHID: phid, Comment: c})
+			commentsByPHID[phid] = c
 
 			//If this was a rejection comment, add it to ordered comment hash
 			if c.Resolved != nil && *c.Resolved == false {
 				commentHash, err := c.Hash()
 				if err != nil {
-					orPanic(err)
+					return nil, err
 				}
 				logger.Infof("LOADCOMMENTS: Received rejection. Adding comment %v with hash %x", c, commentHash)
 				rejectionCommentsByUser[author.UserName] = append(rejectionCommentsByUser[author.UserName], commentHash)
@@ -337,5 +417,5 @@ func LoadComments(review DifferentialReview, readTransactions ReadTransactions,
 	}
 
 	logger.Infof("LOADCOMMENTS: Returning %d comments", len(comments))
-	return comments
+	return comments, nil
 }
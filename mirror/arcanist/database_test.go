@@ -17,7 +17,11 @@ limitations under the License.
 package arcanist
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"github.com/akatrevorjay/git-appraise/review/comment"
+	"io"
 	"testing"
 )
 
@@ -65,31 +69,37 @@ func MockLookupUser(userPHID string) (*user, error) {
 Verify the correct tree for the revision has been generated. For the above setup the following tree should be generated.
 Hash is made equal to id for understanding purposes
 
-  testReview
-    |
- 	  |-->[id:1 user:u1 resolved:false parent: hash:1] children: [id:2 user:u1, resolved:true parent:1 hash:2], [id:6 user:u1, resolved:true parent:1 hash: 6]
-    |
-    |-->[id:3 user:u1 resolved:true parent: hash:3]
-    |
-    |-->[id:4 user:u1 resolved:false parent: hash:4]  children: [id:7 user:u1, resolved:true parent:4 hash:7]
-  	|
-  	|-->[id:5 user:u2 resolved:false parent: hash:5]
-    |
-    |-->[id:8 user:u1 resolved:true parent: hash:8]
-
+	testReview
+	  |
+	  |-->[id:1 user:u1 resolved:false parent: hash:1] children: [id:2 user:u1, resolved:true parent:1 hash:2], [id:6 user:u1, resolved:true parent:1 hash: 6]
+	  |
+	  |-->[id:3 user:u1 resolved:true parent: hash:3]
+	  |
+	  |-->[id:4 user:u1 resolved:false parent: hash:4]  children: [id:7 user:u1, resolved:true parent:4 hash:7]
+	  |
+	  |-->[id:5 user:u2 resolved:false parent: hash:5]
+	  |
+	  |-->[id:8 user:u1 resolved:true parent: hash:8]
 */
 func TestLoadComments(t *testing.T) {
 	revisionID := "testReview"
 	review := DifferentialReview{ID: revisionID}
 
 	expectedComments := SetupExpectedComments()
-	actualComments := LoadComments(review, MockReadTransactions, MockReadTransactionComment, MockLookupUser)
+	actualComments, err := LoadComments(review, MockReadTransactions, MockReadTransactionComment, MockLookupUser)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(actualComments) != len(expectedComments) {
 		t.Errorf("Unexpected number of comments: %v", actualComments)
 	}
 
-	if !validateExpectedComments(expectedComments, actualComments) {
+	var comments []comment.Comment
+	for _, c := range actualComments {
+		comments = append(comments, c.Comment)
+	}
+	if !validateExpectedComments(expectedComments, comments) {
 		t.Errorf("Unexpected content expectedComments: %v and actual Comments: %v", expectedComments, actualComments)
 	}
 
@@ -179,3 +189,111 @@ func getHash(c comment.Comment) string {
 	}
 	return cHash
 }
+
+// fakeSQLDriver is a database/sql driver that answers each prepared query with canned rows.
+type fakeSQLDriver struct {
+	Rows map[string][][]driver.Value
+	Args map[string][][]driver.Value
+}
+
+// fakeDriver is registered once as "fakeTransactionDatabase", since database/sql does not allow
+// a driver name to be registered more than once. Each test sets the rows that it expects.
+var fakeDriver = &fakeSQLDriver{}
+
+func init() {
+	sql.Register("fakeTransactionDatabase", fakeDriver)
+}
+
+type fakeSQLConn struct{ driver *fakeSQLDriver }
+type fakeSQLStmt struct {
+	driver *fakeSQLDriver
+	query  string
+}
+type fakeSQLRows struct{ rows [][]driver.Value }
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) { return &fakeSQLConn{d}, nil }
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{c.driver, query}, nil
+}
+func (c *fakeSQLConn) Close() error { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("Transactions are not supported")
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("Exec is not supported")
+}
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.driver.Args[s.query] = append(s.driver.Args[s.query], args)
+	return &fakeSQLRows{s.driver.Rows[s.query]}, nil
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *fakeSQLRows) Close() error { return nil }
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestDatabaseReadTransactions(t *testing.T) {
+	*fakeDriver = fakeSQLDriver{
+		Rows: map[string][][]driver.Value{
+			selectTransactionsQuery: [][]driver.Value{
+				[]driver.Value{"PHID-XACT-1", "u1", int64(1), "differential:action", "\"accept\"", nil},
+				[]driver.Value{"PHID-XACT-2", "u1", int64(2), "differential:inline", nil, "PHID-XCMT-2"},
+			},
+			selectTransactionCommentQuery: [][]driver.Value{
+				[]driver.Value{int64(12), "PHID-XCMT-2", int64(42), int64(3), nil, "Tabs\tand\nnewlines", "hello.txt", int64(7)},
+			},
+		},
+		Args: make(map[string][][]driver.Value),
+	}
+	database, err := openTransactionDatabase("fakeTransactionDatabase", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reviewID := `PHID-DREV-1" or "1"="1`
+	transactions, err := database.ReadTransactions(reviewID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 2 {
+		t.Fatalf("Unexpected transactions: %v", transactions)
+	}
+	if transactions[0].DateCreated != 1 || *transactions[0].NewValue != "\"accept\"" || transactions[0].CommentPHID != nil {
+		t.Errorf("Unexpected first transaction: %v", transactions[0])
+	}
+	if transactions[1].NewValue != nil || *transactions[1].CommentPHID != "PHID-XCMT-2" {
+		t.Errorf("Unexpected second transaction: %v", transactions[1])
+	}
+	if args := fakeDriver.Args[selectTransactionsQuery]; len(args) != 1 || args[0][0] != reviewID {
+		t.Errorf("The review ID was not passed as a query argument: %v", args)
+	}
+
+	mock := newMockConduit(map[string][]string{
+		"differential.querydiffs": []string{testQueryDiffsResponse},
+	})
+	withMockConduit(mock, func() {
+		c, err := database.ReadTransactionComment("PHID-XACT-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ID != 12 || c.PHID != "PHID-XCMT-2" || c.LineNumber != 42 || c.LineLength != 3 || c.ReplyToCommentPHID != nil ||
+			c.Content != "Tabs\tand\nnewlines" || c.FileName != "hello.txt" || c.Commit != "ABCD" {
+			t.Errorf("Unexpected transaction comment: %v", c)
+		}
+	})
+}
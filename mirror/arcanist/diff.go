@@ -56,12 +56,14 @@ type differentialQueryDiffsResponse struct {
 	Response     map[string]queryDiffItem `json:"response"`
 }
 
-func readDiff(diffID int) (*queryDiffItem, error) {
+func (arc Arcanist) readDiff(diffID int) (*queryDiffItem, error) {
 	queryRequest := differentialQueryDiffsRequest{IDs: []int{diffID}}
 	var queryResponse differentialQueryDiffsResponse
-	runArcCommandOrDie("differential.querydiffs", queryRequest, &queryResponse)
+	if err := arc.callConduit("differential.querydiffs", queryRequest, &queryResponse); err != nil {
+		return nil, err
+	}
 	if queryResponse.Error != "" {
-		return nil, fmt.Errorf(queryResponse.ErrorMessage)
+		return nil, errors.New(queryResponse.ErrorMessage)
 	}
 	if diff, ok := queryResponse.Response[strconv.Itoa(diffID)]; ok {
 		return &diff, nil
@@ -83,7 +85,8 @@ func findLastCommit(commitsMap map[string]interface{}) string {
 			if ok {
 				timestamp, err := strconv.Atoi(timestampString)
 				if err != nil {
-					orPanic(err)
+					logger.Warningf("Ignoring commit %s with a malformed timestamp %q", commit, timestampString)
+					continue
 				}
 				timestamps = append(timestamps, timestamp)
 				timestampCommitMap[timestamp] = commit
@@ -124,13 +127,19 @@ func (arc Arcanist) getDiffChanges(repo repository.Repo, from, to string) ([]int
 	}
 	createRequest := differentialCreateRawDiffRequest{Diff: rawDiff}
 	var createResponse differentialCreateRawDiffResponse
-	runArcCommandOrDie("differential.createrawdiff", createRequest, &createResponse)
+	if err := arc.callConduit("differential.createrawdiff", createRequest, &createResponse); err != nil {
+		return nil, err
+	}
 	if createResponse.Error != "" {
-		return nil, fmt.Errorf(createResponse.ErrorMessage)
+		return nil, errors.New(createResponse.ErrorMessage)
 	}
 	diffID := createResponse.Response.ID
+	if plan != nil {
+		// This is a dry run, so the raw diff was never created, and there are no changes to read back.
+		return nil, nil
+	}
 
-	diff, err := readDiff(diffID)
+	diff, err := arc.readDiff(diffID)
 	if err != nil {
 		return nil, err
 	}
@@ -181,7 +190,9 @@ func (arc Arcanist) setDiffProperty(diffID int, name, value string) error {
 		Data: value,
 	}
 	var setPropertyResponse differentialSetDiffPropertyResponse
-	runArcCommandOrDie("differential.setdiffproperty", setPropertyRequest, &setPropertyResponse)
+	if err := arc.callConduit("differential.setdiffproperty", setPropertyRequest, &setPropertyResponse); err != nil {
+		return err
+	}
 	if setPropertyResponse.Error != "" {
 		return errors.New(setPropertyResponse.ErrorMessage)
 	}
@@ -230,9 +241,11 @@ func (arc Arcanist) createDifferentialDiff(repo repository.Repo, mergeBase, revi
 		Changes:                   changes,
 	}
 	var createResponse differentialCreateDiffResponse
-	runArcCommandOrDie("differential.creatediff", createRequest, &createResponse)
+	if err := arc.callConduit("differential.creatediff", createRequest, &createResponse); err != nil {
+		return nil, err
+	}
 	if createResponse.Error != "" {
-		return nil, fmt.Errorf(createResponse.ErrorMessage)
+		return nil, errors.New(createResponse.ErrorMessage)
 	}
 
 	localCommits := make(map[string]interface{})
@@ -243,9 +256,11 @@ func (arc Arcanist) createDifferentialDiff(repo repository.Repo, mergeBase, revi
 		}
 		queryRequest := differentialQueryDiffsRequest{[]int{diffID}}
 		var queryResponse differentialQueryDiffsResponse
-		runArcCommandOrDie("differential.querydiffs", queryRequest, &queryResponse)
+		if err := arc.callConduit("differential.querydiffs", queryRequest, &queryResponse); err != nil {
+			return nil, err
+		}
 		if queryResponse.Error != "" {
-			return nil, fmt.Errorf(queryResponse.ErrorMessage)
+			return nil, errors.New(queryResponse.ErrorMessage)
 		}
 		priorProperty := queryResponse.Response[priorDiff].Properties
 		if priorPropertyMap, ok := priorProperty.(map[string]interface{}); ok {
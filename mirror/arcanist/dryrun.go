@@ -0,0 +1,65 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/dryrun"
+)
+
+// readOnlyConduitMethods lists the Conduit methods that do not modify anything in Phabricator.
+//
+// Any method that is not listed here is treated as a write, so that a dry run never modifies
+// Phabricator, even when a new method is used without being added to this list.
+var readOnlyConduitMethods = map[string]bool{
+	"differential.query":           true,
+	"differential.querydiffs":      true,
+	"differential.revision.search": true,
+	"diffusion.querycommits":       true,
+	"diffusion.repository.search":  true,
+	"transaction.search":           true,
+	"user.query":                   true,
+	"user.whoami":                  true,
+}
+
+// plan records the changes that would have been made, or is nil if this is not a dry run.
+var plan *dryrun.Plan
+
+// SetDryRun makes every subsequent Conduit call that would modify Phabricator be recorded
+// in the given plan rather than being made.
+func SetDryRun(p *dryrun.Plan) {
+	plan = p
+}
+
+// dryRunCaller is a ConduitCaller that only passes through the calls that do not modify anything.
+//
+// The responses to the recorded calls are left empty, so any IDs that the mirror would have
+// read from them (e.g. for a newly created diff) are zero in the subsequently recorded calls.
+type dryRunCaller struct {
+	caller ConduitCaller
+	plan   *dryrun.Plan
+}
+
+func (c dryRunCaller) Call(method string, request interface{}, response interface{}) error {
+	if readOnlyConduitMethods[method] {
+		return c.caller.Call(method, request, response)
+	}
+	return c.plan.Record(dryrun.Action{
+		Type:   dryrun.ConduitCall,
+		Method: method,
+		Params: request,
+	})
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"testing"
+
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/dryrun"
+)
+
+func TestDryRunOnlyMakesReadOnlyCalls(t *testing.T) {
+	mock := newMockConduit(map[string][]string{
+		"user.query": {`{"response": [{"phid": "PHID-USER-DRY", "userName": "dryrunner"}]}`},
+	})
+	dryRunPlan := dryrun.NewPlan(nil)
+	SetDryRun(dryRunPlan)
+	defer func() { plan = nil }()
+
+	// The users are cached for each ConduitCaller, so a fresh one ensures that the user is queried.
+	arc := Arcanist{Conduit: mock}
+
+	if _, err := arc.queryUser("dryrunner"); err != nil {
+		t.Fatal(err)
+	}
+	request := createInlineRequest{RevisionID: "1", Content: "Hello"}
+	var response createInlineResponse
+	if err := arc.callConduit("differential.createinline", request, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mock.Requests["user.query"]) != 1 {
+		t.Errorf("The read-only call was not made: %v", mock.Requests)
+	}
+	if len(mock.Requests["differential.createinline"]) != 0 {
+		t.Errorf("A write was made during a dry run: %v", mock.Requests)
+	}
+	actions := dryRunPlan.Actions()
+	if len(actions) != 1 || actions[0].Type != dryrun.ConduitCall || actions[0].Method != "differential.createinline" {
+		t.Errorf("Unexpected planned actions: %+v", actions)
+	}
+}
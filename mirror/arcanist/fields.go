@@ -0,0 +1,286 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+// The title, summary, reviewers, and CCs of a revision are set from the review request when the
+// revision is created, and are then kept in sync with any later edits to the request. Only the
+// fields that changed in the request, and that differ from the revision's current fields, are
+// edited, so that any changes made directly in Phabricator to the other fields are preserved.
+//
+// In the other direction, reviewers that are added to or removed from a revision in Phabricator
+// are mirrored back into the review by appending a new request.
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review"
+	"github.com/akatrevorjay/git-appraise/review/request"
+	review_utils "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
+)
+
+// userPHIDPrefix is the prefix of the PHIDs of Phabricator users, as opposed to projects or packages.
+const userPHIDPrefix = "PHID-USER-"
+
+// revisionEditTransaction models a single edit in a differential.revision.edit request.
+type revisionEditTransaction struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// revisionEditRequest models the request format for Phabricator's differential.revision.edit API method.
+type revisionEditRequest struct {
+	ObjectIdentifier string                    `json:"objectIdentifier"`
+	Transactions     []revisionEditTransaction `json:"transactions"`
+}
+
+type revisionEditResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// requestHash returns a hash of the fields of the given request that are mirrored into the revision's fields.
+func requestHash(req request.Request) string {
+	mirrored := struct {
+		Description string   `json:"description"`
+		Requester   string   `json:"requester"`
+		Reviewers   []string `json:"reviewers"`
+	}{req.Description, req.Requester, req.Reviewers}
+	encoded, _ := json.Marshal(mirrored)
+	return fmt.Sprintf("%x", sha1.Sum(encoded))
+}
+
+// syncedRequest returns the request whose fields were last mirrored into the review's revision, or nil if it is not known.
+func syncedRequest(repo repository.Repo, r review.Review) *request.Request {
+	hash := store.GetSyncedRequest(repo.GetPath(), r.Revision)
+	if hash == "" {
+		return nil
+	}
+	for i := len(r.AllRequests) - 1; i >= 0; i-- {
+		if requestHash(r.AllRequests[i]) == hash {
+			return &r.AllRequests[i]
+		}
+	}
+	return nil
+}
+
+// difference returns the items in the first list that are not in the second.
+func difference(list, other []string) []string {
+	var result []string
+	for _, item := range list {
+		if !contains(other, item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// intersection returns the items in the first list that are also in the second.
+func intersection(list, other []string) []string {
+	var result []string
+	for _, item := range list {
+		if contains(other, item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// fieldEdits returns the edits that bring the current fields of the given revision in line with the given request.
+//
+// If the previously mirrored request is known, then only the fields that changed since it are edited, so that
+// changes made directly in Phabricator to the other fields are preserved. Otherwise, every field is reconciled
+// with the request, except that nobody is removed, since they may have been added directly in Phabricator.
+func (arc Arcanist) fieldEdits(differentialReview DifferentialReview, previous *request.Request, req request.Request) ([]revisionEditTransaction, error) {
+	var edits []revisionEditTransaction
+	if previous == nil || previous.Description != req.Description {
+		title, summary := revisionTitleAndSummary(req.Description)
+		if title != differentialReview.Title {
+			edits = append(edits, revisionEditTransaction{"title", title})
+		}
+		if summary != differentialReview.Summary {
+			edits = append(edits, revisionEditTransaction{"summary", summary})
+		}
+	}
+
+	reviewers, err := arc.userPHIDs(arc.requestReviewers(req))
+	if err != nil {
+		return nil, err
+	}
+	added := difference(reviewers, differentialReview.Reviewers)
+	var removed []string
+	if previous != nil {
+		previousReviewers, err := arc.userPHIDs(arc.requestReviewers(*previous))
+		if err != nil {
+			return nil, err
+		}
+		// Reviewers that were removed in Phabricator since the previous request are not added back.
+		added = difference(added, previousReviewers)
+		removed = intersection(difference(previousReviewers, reviewers), differentialReview.Reviewers)
+	}
+	if len(added) > 0 {
+		edits = append(edits, revisionEditTransaction{"reviewers.add", added})
+	}
+	if len(removed) > 0 {
+		edits = append(edits, revisionEditTransaction{"reviewers.remove", removed})
+	}
+
+	if previous == nil || previous.Requester != req.Requester {
+		if req.Requester != "" {
+			ccs, err := arc.userPHIDs([]string{req.Requester})
+			if err != nil {
+				return nil, err
+			}
+			if added := difference(ccs, differentialReview.CCs); len(added) > 0 {
+				edits = append(edits, revisionEditTransaction{"subscribers.add", added})
+			}
+		}
+		if previous != nil && previous.Requester != "" {
+			ccs, err := arc.userPHIDs([]string{previous.Requester})
+			if err != nil {
+				return nil, err
+			}
+			if removed := intersection(ccs, differentialReview.CCs); len(removed) > 0 {
+				edits = append(edits, revisionEditTransaction{"subscribers.remove", removed})
+			}
+		}
+	}
+	return edits, nil
+}
+
+// updateFields edits the fields of the given revision to match the review's request, if the request
+// has changed since its fields were last mirrored.
+//
+// The edits are made against the revision's current fields, so revisions whose previously mirrored
+// request is unknown (e.g. because they were created before the fields were kept in sync) are still
+// brought in line with the request.
+func (arc Arcanist) updateFields(repo repository.Repo, differentialReview DifferentialReview, r review.Review) error {
+	hash := requestHash(r.Request)
+	if store.GetSyncedRequest(repo.GetPath(), r.Revision) == hash {
+		return nil
+	}
+	edits, err := arc.fieldEdits(differentialReview, syncedRequest(repo, r), r.Request)
+	if err != nil {
+		return err
+	}
+	if len(edits) > 0 {
+		logger.Infof("Updating the fields of the differential revision %s to match the review %s", differentialReview.ID, r.Revision)
+		identifier := differentialReview.PHID
+		if identifier == "" {
+			identifier = "D" + differentialReview.ID
+		}
+		editRequest := revisionEditRequest{ObjectIdentifier: identifier, Transactions: edits}
+		var editResponse revisionEditResponse
+		if err := differentialReview.arc.callConduit("differential.revision.edit", editRequest, &editResponse); err != nil {
+			return err
+		}
+		if editResponse.Error != "" {
+			return fmt.Errorf("Failed to edit the differential revision %s: %s", differentialReview.ID, editResponse.ErrorMessage)
+		}
+	}
+	return store.SetSyncedRequest(repo.GetPath(), r.Revision, hash)
+}
+
+// sameMembers reports whether the given lists contain the same items, in any order.
+func sameMembers(list, other []string) bool {
+	return len(difference(list, other)) == 0 && len(difference(other, list)) == 0
+}
+
+// MirrorReviewers appends a new request to the review linked to the given Differential revision, if
+// reviewers have been added to or removed from the revision since the review's request was mirrored into it.
+//
+// Only those changes are applied to the request, so its other reviewers (e.g. ones without a Phabricator
+// account) are kept as they are written. Requests that have not been mirrored into the revision yet are left
+// alone, since their reviewers would otherwise be reverted to the revision's.
+func (arc Arcanist) MirrorReviewers(repo repository.Repo, phabricatorReview review_utils.PhabricatorReview) error {
+	differentialReview, ok := phabricatorReview.(DifferentialReview)
+	if !ok {
+		return nil
+	}
+	revision := differentialReview.GetFirstCommit(repo)
+	if revision == "" {
+		return nil
+	}
+	r, err := review.GetSummary(repo, revision)
+	if err != nil || r == nil || !r.IsOpen() {
+		return err
+	}
+	if store.GetSyncedRequest(repo.GetPath(), revision) != requestHash(r.Request) {
+		return nil
+	}
+	// The reviewers of the request when it was mirrored, keyed by their PHIDs.
+	synced := make(map[string]string)
+	for _, name := range arc.requestReviewers(r.Request) {
+		u, err := arc.queryUser(name)
+		if err != nil {
+			return err
+		}
+		if u != nil {
+			synced[u.PHID] = name
+		}
+	}
+	var current []string
+	for _, reviewerPHID := range differentialReview.Reviewers {
+		// Reviewers that are not users (e.g. projects or packages added by Herald) are skipped.
+		if strings.HasPrefix(reviewerPHID, userPHIDPrefix) {
+			current = append(current, reviewerPHID)
+		}
+	}
+	var removed []string
+	for reviewerPHID, name := range synced {
+		if !contains(current, reviewerPHID) {
+			removed = append(removed, name)
+		}
+	}
+	var reviewers []string
+	for _, name := range r.Request.Reviewers {
+		if !contains(removed, name) {
+			reviewers = append(reviewers, name)
+		}
+	}
+	for _, reviewerPHID := range current {
+		if _, ok := synced[reviewerPHID]; ok {
+			continue
+		}
+		name, err := arc.userName(reviewerPHID)
+		if err != nil {
+			return err
+		}
+		reviewers = append(reviewers, name)
+	}
+	if sameMembers(reviewers, r.Request.Reviewers) {
+		return nil
+	}
+	req := r.Request
+	req.Reviewers = reviewers
+	req.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	note, err := req.Write()
+	if err != nil {
+		return err
+	}
+	logger.Infof("Updating the reviewers of the review %s to match the differential revision %s: %v", revision, differentialReview.ID, reviewers)
+	if err := repo.AppendNote(request.Ref, revision, note); err != nil {
+		return err
+	}
+	// The revision already has these reviewers, so there is nothing to mirror back into it.
+	return store.SetSyncedRequest(repo.GetPath(), revision, requestHash(req))
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review"
+	"github.com/akatrevorjay/git-appraise/review/request"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
+)
+
+func TestUpdateFields(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	previous := request.Request{
+		Description: "Old title",
+		Requester:   "fields-author",
+		Reviewers:   []string{"fields-kept", "fields-removed"},
+	}
+	current := request.Request{
+		Description: "New title\n\nWith a summary",
+		Requester:   "fields-author",
+		Reviewers:   []string{"fields-kept", "fields-added"},
+	}
+	r := review.Review{Summary: &review.Summary{
+		Revision:    "rev1",
+		Request:     current,
+		AllRequests: []request.Request{previous, current},
+	}}
+	differentialReview := DifferentialReview{
+		ID:        "7",
+		PHID:      "PHID-DREV-7",
+		Title:     "Old title",
+		Reviewers: []string{"PHID-USER-KEPT", "PHID-USER-REMOVED", "PHID-USER-PHABRICATOR"},
+	}
+	mock := newMockConduit(map[string][]string{
+		"user.query": []string{
+			`{"response": [{"phid": "PHID-USER-KEPT", "userName": "fields-kept"}]}`,
+			`{"response": [{"phid": "PHID-USER-ADDED", "userName": "fields-added"}]}`,
+			`{"response": [{"phid": "PHID-USER-AUTHOR", "userName": "fields-author"}]}`,
+			`{"response": [{"phid": "PHID-USER-REMOVED", "userName": "fields-removed"}]}`,
+		},
+		"differential.revision.edit": []string{`{"response": {}}`, `{"response": {}}`},
+	})
+	withMockConduit(mock, func() {
+		// Without the previously mirrored request, the fields are reconciled with the revision's current fields.
+		for i := 0; i < 2; i++ {
+			if err := (Arcanist{}).updateFields(repo, differentialReview, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.SetSyncedRequest(repo.GetPath(), "rev1", requestHash(previous)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := (Arcanist{}).updateFields(repo, differentialReview, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	// Nobody is removed until the previously mirrored request is known.
+	reconciled := `{"objectIdentifier":"PHID-DREV-7","transactions":[` +
+		`{"type":"title","value":"New title"},` +
+		`{"type":"summary","value":"New title\n\nWith a summary"},` +
+		`{"type":"reviewers.add","value":["PHID-USER-ADDED"]},` +
+		`{"type":"subscribers.add","value":["PHID-USER-AUTHOR"]}]}`
+	// The reviewer added in Phabricator is kept, as only the fields that changed in the request are edited.
+	expected := `{"objectIdentifier":"PHID-DREV-7","transactions":[` +
+		`{"type":"title","value":"New title"},` +
+		`{"type":"summary","value":"New title\n\nWith a summary"},` +
+		`{"type":"reviewers.add","value":["PHID-USER-ADDED"]},` +
+		`{"type":"reviewers.remove","value":["PHID-USER-REMOVED"]}]}`
+	if requests := mock.Requests["differential.revision.edit"]; len(requests) != 2 || requests[0] != reconciled || requests[1] != expected {
+		t.Errorf("Unexpected edit requests: %v", requests)
+	}
+}
+
+func TestMirrorReviewers(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	differentialReview := DifferentialReview{
+		ID:        "8",
+		Reviewers: []string{"PHID-USER-MIRROR-KEPT", "PHID-USER-MIRROR-HERALD", "PHID-PROJ-TEAM"},
+	}
+	if err := recordLink(repo, "rev1", differentialReview); err != nil {
+		t.Fatal(err)
+	}
+	synced := request.Request{
+		Timestamp:   "1",
+		ReviewRef:   "refs/heads/r1",
+		TargetRef:   "refs/heads/master",
+		Description: "First",
+		Reviewers:   []string{"mirror-local", "mirror-kept", "mirror-dropped"},
+	}
+	note, err := synced.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(request.Ref, "rev1", note); err != nil {
+		t.Fatal(err)
+	}
+	mock := newMockConduit(map[string][]string{
+		"user.query": []string{
+			`{"response": []}`,
+			`{"response": []}`,
+			`{"response": [{"phid": "PHID-USER-MIRROR-KEPT", "userName": "mirror-kept"}]}`,
+			`{"response": [{"phid": "PHID-USER-MIRROR-DROPPED", "userName": "mirror-dropped"}]}`,
+			`{"response": [{"phid": "PHID-USER-MIRROR-HERALD", "userName": "herald", "primaryEmail": "mirror-herald@example.com"}]}`,
+			`{"response": [{"phid": "PHID-USER-MIRROR-HERALD", "userName": "herald", "primaryEmail": "mirror-herald@example.com"}]}`,
+		},
+	})
+	withMockConduit(mock, func() {
+		// The reviewers of a request that has not been mirrored into the revision are left alone.
+		if err := (Arcanist{}).MirrorReviewers(repo, differentialReview); err != nil {
+			t.Fatal(err)
+		}
+		if len(repo.GetNotes(request.Ref, "rev1")) != 2 {
+			t.Fatalf("The reviewers of an unmirrored request were changed")
+		}
+		if err := store.SetSyncedRequest(repo.GetPath(), "rev1", requestHash(synced)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := (Arcanist{}).MirrorReviewers(repo, differentialReview); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	notes := repo.GetNotes(request.Ref, "rev1")
+	if len(notes) != 3 {
+		t.Fatalf("Unexpected request notes: %v", notes)
+	}
+	req, err := request.Parse(notes[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the changes made in Phabricator are applied, so the reviewer without an account is kept.
+	if strings.Join(req.Reviewers, ",") != "mirror-local,mirror-kept,mirror-herald@example.com" || req.Description != "First" {
+		t.Errorf("Unexpected request: %+v", req)
+	}
+	if store.GetSyncedRequest(repo.GetPath(), "rev1") != requestHash(req) {
+		t.Errorf("The updated request was not recorded as mirrored into the revision")
+	}
+}
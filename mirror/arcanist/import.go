@@ -0,0 +1,267 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+// Revisions created directly in Phabricator (e.g. with "arc diff") are imported into git-appraise
+// by writing a review request for them, once their commits are present in a repo. The commits
+// are identified using the "local:commits" property that arcanist attaches to each diff.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review"
+	"github.com/akatrevorjay/git-appraise/review/request"
+	review_utils "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
+)
+
+// defaultImportTargetRef is the target ref for imported reviews whose diffs do not record the branch they are onto.
+const defaultImportTargetRef = "refs/heads/master"
+
+// ontoDiffPropertyName is the name of the property in which arcanist records the branch a diff is onto.
+const ontoDiffPropertyName = "arc:onto"
+
+// localCommit models an entry in the "local:commits" property of a diff.
+type localCommit struct {
+	Parents []string        `json:"parents"`
+	Time    json.RawMessage `json:"time"`
+}
+
+// timestamp returns the commit time, which arcanist records as either a string or a number.
+func (c localCommit) timestamp() int64 {
+	timestamp, _ := strconv.ParseInt(strings.Trim(string(c.Time), `"`), 10, 64)
+	return timestamp
+}
+
+// localCommits returns the commits included in the diff, keyed by their hashes.
+func (diff *queryDiffItem) localCommits() map[string]localCommit {
+	propertiesMap, ok := diff.Properties.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	encoded, err := json.Marshal(propertiesMap["local:commits"])
+	if err != nil {
+		return nil
+	}
+	var commits map[string]localCommit
+	if err := json.Unmarshal(encoded, &commits); err != nil {
+		return nil
+	}
+	return commits
+}
+
+// ontoRef returns the ref that the diff was made onto, or the empty string if it is not recorded.
+func (diff *queryDiffItem) ontoRef() string {
+	propertiesMap, ok := diff.Properties.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	onto, ok := propertiesMap[ontoDiffPropertyName].(string)
+	if !ok || onto == "" {
+		return ""
+	}
+	if strings.HasPrefix(onto, "refs/") {
+		return onto
+	}
+	return "refs/heads/" + onto
+}
+
+// firstCommit returns the earliest of the given commits, i.e. the first commit of the review,
+// along with its parent, which is the base of the review.
+func firstCommit(commits map[string]localCommit) (string, string) {
+	var roots []string
+	for hash, c := range commits {
+		isRoot := true
+		for _, parent := range c.Parents {
+			if _, ok := commits[parent]; ok {
+				isRoot = false
+			}
+		}
+		if isRoot {
+			roots = append(roots, hash)
+		}
+	}
+	if len(roots) == 0 {
+		return "", ""
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		if commits[roots[i]].timestamp() != commits[roots[j]].timestamp() {
+			return commits[roots[i]].timestamp() < commits[roots[j]].timestamp()
+		}
+		return roots[i] < roots[j]
+	})
+	first := roots[0]
+	var base string
+	if parents := commits[first].Parents; len(parents) > 0 {
+		base = parents[0]
+	}
+	return first, base
+}
+
+// latestDiffID returns the ID of the most recent diff in the revision, or 0 if there are none.
+func (differentialReview DifferentialReview) latestDiffID() int {
+	latest := 0
+	for _, diffIDString := range differentialReview.Diffs {
+		if diffID, err := strconv.Atoi(diffIDString); err == nil && diffID > latest {
+			latest = diffID
+		}
+	}
+	return latest
+}
+
+// userName returns the name that git-appraise uses for the Phabricator user with the given PHID.
+func (arc Arcanist) userName(userPHID string) (string, error) {
+	u, err := arc.lookupUser(userPHID)
+	if err != nil {
+		return "", err
+	}
+	if u == nil {
+		return "", fmt.Errorf("Unknown user %q", userPHID)
+	}
+	if u.Email != "" {
+		return u.Email, nil
+	}
+	return u.UserName, nil
+}
+
+// ImportReview writes a git-appraise review request for the given Differential revision, if all of
+// the commits in its latest diff are present in the given repo, and links the request to the revision.
+//
+// The caller must first check that the revision is not already linked to a review in the repo.
+// If the repo already has a review request for the revision's first commit, then that request
+// is linked rather than a new one being written. Revisions that record a different repository
+// are skipped without reading their diffs. Closed and abandoned revisions are imported as
+// submitted and abandoned reviews respectively.
+func (arc Arcanist) ImportReview(repo repository.Repo, phabricatorReview review_utils.PhabricatorReview) (bool, error) {
+	differentialReview, ok := phabricatorReview.(DifferentialReview)
+	if !ok {
+		return false, nil
+	}
+	if inRepo, err := arc.inRepo(repo, differentialReview); err != nil || !inRepo {
+		return false, err
+	}
+	latestDiffID := differentialReview.latestDiffID()
+	if latestDiffID == 0 {
+		return false, nil
+	}
+	// Record the diffs that cannot be imported, so that the same diff is not read again on every pass.
+	if store.IsImportSkipped(repo.GetPath(), differentialReview.ID, strconv.Itoa(latestDiffID)) {
+		return false, nil
+	}
+	skip := func() (bool, error) {
+		return false, store.MarkImportSkipped(repo.GetPath(), differentialReview.ID, strconv.Itoa(latestDiffID))
+	}
+
+	diff, err := arc.readDiff(latestDiffID)
+	if err != nil {
+		return false, err
+	}
+	if diff == nil {
+		return skip()
+	}
+	commits := diff.localCommits()
+	if len(commits) == 0 {
+		return skip()
+	}
+	for hash := range commits {
+		if err := repo.VerifyCommit(hash); err != nil {
+			// The revision is for a different repo, or its commits have not been pushed yet.
+			return skip()
+		}
+	}
+	revision, base := firstCommit(commits)
+	if revision == "" {
+		return skip()
+	}
+
+	existing, err := review.GetSummary(repo, revision)
+	if err != nil {
+		return false, err
+	}
+	if existing == nil {
+		requester, err := arc.userName(differentialReview.AuthorPHID)
+		if err != nil {
+			return false, err
+		}
+		var reviewers []string
+		for _, reviewerPHID := range differentialReview.Reviewers {
+			// Reviewers that are not users (e.g. projects or packages added by Herald) are skipped.
+			if !strings.HasPrefix(reviewerPHID, userPHIDPrefix) {
+				continue
+			}
+			reviewer, err := arc.userName(reviewerPHID)
+			if err != nil {
+				return false, err
+			}
+			reviewers = append(reviewers, reviewer)
+		}
+		description := differentialReview.Title
+		if differentialReview.Summary != "" {
+			description += "\n\n" + differentialReview.Summary
+		}
+		var reviewRef string
+		if differentialReview.Branch != "" {
+			reviewRef = "refs/heads/" + differentialReview.Branch
+		}
+		targetRef := diff.ontoRef()
+		if targetRef == "" {
+			targetRef = defaultImportTargetRef
+		}
+		req := request.New(requester, reviewers, reviewRef, targetRef, description)
+		req.BaseCommit = base
+		// Closed and abandoned revisions are written in their final state, as MirrorStatus would
+		// leave them, so that they are not mistaken for open reviews and reopened in Phabricator.
+		switch differentialReview.Status {
+		case differentialAbandonedStatus:
+			req.TargetRef = ""
+		case differentialClosedStatus:
+			commit, err := arc.landedCommit(differentialReview)
+			if err != nil {
+				return false, err
+			}
+			if commit != revision {
+				req.Alias = commit
+			}
+		}
+		note, err := req.Write()
+		if err != nil {
+			return false, err
+		}
+		logger.Infof("Importing the differential revision %s as a review of %s", differentialReview.ID, revision)
+		if err := repo.AppendNote(request.Ref, revision, note); err != nil {
+			return false, err
+		}
+		switch differentialReview.Status {
+		case differentialAbandonedStatus:
+			if err := store.MarkRevisionAbandoned(repo.GetPath(), revision, true); err != nil {
+				return false, err
+			}
+		case differentialClosedStatus:
+			if err := store.MarkRevisionClosed(repo.GetPath(), revision); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := recordLink(repo, revision, differentialReview); err != nil {
+		return false, err
+	}
+	return true, nil
+}
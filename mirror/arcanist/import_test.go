@@ -0,0 +1,213 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review/request"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
+)
+
+const testImportDiff = `{"response": {"12": {"id": "12", "changes": [], "properties": {
+  "arc:onto": "main",
+  "local:commits": {
+    "C2": {"parents": ["C1"], "time": 200},
+    "C1": {"parents": ["BASE"], "time": "100"}
+  }}}}}`
+
+// missingCommitsRepo is a repo that does not contain any of the given commits.
+type missingCommitsRepo struct {
+	repository.Repo
+	missing []string
+}
+
+func (r missingCommitsRepo) VerifyCommit(hash string) error {
+	if contains(r.missing, hash) {
+		return errors.New("missing commit")
+	}
+	return r.Repo.VerifyCommit(hash)
+}
+
+func testImportedRevision(id string) DifferentialReview {
+	return DifferentialReview{
+		ID:         id,
+		PHID:       "PHID-DREV-" + id,
+		Title:      "Add a feature",
+		Summary:    "With some details",
+		Branch:     "feature",
+		AuthorPHID: "PHID-USER-IMPORT-AUTHOR",
+		Reviewers:  []string{"PHID-USER-IMPORT-REVIEWER"},
+		Diffs:      []string{"12", "9"},
+	}
+}
+
+func TestImportReview(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	mock := newMockConduit(map[string][]string{
+		"differential.querydiffs": []string{testImportDiff},
+		"user.query": []string{
+			`{"response": [{"phid": "PHID-USER-IMPORT-AUTHOR", "userName": "author", "primaryEmail": "author@example.com"}]}`,
+			`{"response": [{"phid": "PHID-USER-IMPORT-REVIEWER", "userName": "reviewer"}]}`,
+		},
+	})
+	revision := testImportedRevision("51")
+	revision.Reviewers = append(revision.Reviewers, "PHID-PROJ-IMPORT")
+	withMockConduit(mock, func() {
+		imported, err := Arcanist{}.ImportReview(repo, revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !imported {
+			t.Fatal("Failed to import the revision")
+		}
+	})
+	if requests := mock.Requests["differential.querydiffs"]; len(requests) != 1 || requests[0] != `{"ids":[12]}` {
+		t.Errorf("Unexpected diff queries: %v", requests)
+	}
+	notes := repo.GetNotes(request.Ref, "C1")
+	if len(notes) != 1 {
+		t.Fatalf("Unexpected request notes: %v", notes)
+	}
+	req, err := request.Parse(notes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Requester != "author@example.com" || strings.Join(req.Reviewers, ",") != "reviewer" ||
+		req.ReviewRef != "refs/heads/feature" || req.TargetRef != "refs/heads/main" ||
+		req.BaseCommit != "BASE" || req.Description != "Add a feature\n\nWith some details" {
+		t.Errorf("Unexpected request: %+v", req)
+	}
+	if id := LinkedRevisionID(repo, "C1"); id != "51" {
+		t.Errorf("Unexpected linked revision: %q", id)
+	}
+}
+
+func TestImportReviewMissingCommits(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := missingCommitsRepo{repository.NewMockRepoForTest(), []string{"C2"}}
+	mock := newMockConduit(map[string][]string{
+		"differential.querydiffs": []string{testImportDiff},
+	})
+	withMockConduit(mock, func() {
+		for i := 0; i < 2; i++ {
+			imported, err := Arcanist{}.ImportReview(repo, testImportedRevision("52"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported {
+				t.Fatal("Unexpectedly imported a revision whose commits are missing")
+			}
+		}
+	})
+	if requests := mock.Requests["differential.querydiffs"]; len(requests) != 1 {
+		t.Errorf("Unexpected diff queries: %v", requests)
+	}
+	if !store.IsImportSkipped(repo.GetPath(), "52", "12") {
+		t.Errorf("The skipped diff was not recorded")
+	}
+	if notes := repo.GetNotes(request.Ref, "C1"); len(notes) != 0 {
+		t.Errorf("Unexpected request notes: %v", notes)
+	}
+}
+
+func TestImportReviewOtherRepository(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	mock := newMockConduit(map[string][]string{
+		"diffusion.repository.search": []string{`{"response": {"data": [{"phid": "PHID-REPO-IMPORT"}]}}`},
+	})
+	revision := testImportedRevision("53")
+	revision.RepositoryPHID = "PHID-REPO-OTHER"
+	withMockConduit(mock, func() {
+		imported, err := Arcanist{Callsign: "IMPORT"}.ImportReview(repo, revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported {
+			t.Fatal("Unexpectedly imported a revision for another repository")
+		}
+	})
+	if requests := mock.Requests["differential.querydiffs"]; len(requests) != 0 {
+		t.Errorf("Read the diffs of a revision for another repository: %v", requests)
+	}
+}
+
+func TestImportClosedReviews(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	abandonedRepo := repository.NewMockRepoForTest()
+	closedRepo := repository.NewMockRepoForTest()
+	mock := newMockConduit(map[string][]string{
+		"differential.querydiffs": []string{testImportDiff, testImportDiff},
+		"user.query": []string{
+			`{"response": [{"phid": "PHID-USER-CLOSED-AUTHOR", "userName": "author"}]}`,
+		},
+		"diffusion.querycommits": []string{`{"response": {"data": {"PHID-CMIT-55": {"identifier": "LANDED"}}}}`},
+	})
+	abandoned := testImportedRevision("54")
+	abandoned.AuthorPHID = "PHID-USER-CLOSED-AUTHOR"
+	abandoned.Reviewers = nil
+	abandoned.Status = differentialAbandonedStatus
+	closed := testImportedRevision("55")
+	closed.AuthorPHID = "PHID-USER-CLOSED-AUTHOR"
+	closed.Reviewers = nil
+	closed.Status = differentialClosedStatus
+	closed.Commits = []string{"PHID-CMIT-55"}
+	withMockConduit(mock, func() {
+		if imported, err := (Arcanist{}).ImportReview(abandonedRepo, abandoned); err != nil || !imported {
+			t.Fatalf("Failed to import the abandoned revision: %v", err)
+		}
+		if imported, err := (Arcanist{}).ImportReview(closedRepo, closed); err != nil || !imported {
+			t.Fatalf("Failed to import the closed revision: %v", err)
+		}
+	})
+
+	notes := abandonedRepo.GetNotes(request.Ref, "C1")
+	if len(notes) != 1 {
+		t.Fatalf("Unexpected request notes: %v", notes)
+	}
+	if req, err := request.Parse(notes[0]); err != nil || req.TargetRef != "" {
+		t.Errorf("The abandoned revision was not imported as an abandoned review: %+v, %v", req, err)
+	}
+	if !store.IsRevisionAbandoned(abandonedRepo.GetPath(), "C1") {
+		t.Errorf("The abandoned revision was not recorded")
+	}
+
+	notes = closedRepo.GetNotes(request.Ref, "C1")
+	if len(notes) != 1 {
+		t.Fatalf("Unexpected request notes: %v", notes)
+	}
+	if req, err := request.Parse(notes[0]); err != nil || req.TargetRef != "refs/heads/main" || req.Alias != "LANDED" {
+		t.Errorf("The closed revision was not imported as a submitted review: %+v, %v", req, err)
+	}
+	if !store.IsRevisionClosed(closedRepo.GetPath(), "C1") {
+		t.Errorf("The closed revision was not recorded")
+	}
+}
+
+func TestFirstCommit(t *testing.T) {
+	commits := map[string]localCommit{
+		"C3": {Parents: []string{"C2", "OTHER"}, Time: []byte(`300`)},
+		"C2": {Parents: []string{"C1"}, Time: []byte(`"200"`)},
+		"C1": {Parents: []string{"BASE"}, Time: []byte(`"100"`)},
+	}
+	if first, base := firstCommit(commits); first != "C1" || base != "BASE" {
+		t.Errorf("Unexpected first commit %q with base %q", first, base)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+// Every git-appraise review that we mirror is linked to its Differential revision by a git note
+// attached to the review's revision. Unlike commit hashes, the link survives rebases and
+// force-pushes of the review ref, so it is the only thing used to match reviews with revisions.
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review"
+)
+
+// LinkRef defines the git-notes ref that we use for linking reviews to Differential revisions.
+const LinkRef = "refs/notes/devtools/phabricator"
+
+// revisionLink models the contents of a link note.
+//
+// When a review has multiple link notes, the last one takes precedence.
+type revisionLink struct {
+	Timestamp    string   `json:"timestamp,omitempty"`
+	RevisionID   string   `json:"revisionID"`
+	RevisionPHID string   `json:"revisionPHID,omitempty"`
+	DiffIDs      []string `json:"diffIDs,omitempty"`
+}
+
+// readLink returns the latest link note for the review of the given revision, or nil if there is none.
+func readLink(repo repository.Repo, revision string) *revisionLink {
+	var link *revisionLink
+	for _, note := range repo.GetNotes(LinkRef, revision) {
+		var parsed revisionLink
+		if err := json.Unmarshal([]byte(note), &parsed); err != nil || parsed.RevisionID == "" {
+			logger.Warningf("Ignoring malformed link note for %s: %q", revision, string(note))
+			continue
+		}
+		link = &parsed
+	}
+	return link
+}
+
+// LinkedRevisionID returns the ID of the Differential revision linked to the review of the given revision,
+// or the empty string if the review has not been linked to one.
+func LinkedRevisionID(repo repository.Repo, revision string) string {
+	if link := readLink(repo, revision); link != nil {
+		return link.RevisionID
+	}
+	return ""
+}
+
+// recordLink links the review of the given revision to the given Differential revision.
+//
+// A new note is only written if the link has changed since it was last recorded.
+func recordLink(repo repository.Repo, revision string, differentialReview DifferentialReview) error {
+	link := revisionLink{
+		RevisionID:   differentialReview.ID,
+		RevisionPHID: differentialReview.PHID,
+		DiffIDs:      differentialReview.Diffs,
+	}
+	if existing := readLink(repo, revision); existing != nil {
+		existing.Timestamp = ""
+		if reflect.DeepEqual(*existing, link) {
+			return nil
+		}
+	}
+	link.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	note, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Linking the review %s to the differential revision %s", revision, link.RevisionID)
+	if err := repo.AppendNote(LinkRef, revision, repository.Note(note)); err != nil {
+		return err
+	}
+	linkIndexMutex.Lock()
+	if index, ok := linkIndexes[repo.GetPath()]; ok {
+		index[link.RevisionID] = revision
+	}
+	linkIndexMutex.Unlock()
+	return store.LinkRevision(repo.GetPath(), revision, link.RevisionID)
+}
+
+// linkIndexes holds, for each repo, the revisions of the linked reviews keyed by their Differential revision IDs.
+//
+// Reading every link note in a repo is slow, so each index is built once, and then kept up to date as
+// links are recorded, until ResetLinks is called.
+var linkIndexes = make(map[string]map[string]string)
+
+// unlinkedRevisions holds, for each repo, the Differential revisions that could not be matched to a review
+// by their commits, keyed by their IDs and mapped to their latest diff IDs.
+var unlinkedRevisions = make(map[string]map[string]string)
+
+// linkIndexMutex guards linkIndexes and unlinkedRevisions, which are shared by every repo being mirrored.
+var linkIndexMutex sync.Mutex
+
+// ResetLinks drops the cached links for the given repo, so that they are read from the link notes again
+// the next time that they are needed. It should be called whenever the notes may have been changed by
+// someone else, such as after pulling them from the remote.
+func ResetLinks(repo repository.Repo) {
+	linkIndexMutex.Lock()
+	defer linkIndexMutex.Unlock()
+	delete(linkIndexes, repo.GetPath())
+}
+
+// findLinkedRevision returns the revision of the review linked to the given Differential revision,
+// or the empty string if no review is linked to it.
+func findLinkedRevision(repo repository.Repo, differentialID string) string {
+	linkIndexMutex.Lock()
+	defer linkIndexMutex.Unlock()
+	index, ok := linkIndexes[repo.GetPath()]
+	if !ok {
+		index = make(map[string]string)
+		for _, revision := range repo.ListNotedRevisions(LinkRef) {
+			if link := readLink(repo, revision); link != nil {
+				index[link.RevisionID] = revision
+			}
+		}
+		linkIndexes[repo.GetPath()] = index
+	}
+	return index[differentialID]
+}
+
+// latestDiff returns the ID of the latest diff in the revision, or "" if it has none.
+func (r DifferentialReview) latestDiff() string {
+	if len(r.Diffs) == 0 {
+		return ""
+	}
+	return r.Diffs[0]
+}
+
+// findUnlinkedReview returns the revision of the review for which the given Differential revision was
+// created before we started writing link notes, or the empty string if there is none.
+//
+// Such a revision is matched by its earliest commit that has a review, after which the review is linked
+// to it. Revisions that do not match any review are not checked again until they are updated with a new diff.
+func (r DifferentialReview) findUnlinkedReview(repo repository.Repo) string {
+	linkIndexMutex.Lock()
+	unlinked := unlinkedRevisions[repo.GetPath()]
+	checked := unlinked != nil && unlinked[r.ID] == r.latestDiff()
+	linkIndexMutex.Unlock()
+	if checked {
+		return ""
+	}
+
+	var commits []string
+	for _, hashPair := range r.Hashes {
+		// We only care about the hashes for commits, which have exactly two
+		// elements, the first of which is "gtcm".
+		if len(hashPair) == 2 && hashPair[0] == commitHashType {
+			commits = append(commits, hashPair[1])
+		}
+	}
+	var existing []string
+	timestamps := make(map[string]int)
+	for _, commit := range commits {
+		if err := repo.VerifyCommit(commit); err != nil {
+			continue
+		}
+		existing = append(existing, commit)
+		if timeString, err := repo.GetCommitTime(commit); err == nil {
+			timestamps[commit], _ = strconv.Atoi(timeString)
+		}
+	}
+	sort.SliceStable(existing, func(i, j int) bool { return timestamps[existing[i]] < timestamps[existing[j]] })
+	for _, commit := range existing {
+		if readLink(repo, commit) != nil {
+			continue
+		}
+		if summary, err := review.GetSummary(repo, commit); err != nil || summary == nil {
+			continue
+		}
+		if err := recordLink(repo, commit, r); err != nil {
+			logger.Errorf("Failed to link the review %s to the differential revision %s: %v", commit, r.ID, err)
+		}
+		return commit
+	}
+
+	linkIndexMutex.Lock()
+	defer linkIndexMutex.Unlock()
+	if unlinkedRevisions[repo.GetPath()] == nil {
+		unlinkedRevisions[repo.GetPath()] = make(map[string]string)
+	}
+	unlinkedRevisions[repo.GetPath()][r.ID] = r.latestDiff()
+	return ""
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
+)
+
+const testQueryByIDResponse = `{"response": [
+  {"id": "12", "phid": "PHID-DREV-12", "reviewers": [], "diffs": ["34", "33"]}]}`
+
+func TestRecordLink(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	ResetLinks(repo)
+	if link := readLink(repo, "ABCD"); link != nil {
+		t.Errorf("Unexpected link for an unmirrored review: %v", link)
+	}
+	if revision := findLinkedRevision(repo, "12"); revision != "" {
+		t.Errorf("Unexpected review for an unlinked revision: %q", revision)
+	}
+
+	differentialReview := DifferentialReview{ID: "12", PHID: "PHID-DREV-12", Diffs: []string{"33"}}
+	if err := recordLink(repo, "ABCD", differentialReview); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordLink(repo, "ABCD", differentialReview); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes(LinkRef, "ABCD"); len(notes) != 1 {
+		t.Errorf("An unchanged link was recorded again: %v", notes)
+	}
+	differentialReview.Diffs = []string{"34", "33"}
+	if err := recordLink(repo, "ABCD", differentialReview); err != nil {
+		t.Fatal(err)
+	}
+	link := readLink(repo, "ABCD")
+	if link == nil || link.RevisionID != "12" || link.RevisionPHID != "PHID-DREV-12" || len(link.DiffIDs) != 2 {
+		t.Errorf("Unexpected link: %v", link)
+	}
+
+	// Simulate a restart, after which the reverse mapping must be read from the notes.
+	SetStore(state.NewMemoryStore())
+	ResetLinks(repo)
+	if revision := (DifferentialReview{ID: "12"}).GetFirstCommit(repo); revision != "ABCD" {
+		t.Errorf("Unexpected review for a linked revision: %q", revision)
+	}
+	if revision := (DifferentialReview{ID: "13"}).GetFirstCommit(repo); revision != "" {
+		t.Errorf("Unexpected review for an unlinked revision: %q", revision)
+	}
+}
+
+func TestGetFirstCommitLinksReviewsMirroredBeforeLinks(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	ResetLinks(repo)
+	differentialReview := DifferentialReview{
+		ID:     "21",
+		PHID:   "PHID-DREV-21",
+		Diffs:  []string{"40"},
+		Hashes: [][]string{[]string{"gttr", "tree"}, []string{commitHashType, "unreviewed"}, []string{commitHashType, "rev1"}},
+	}
+	if revision := differentialReview.GetFirstCommit(repo); revision != "rev1" {
+		t.Errorf("The review was not matched by its commit: %q", revision)
+	}
+	if link := readLink(repo, "rev1"); link == nil || link.RevisionID != "21" {
+		t.Errorf("The matched review was not linked: %v", link)
+	}
+
+	native := DifferentialReview{ID: "22", Diffs: []string{"41"}, Hashes: [][]string{[]string{commitHashType, "unreviewed"}}}
+	if revision := native.GetFirstCommit(repo); revision != "" {
+		t.Errorf("Unexpected review for a revision created in Phabricator: %q", revision)
+	}
+	if diff := unlinkedRevisions[repo.GetPath()]["22"]; diff != "41" {
+		t.Errorf("The unmatched revision was not remembered: %q", diff)
+	}
+}
+
+func TestListDifferentialReviewsUsesLink(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	mock := newMockConduit(map[string][]string{
+		"differential.query": []string{testQueryByIDResponse, testQueryByIDResponse},
+	})
+	withMockConduit(mock, func() {
+		// An unlinked review is found by its commit hash, and then linked.
+		reviews, err := Arcanist{}.listDifferentialReviews(repo, "ABCD")
+		if err != nil || len(reviews) != 1 || reviews[0].ID != "12" {
+			t.Fatalf("Unexpected reviews: %v, %v", reviews, err)
+		}
+		if link := readLink(repo, "ABCD"); link == nil || link.RevisionID != "12" {
+			t.Errorf("The review was not linked: %v", link)
+		}
+
+		// A linked review is read by its revision ID.
+		if _, err := (Arcanist{}).listDifferentialReviews(repo, "ABCD"); err != nil {
+			t.Fatal(err)
+		}
+		requests := mock.Requests["differential.query"]
+		if len(requests) != 2 || !strings.Contains(requests[0], "commitHashes") || !strings.Contains(requests[1], `"ids":[12]`) {
+			t.Errorf("Unexpected differential queries: %v", requests)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+)
+
+// repositorySearchRequest models the request format for Phabricator's diffusion.repository.search API method.
+type repositorySearchRequest struct {
+	Constraints struct {
+		Callsigns []string `json:"callsigns,omitempty"`
+	} `json:"constraints"`
+}
+
+// repositorySearchResponse models the response format for Phabricator's diffusion.repository.search API method.
+type repositorySearchResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     struct {
+		Data []struct {
+			PHID string `json:"phid"`
+		} `json:"data"`
+	} `json:"response,omitempty"`
+}
+
+// repositoryCacheKey identifies a cached repository PHID. Since each Phabricator instance has its
+// own repositories, they are cached separately for each ConduitCaller.
+type repositoryCacheKey struct {
+	conduit  ConduitCaller
+	callsign string
+}
+
+// repositoryPHIDs caches the PHID of each repository, or the empty string for unknown callsigns.
+var repositoryPHIDs = make(map[repositoryCacheKey]string)
+var repositoryPHIDsMutex sync.Mutex
+
+// callsign returns the identifier Phabricator uses for the given repo, or the empty string if it is unknown.
+//
+// We cannot determine the repo's callsign in all cases, but we can figure it out in the case that the
+// mirror runs on the same directories that Phabricator is using. In that scenario, the repo directories
+// default to being named "/var/repo/<CALLSIGN>", so if the repo path starts with that prefix then
+// we can try to strip out that prefix and use the rest as a callsign.
+func (arc Arcanist) callsign(repo repository.Repo) string {
+	if arc.Callsign != "" {
+		return arc.Callsign
+	}
+	repoDirPrefix := arc.RepoDirPrefix
+	if repoDirPrefix == "" {
+		repoDirPrefix = defaultRepoDirPrefix
+	}
+	if strings.HasPrefix(repo.GetPath(), repoDirPrefix) {
+		return strings.TrimPrefix(repo.GetPath(), repoDirPrefix)
+	}
+	return ""
+}
+
+// repositoryPHID returns the PHID of the Phabricator repository for the given repo, or the empty string if it is unknown.
+func (arc Arcanist) repositoryPHID(repo repository.Repo) (string, error) {
+	callsign := arc.callsign(repo)
+	if callsign == "" {
+		return "", nil
+	}
+	key := repositoryCacheKey{arc.Conduit, callsign}
+	repositoryPHIDsMutex.Lock()
+	phid, ok := repositoryPHIDs[key]
+	repositoryPHIDsMutex.Unlock()
+	if ok {
+		return phid, nil
+	}
+	var request repositorySearchRequest
+	request.Constraints.Callsigns = []string{callsign}
+	var response repositorySearchResponse
+	if err := arc.callConduit("diffusion.repository.search", request, &response); err != nil {
+		return "", err
+	}
+	if response.Error != "" {
+		return "", fmt.Errorf("Failed to look up the repository %s: %s", callsign, response.ErrorMessage)
+	}
+	if len(response.Response.Data) == 1 {
+		phid = response.Response.Data[0].PHID
+	}
+	repositoryPHIDsMutex.Lock()
+	defer repositoryPHIDsMutex.Unlock()
+	repositoryPHIDs[key] = phid
+	return phid, nil
+}
+
+// inRepo reports whether the given revision may be for the given repo.
+//
+// Revisions that do not record their repository, and repos whose repository is unknown, may match any repo.
+func (arc Arcanist) inRepo(repo repository.Repo, differentialReview DifferentialReview) (bool, error) {
+	if differentialReview.RepositoryPHID == "" {
+		return true, nil
+	}
+	phid, err := arc.repositoryPHID(repo)
+	if err != nil {
+		return false, err
+	}
+	return phid == "" || phid == differentialReview.RepositoryPHID, nil
+}
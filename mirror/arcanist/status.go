@@ -0,0 +1,172 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+// Closing or abandoning a revision in Phabricator is mirrored into git-appraise by writing a new
+// review request. An abandoned review's request has no target ref, and a closed review's request
+// has the commit that it landed as for an alias, so that git-appraise reports it as submitted.
+// Reclaiming an abandoned revision restores the target ref from the review's earlier requests.
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review"
+	"github.com/akatrevorjay/git-appraise/review/request"
+)
+
+// queryCommitsRequest models the request format for Phabricator's diffusion.querycommits API method.
+type queryCommitsRequest struct {
+	PHIDs []string `json:"phids"`
+}
+
+type queryCommitsResponse struct {
+	Error        string `json:"error,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Response     struct {
+		Data map[string]struct {
+			Identifier string `json:"identifier"`
+		} `json:"data"`
+	} `json:"response"`
+}
+
+// landedCommit returns the hash of the commit that closed the given revision, or the empty string if it is not known.
+func (arc Arcanist) landedCommit(differentialReview DifferentialReview) (string, error) {
+	if len(differentialReview.Commits) == 0 {
+		return "", nil
+	}
+	var response queryCommitsResponse
+	if err := arc.callConduit("diffusion.querycommits", queryCommitsRequest{PHIDs: differentialReview.Commits}, &response); err != nil {
+		return "", err
+	}
+	if response.Error != "" {
+		return "", fmt.Errorf("Failed to query the commits for %s: %s", differentialReview.ID, response.ErrorMessage)
+	}
+	// The revision's commits are listed from the most recent.
+	if commit, ok := response.Response.Data[differentialReview.Commits[0]]; ok {
+		return commit.Identifier, nil
+	}
+	return "", nil
+}
+
+// reclaimedSince reports whether the revision has been reclaimed since the given request was written.
+//
+// Any change to a revision updates its modification time, so the reclaim itself is looked for.
+func (differentialReview DifferentialReview) reclaimedSince(req request.Request) (bool, error) {
+	requested, err := strconv.ParseInt(req.Timestamp, 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	readTransactions, _ := differentialReview.transactionReaders()
+	transactions, err := readTransactions(differentialReview.PHID)
+	if err != nil {
+		return false, err
+	}
+	for _, transaction := range transactions {
+		if transaction.Type == "differential:action" && transaction.NewValue != nil &&
+			*transaction.NewValue == `"reclaim"` && int64(transaction.DateCreated) > requested {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MirrorStatus updates the given review, if its Differential revision has been closed or abandoned,
+// so that git-appraise reports it as submitted or abandoned respectively. An abandoned review is
+// revived if its revision has been reclaimed since the review was abandoned.
+//
+// Reviews that are not linked to a revision, or whose revisions are still open, are left alone.
+func (arc Arcanist) MirrorStatus(repo repository.Repo, r review.Summary) error {
+	if r.Submitted || store.IsRevisionClosed(repo.GetPath(), r.Revision) {
+		return nil
+	}
+	differentialID, err := strconv.Atoi(LinkedRevisionID(repo, r.Revision))
+	if err != nil {
+		return nil
+	}
+	differentialReviews, err := arc.queryDifferentialReviews(queryRequest{IDs: []int{differentialID}})
+	if err != nil || len(differentialReviews) == 0 {
+		return err
+	}
+	differentialReview := differentialReviews[0]
+	req := r.Request
+	req.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	closed := false
+	switch {
+	case r.IsAbandoned():
+		// The revision was either reclaimed after the review was abandoned, or is still open
+		// because the review's abandonment has not been mirrored into it yet.
+		if differentialReview.isClosed() {
+			return nil
+		}
+		reclaimed, err := differentialReview.reclaimedSince(r.Request)
+		if err != nil || !reclaimed {
+			return err
+		}
+		req.TargetRef = previousTargetRef(r)
+		if req.TargetRef == "" {
+			return nil
+		}
+		logger.Infof("Reviving the review %s, as the differential revision %s was reclaimed", r.Revision, differentialReview.ID)
+	case differentialReview.Status == differentialAbandonedStatus:
+		if store.IsRevisionAbandoned(repo.GetPath(), r.Revision) {
+			// The mirror abandoned the revision because the review's ref was deleted,
+			// in which case the revision is reclaimed if the ref is restored.
+			return nil
+		}
+		logger.Infof("Abandoning the review %s, as the differential revision %s was abandoned", r.Revision, differentialReview.ID)
+		req.TargetRef = ""
+	case differentialReview.Status == differentialClosedStatus:
+		commit, err := arc.landedCommit(differentialReview)
+		if err != nil {
+			return err
+		}
+		if commit == "" || commit == r.Revision || commit == req.Alias {
+			return store.MarkRevisionClosed(repo.GetPath(), r.Revision)
+		}
+		logger.Infof("Submitting the review %s as %s, as the differential revision %s was closed", r.Revision, commit, differentialReview.ID)
+		req.Alias = commit
+		closed = true
+	default:
+		return nil
+	}
+	note, err := req.Write()
+	if err != nil {
+		return err
+	}
+	if err := repo.AppendNote(request.Ref, r.Revision, note); err != nil {
+		return err
+	}
+	if !closed {
+		// The review may still be abandoned or revived again, in which case the status is mirrored again.
+		return nil
+	}
+	return store.MarkRevisionClosed(repo.GetPath(), r.Revision)
+}
+
+// previousTargetRef returns the target ref of the latest request for the given review that had one,
+// which is kept in the review's history when the review is abandoned.
+func previousTargetRef(r review.Summary) string {
+	for i := len(r.AllRequests) - 1; i >= 0; i-- {
+		if targetRef := r.AllRequests[i].TargetRef; targetRef != "" {
+			return targetRef
+		}
+	}
+	return ""
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review"
+	"github.com/akatrevorjay/git-appraise/review/request"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
+)
+
+// testStatusRepo returns a mock repo in which the reviews of "rev1" and "rev2" are linked to D1 and D2 respectively.
+func testStatusRepo(t *testing.T) repository.Repo {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	for revision, id := range map[string]string{"rev1": "1", "rev2": "2"} {
+		if err := recordLink(repo, revision, DifferentialReview{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func latestRequest(t *testing.T, repo repository.Repo, revision string) request.Request {
+	r, err := review.GetSummary(repo, revision)
+	if err != nil || r == nil {
+		t.Fatalf("Failed to read the review %s: %v", revision, err)
+	}
+	return r.Request
+}
+
+func TestMirrorStatus(t *testing.T) {
+	repo := testStatusRepo(t)
+	mock := newMockConduit(map[string][]string{
+		"differential.query": []string{
+			`{"response": [{"id": "1", "reviewers": [], "status": "4"}]}`,
+			`{"response": [{"id": "2", "reviewers": [], "status": "3", "commits": ["PHID-CMIT-2"]}]}`,
+			`{"response": [{"id": "1", "reviewers": [], "status": "4"}]}`,
+		},
+		"diffusion.querycommits": []string{
+			`{"response": {"data": {"PHID-CMIT-2": {"identifier": "landed"}}}}`,
+		},
+	})
+	withMockConduit(mock, func() {
+		// Submitted reviews are not looked up again, while abandoned ones are in case they are reclaimed.
+		for _, revision := range []string{"rev1", "rev2", "rev1", "rev2"} {
+			r, err := review.GetSummary(repo, revision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := (Arcanist{}).MirrorStatus(repo, *r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if abandoned := latestRequest(t, repo, "rev1"); abandoned.TargetRef != "" || abandoned.Description != "First" {
+		t.Errorf("The review was not abandoned: %+v", abandoned)
+	}
+	if submitted := latestRequest(t, repo, "rev2"); submitted.Alias != "landed" || submitted.TargetRef != "refs/heads/master" {
+		t.Errorf("The review was not submitted: %+v", submitted)
+	}
+	if requests := mock.Requests["differential.query"]; len(requests) != 3 {
+		t.Errorf("Unexpected revision queries: %v", requests)
+	}
+}
+
+func TestMirrorStatusReclaimed(t *testing.T) {
+	repo := testStatusRepo(t)
+	mirrorStatus := func(responses map[string][]string) {
+		withMockConduit(newMockConduit(responses), func() {
+			r, err := review.GetSummary(repo, "rev1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := (Arcanist{}).MirrorStatus(repo, *r); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	mirrorStatus(map[string][]string{"differential.query": []string{`{"response": [{"id": "1", "reviewers": [], "status": "4"}]}`}})
+	abandoned := latestRequest(t, repo, "rev1")
+	if abandoned.TargetRef != "" {
+		t.Fatalf("The review was not abandoned: %+v", abandoned)
+	}
+	requested, err := strconv.Atoi(abandoned.Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := `{"response": [{"id": "1", "phid": "PHID-DREV-1", "reviewers": [], "status": "0", "dateModified": "` + strconv.Itoa(requested+10) + `"}]}`
+	transactions := func(transactionType string, created int) string {
+		return fmt.Sprintf(`{"response": {"data": [{"phid": "PHID-XACT-1", "type": %q, "authorPHID": "u1", "dateCreated": %d, "comments": [], "fields": {}}], "cursor": {"after": null}}}`,
+			transactionType, created)
+	}
+
+	// A revision that was only changed (e.g. commented on) since the review was abandoned is left
+	// to be abandoned by the mirror, as is one that was reclaimed before the review was abandoned.
+	mirrorStatus(map[string][]string{"differential.query": []string{open}, "transaction.search": []string{transactions("comment", requested+10)}})
+	mirrorStatus(map[string][]string{"differential.query": []string{open}, "transaction.search": []string{transactions("reclaim", requested-10)}})
+	if notes := repo.GetNotes(request.Ref, "rev1"); len(notes) != 2 {
+		t.Errorf("The review was revived by a revision that was not reclaimed: %v", notes)
+	}
+
+	mirrorStatus(map[string][]string{"differential.query": []string{open}, "transaction.search": []string{transactions("reclaim", requested+10)}})
+	if revived := latestRequest(t, repo, "rev1"); revived.TargetRef != "refs/heads/master" || revived.Description != "First" {
+		t.Errorf("The review was not revived: %+v", revived)
+	}
+}
+
+func TestMirrorStatusOpen(t *testing.T) {
+	repo := testStatusRepo(t)
+	mock := newMockConduit(map[string][]string{
+		"differential.query": []string{`{"response": [{"id": "1", "reviewers": [], "status": "0"}]}`},
+	})
+	withMockConduit(mock, func() {
+		r, err := review.GetSummary(repo, "rev1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (Arcanist{}).MirrorStatus(repo, *r); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if notes := repo.GetNotes(request.Ref, "rev1"); len(notes) != 1 {
+		t.Errorf("The request of an open review was changed: %v", notes)
+	}
+	if store.IsRevisionClosed(repo.GetPath(), "rev1") {
+		t.Errorf("An open review was marked as closed")
+	}
+}
+
+func TestEnsureRequestExistsAbandons(t *testing.T) {
+	repo := testStatusRepo(t)
+	mock := newMockConduit(map[string][]string{
+		"differential.query": []string{
+			`{"response": [{"id": "1", "reviewers": [], "status": "0", "dateModified": "100"}]}`,
+			`{"response": [{"id": "2", "reviewers": [], "status": "0", "dateModified": "300"}]}`,
+		},
+		"differential.createcomment": []string{`{"response": {}}`},
+	})
+	withMockConduit(mock, func() {
+		for _, revision := range []string{"rev1", "rev2"} {
+			abandoned := review.Review{Summary: &review.Summary{
+				Revision: revision,
+				Request:  request.Request{Timestamp: "200", TargetRef: ""},
+			}}
+			if err := (Arcanist{}).EnsureRequestExists(repo, abandoned); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	// The second revision was modified (e.g. reclaimed) after the review was abandoned, so it is left open.
+	requests := mock.Requests["differential.createcomment"]
+	if len(requests) != 1 || !strings.Contains(requests[0], `"revision_id":"1"`) || !strings.Contains(requests[0], `"action":"abandon"`) {
+		t.Errorf("Unexpected comment requests: %v", requests)
+	}
+	if !store.IsRevisionAbandoned(repo.GetPath(), "rev1") || store.IsRevisionAbandoned(repo.GetPath(), "rev2") {
+		t.Errorf("Unexpected abandoned revisions")
+	}
+}
+
+// refRepo is a repo that reports whether it has a review's ref, and never has its head commit.
+type refRepo struct {
+	repository.Repo
+	hasRef bool
+}
+
+func (r refRepo) HasRef(ref string) (bool, error) {
+	return r.hasRef, nil
+}
+
+func TestEnsureRequestExistsAbandonsDeletedRef(t *testing.T) {
+	repo := refRepo{testStatusRepo(t), true}
+	open := `{"response": [{"id": "1", "reviewers": [], "status": "0", "dateModified": "100"}]}`
+	mock := newMockConduit(map[string][]string{
+		"differential.query":         []string{open, open, open},
+		"differential.createcomment": []string{`{"response": {}}`},
+	})
+	r := review.Review{Summary: &review.Summary{
+		Revision: "rev1",
+		Request:  request.Request{Timestamp: "50", ReviewRef: "refs/heads/feature", TargetRef: "refs/heads/master"},
+	}}
+	withMockConduit(mock, func() {
+		// The head commit cannot be read, but the ref still exists, so the revision is left open.
+		if err := (Arcanist{}).EnsureRequestExists(repo, r); err == nil {
+			t.Errorf("Unexpected success for a review whose head commit cannot be read")
+		}
+		repo.hasRef = false
+		// The revision is only abandoned once, so it stays open once someone has reclaimed it.
+		for i := 0; i < 2; i++ {
+			if err := (Arcanist{}).EnsureRequestExists(repo, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	requests := mock.Requests["differential.createcomment"]
+	if len(requests) != 1 || !strings.Contains(requests[0], `"action":"abandon"`) {
+		t.Errorf("Unexpected comment requests: %v", requests)
+	}
+	if !store.IsRevisionAbandoned(repo.GetPath(), "rev1") {
+		t.Errorf("The abandoned revision was not recorded")
+	}
+}
+
+func TestEnsureRequestExistsActionRefused(t *testing.T) {
+	repo := testStatusRepo(t)
+	refused := `{"error": "ERR-CONDUIT-CORE", "errorMessage": "You can not abandon this revision because you do not own it."}`
+	mock := newMockConduit(map[string][]string{
+		"differential.query":         []string{`{"response": [{"id": "1", "reviewers": [], "status": "0", "dateModified": "100"}]}`},
+		"differential.createcomment": []string{refused, refused},
+	})
+	withMockConduit(mock, func() {
+		// Revisions that the mirror does not own cannot be abandoned or reclaimed by it, which must
+		// not stop the rest of the repo from being recorded as mirrored.
+		abandoned := review.Review{Summary: &review.Summary{
+			Revision: "rev1",
+			Request:  request.Request{Timestamp: "200", TargetRef: ""},
+		}}
+		if err := (Arcanist{}).EnsureRequestExists(repo, abandoned); err != nil {
+			t.Errorf("A refused abandon failed the review: %v", err)
+		}
+		reviews, err := reclaimAll(repo, "rev2", []DifferentialReview{{ID: "2", Status: differentialAbandonedStatus, DateModified: "100"}},
+			request.Request{Timestamp: "200", TargetRef: "refs/heads/master"})
+		if err != nil {
+			t.Errorf("A refused reclaim failed the review: %v", err)
+		}
+		if len(reviews) != 1 || !reviews[0].isAbandoned() {
+			t.Errorf("A revision that could not be reclaimed was reported as open: %v", reviews)
+		}
+	})
+	if requests := mock.Requests["differential.createcomment"]; len(requests) != 2 {
+		t.Errorf("Unexpected comment requests: %v", requests)
+	}
+	if store.IsRevisionAbandoned(repo.GetPath(), "rev1") {
+		t.Errorf("A revision that could not be abandoned was recorded as abandoned")
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+// Phabricator's "transaction.search" API method returns the same data that we otherwise read
+// directly from the database tables described in database.go. We translate its results into
+// the database representation so that both sources can share the LoadComments logic.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// conduitActionTypes maps the transaction types reported by "transaction.search" to the
+// action names that Differential stores in its "differential:action" transactions.
+var conduitActionTypes = map[string]string{
+	"accept":          "accept",
+	"request-changes": "reject",
+	"resign":          "resign",
+	"abandon":         "abandon",
+	"reclaim":         "reclaim",
+	"plan-changes":    "rethink",
+	"request-review":  "request_review",
+	"commandeer":      "commandeer",
+	"close":           "close",
+	"reopen":          "reopen",
+}
+
+// transactionSearchRequest models the request format for Phabricator's transaction.search API method.
+type transactionSearchRequest struct {
+	ObjectIdentifier string `json:"objectIdentifier"`
+	After            string `json:"after,omitempty"`
+}
+
+type transactionSearchComment struct {
+	ID      int    `json:"id"`
+	PHID    string `json:"phid"`
+	Removed bool   `json:"removed"`
+	Content struct {
+		Raw string `json:"raw"`
+	} `json:"content"`
+}
+
+type transactionSearchFields struct {
+	Diff *struct {
+		ID int `json:"id"`
+	} `json:"diff,omitempty"`
+	Path               string  `json:"path,omitempty"`
+	Line               uint32  `json:"line,omitempty"`
+	Length             uint32  `json:"length,omitempty"`
+	ReplyToCommentPHID *string `json:"replyToCommentPHID,omitempty"`
+}
+
+type transactionSearchItem struct {
+	PHID        string                     `json:"phid"`
+	Type        *string                    `json:"type"`
+	AuthorPHID  string                     `json:"authorPHID"`
+	DateCreated uint32                     `json:"dateCreated"`
+	Comments    []transactionSearchComment `json:"comments"`
+	Fields      json.RawMessage            `json:"fields"`
+}
+
+type transactionSearchResult struct {
+	Data   []transactionSearchItem `json:"data"`
+	Cursor struct {
+		After *string `json:"after"`
+	} `json:"cursor"`
+}
+
+// transactionSearchResponse models the response format for Phabricator's transaction.search API method.
+type transactionSearchResponse struct {
+	Error        string                  `json:"error,omitempty"`
+	ErrorMessage string                  `json:"errorMessage,omitempty"`
+	Response     transactionSearchResult `json:"response,omitempty"`
+}
+
+// conduitTransactionReader reads the transactions for a review using the Conduit API.
+//
+// The "transaction.search" results include the comment contents along with each transaction,
+// so the reader holds on to those comments for the subsequent calls to ReadTransactionComment.
+type conduitTransactionReader struct {
+	arc      Arcanist
+	comments map[string]*differentialDatabaseTransactionComment
+	commits  map[int]string
+}
+
+func newConduitTransactionReader(arc Arcanist) *conduitTransactionReader {
+	return &conduitTransactionReader{
+		arc:      arc,
+		comments: make(map[string]*differentialDatabaseTransactionComment),
+		commits:  make(map[int]string),
+	}
+}
+
+// findCommit returns the last commit included in the given diff, or the empty string if it cannot be determined.
+func (reader *conduitTransactionReader) findCommit(diffID int) (string, error) {
+	if commit, ok := reader.commits[diffID]; ok {
+		return commit, nil
+	}
+	diff, err := reader.arc.readDiff(diffID)
+	if err != nil {
+		return "", err
+	}
+	var commit string
+	if diff != nil {
+		commit = diff.findLastCommit()
+	}
+	reader.commits[diffID] = commit
+	return commit, nil
+}
+
+// translate converts a single "transaction.search" result into its database representation.
+//
+// The returned transaction is nil for any transaction types that we do not mirror.
+func (reader *conduitTransactionReader) translate(item transactionSearchItem) (*differentialDatabaseTransaction, error) {
+	if item.Type == nil {
+		return nil, nil
+	}
+	transaction := differentialDatabaseTransaction{
+		PHID:        item.PHID,
+		AuthorPHID:  item.AuthorPHID,
+		DateCreated: item.DateCreated,
+	}
+	switch *item.Type {
+	case "comment", "inline":
+		if len(item.Comments) == 0 || item.Comments[0].Removed {
+			return nil, nil
+		}
+		c := &differentialDatabaseTransactionComment{
+			ID:      item.Comments[0].ID,
+			PHID:    item.Comments[0].PHID,
+			Content: item.Comments[0].Content.Raw,
+		}
+		transaction.Type = "core:comment"
+		if *item.Type == "inline" {
+			transaction.Type = "differential:inline"
+			var fields transactionSearchFields
+			if err := json.Unmarshal(item.Fields, &fields); err != nil {
+				return nil, err
+			}
+			c.FileName = fields.Path
+			c.LineNumber = fields.Line
+			c.LineLength = fields.Length
+			c.ReplyToCommentPHID = fields.ReplyToCommentPHID
+			if fields.Diff != nil {
+				commit, err := reader.findCommit(fields.Diff.ID)
+				if err != nil {
+					return nil, err
+				}
+				c.Commit = commit
+			}
+		}
+		transaction.CommentPHID = &c.PHID
+		reader.comments[transaction.PHID] = c
+	default:
+		action, ok := conduitActionTypes[*item.Type]
+		if !ok {
+			return nil, nil
+		}
+		// Differential stores the action as a JSON-encoded string.
+		newValue := strconv.Quote(action)
+		transaction.Type = "differential:action"
+		transaction.NewValue = &newValue
+	}
+	return &transaction, nil
+}
+
+// ReadTransactions reads all of the mirrored transactions for the given review, oldest first.
+func (reader *conduitTransactionReader) ReadTransactions(reviewID string) ([]differentialDatabaseTransaction, error) {
+	var items []transactionSearchItem
+	searchRequest := transactionSearchRequest{ObjectIdentifier: reviewID}
+	for {
+		var searchResponse transactionSearchResponse
+		if err := reader.arc.callConduit("transaction.search", searchRequest, &searchResponse); err != nil {
+			return nil, err
+		}
+		if searchResponse.Error != "" {
+			return nil, fmt.Errorf("Failed to search the transactions for %s: %s", reviewID, searchResponse.ErrorMessage)
+		}
+		items = append(items, searchResponse.Response.Data...)
+		if searchResponse.Response.Cursor.After == nil || *searchResponse.Response.Cursor.After == "" {
+			break
+		}
+		searchRequest.After = *searchResponse.Response.Cursor.After
+	}
+
+	// The search results are ordered newest first, but LoadComments expects every reply
+	// to come after the comment it replies to.
+	var transactions []differentialDatabaseTransaction
+	for i := len(items) - 1; i >= 0; i-- {
+		transaction, err := reader.translate(items[i])
+		if err != nil {
+			return nil, err
+		}
+		if transaction != nil {
+			transactions = append(transactions, *transaction)
+		}
+	}
+	return transactions, nil
+}
+
+// ReadTransactionComment returns the comment attached to a transaction previously returned by ReadTransactions.
+func (reader *conduitTransactionReader) ReadTransactionComment(transactionID string) (*differentialDatabaseTransactionComment, error) {
+	c, ok := reader.comments[transactionID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown comment transaction %q", transactionID)
+	}
+	return c, nil
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arcanist
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// mockConduit answers Conduit calls with canned responses, keyed by method name.
+//
+// Each response is the JSON that "arc call-conduit" would print for that method. When a
+// method has multiple responses, they are returned in order for subsequent calls.
+type mockConduit struct {
+	Responses map[string][]string
+	Requests  map[string][]string
+}
+
+func newMockConduit(responses map[string][]string) *mockConduit {
+	return &mockConduit{
+		Responses: responses,
+		Requests:  make(map[string][]string),
+	}
+}
+
+func (c *mockConduit) Call(method string, request interface{}, response interface{}) error {
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	c.Requests[method] = append(c.Requests[method], string(requestBytes))
+	responses := c.Responses[method]
+	if len(responses) == 0 {
+		return fmt.Errorf("Unexpected conduit call: %s %s", method, string(requestBytes))
+	}
+	c.Responses[method] = responses[1:]
+	return json.Unmarshal([]byte(responses[0]), response)
+}
+
+func withMockConduit(c ConduitCaller, f func()) {
+	previous := conduit
+	SetConduit(c)
+	defer SetConduit(previous)
+	f()
+}
+
+const testTransactionSearchPage1 = `{"response": {
+  "data": [
+    {"phid": "PHID-XACT-5", "type": "inline", "authorPHID": "u2", "dateCreated": 5,
+     "comments": [{"phid": "PHID-XCMT-5", "removed": false, "content": {"raw": "Agreed"}}],
+     "fields": {"diff": {"id": 7}, "path": "hello.txt", "line": 42, "replyToCommentPHID": "PHID-XCMT-3"}},
+    {"phid": "PHID-XACT-4", "type": "request-changes", "authorPHID": "u2", "dateCreated": 4,
+     "comments": [], "fields": {}}
+  ],
+  "cursor": {"after": "4"}}}`
+
+const testTransactionSearchPage2 = `{"response": {
+  "data": [
+    {"phid": "PHID-XACT-3", "type": "inline", "authorPHID": "u1", "dateCreated": 3,
+     "comments": [{"id": 3, "phid": "PHID-XCMT-3", "removed": false, "content": {"raw": "Tabs\tand\nnewlines"}}],
+     "fields": {"diff": {"id": 7}, "path": "hello.txt", "line": 42, "length": 2, "replyToCommentPHID": null}},
+    {"phid": "PHID-XACT-2", "type": "comment", "authorPHID": "u1", "dateCreated": 2,
+     "comments": [{"phid": "PHID-XCMT-2", "removed": true, "content": {"raw": ""}}], "fields": {}},
+    {"phid": "PHID-XACT-1", "type": null, "authorPHID": "u1", "dateCreated": 1,
+     "comments": [], "fields": {}}
+  ],
+  "cursor": {"after": null}}}`
+
+const testQueryDiffsResponse = `{"response": {"7": {"id": "7", "properties": {
+  "local:commits": {"ABCD": {"time": "12345"}}}}}}`
+
+func TestConduitReadTransactions(t *testing.T) {
+	mock := newMockConduit(map[string][]string{
+		"transaction.search":      []string{testTransactionSearchPage1, testTransactionSearchPage2},
+		"differential.querydiffs": []string{testQueryDiffsResponse},
+	})
+	withMockConduit(mock, func() {
+		reader := newConduitTransactionReader(Arcanist{})
+		transactions, err := reader.ReadTransactions("PHID-DREV-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(transactions) != 3 {
+			t.Fatalf("Unexpected transactions: %v", transactions)
+		}
+		if transactions[0].PHID != "PHID-XACT-3" || transactions[0].Type != "differential:inline" {
+			t.Errorf("Unexpected first transaction: %v", transactions[0])
+		}
+		if transactions[1].Type != "differential:action" || *transactions[1].NewValue != "\"reject\"" {
+			t.Errorf("Unexpected action transaction: %v", transactions[1])
+		}
+		if transactions[2].PHID != "PHID-XACT-5" || *transactions[2].CommentPHID != "PHID-XCMT-5" {
+			t.Errorf("Unexpected last transaction: %v", transactions[2])
+		}
+		if len(mock.Requests["transaction.search"]) != 2 || len(mock.Requests["differential.querydiffs"]) != 1 {
+			t.Errorf("Unexpected conduit requests: %v", mock.Requests)
+		}
+
+		first, err := reader.ReadTransactionComment("PHID-XACT-3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.ID != 3 || first.Content != "Tabs\tand\nnewlines" || first.FileName != "hello.txt" ||
+			first.LineNumber != 42 || first.LineLength != 2 || first.Commit != "ABCD" || first.ReplyToCommentPHID != nil {
+			t.Errorf("Unexpected inline comment: %v", first)
+		}
+		reply, err := reader.ReadTransactionComment("PHID-XACT-5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.ReplyToCommentPHID == nil || *reply.ReplyToCommentPHID != "PHID-XCMT-3" {
+			t.Errorf("Unexpected reply comment: %v", reply)
+		}
+		if _, err := reader.ReadTransactionComment("PHID-XACT-2"); err == nil {
+			t.Errorf("Removed comments should not be returned")
+		}
+
+		readTransactions := func(reviewID string) ([]differentialDatabaseTransaction, error) {
+			return transactions, nil
+		}
+		comments, err := LoadComments(DifferentialReview{PHID: "PHID-DREV-1"}, readTransactions, reader.ReadTransactionComment, MockLookupUser)
+		if err != nil || len(comments) != 3 {
+			t.Fatalf("Unexpected comments: %v", comments)
+		}
+		if comments[0].PHID != "PHID-XCMT-3" || comments[1].PHID != "PHID-XACT-4" || comments[2].PHID != "PHID-XCMT-5" {
+			t.Errorf("Unexpected comment PHIDs: %v", comments)
+		}
+		if r := comments[0].Comment.Location.Range; r.StartLine != 42 || r.EndLine != 44 {
+			t.Errorf("Unexpected range for the first comment: %v", r)
+		}
+		if r := comments[2].Comment.Location.Range; r.StartLine != 42 || r.EndLine != 0 {
+			t.Errorf("Unexpected range for the reply: %v", r)
+		}
+	})
+}
+
+func TestLoadCommentsDescribesActions(t *testing.T) {
+	var transactions []differentialDatabaseTransaction
+	for i, action := range []string{"rethink", "abandon", "reclaim", "commit", "unknown"} {
+		transaction := BuildTransactionForUser("u1", strconv.Quote(action), i)
+		transaction.PHID = "PHID-XACT-" + action
+		transactions = append(transactions, transaction)
+	}
+	readTransactions := func(reviewID string) ([]differentialDatabaseTransaction, error) {
+		return transactions, nil
+	}
+	comments, err := LoadComments(DifferentialReview{PHID: "PHID-DREV-1"}, readTransactions, MockReadTransactionComment, MockLookupUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var descriptions []string
+	for _, c := range comments {
+		if c.Resolved != nil {
+			t.Errorf("Unexpected resolved bit for %v", c)
+		}
+		descriptions = append(descriptions, c.Description)
+	}
+	expected := []string{
+		"Planned changes to this revision.",
+		"Abandoned this revision.",
+		"Reclaimed this revision.",
+		"Closed this revision.",
+	}
+	if strings.Join(descriptions, "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected action comments: %v", descriptions)
+	}
+}
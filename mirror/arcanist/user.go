@@ -18,6 +18,7 @@ package arcanist
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -51,24 +52,41 @@ type whoAmIResponse struct {
 	Response     user   `json:"response,omitempty"`
 }
 
-var userQueryCache = make(map[string]cachedUser)
-var userLookupCache = make(map[string]cachedUser)
+// userCacheKey identifies a cached user. Since each Phabricator instance has its own users,
+// the users are cached separately for each ConduitCaller.
+type userCacheKey struct {
+	conduit ConduitCaller
+	name    string
+}
+
+var userQueryCache = make(map[userCacheKey]cachedUser)
+var userLookupCache = make(map[userCacheKey]cachedUser)
+
+// userCacheMutex guards the user caches, which are shared by every repo being mirrored.
+var userCacheMutex sync.Mutex
 
 // We should have *some* time limit for cache values, as the user might change their
 // email address in Phabricator, but we don't have any data to decide what is a
 // reasonable limit, so we are just starting with 5 minutes as an initial value.
 var userCacheDuration = -(time.Minute * 5)
 
-func userCacheLookup(key string, cache map[string]cachedUser, f func() (*user, error)) (*user, error) {
-	if cachedValue, ok := cache[key]; ok {
-		if cachedValue.Time.After(time.Now().Add(userCacheDuration)) {
-			return cachedValue.User, nil
-		}
+// userCacheLookup returns the cached user for the given key, or calls f to look it up if there is none.
+//
+// The lock is not held while calling f, so concurrent lookups of the same uncached user may
+// both query Phabricator, but lookups of other users are never blocked by a slow query.
+func userCacheLookup(key userCacheKey, cache map[userCacheKey]cachedUser, f func() (*user, error)) (*user, error) {
+	userCacheMutex.Lock()
+	cachedValue, ok := cache[key]
+	userCacheMutex.Unlock()
+	if ok && cachedValue.Time.After(time.Now().Add(userCacheDuration)) {
+		return cachedValue.User, nil
 	}
 	result, err := f()
 	if err != nil {
 		return result, err
 	}
+	userCacheMutex.Lock()
+	defer userCacheMutex.Unlock()
 	cache[key] = cachedUser{
 		User: result,
 		Time: time.Now(),
@@ -81,17 +99,21 @@ func userCacheLookup(key string, cache map[string]cachedUser, f func() (*user, e
 // Since we do not know if the name is an email address or a username, we first try
 // to find a user whose email matches the name, and then fall back to a username
 // search if that fails.
-func queryUser(name string) (*user, error) {
-	return userCacheLookup(name, userQueryCache, func() (*user, error) {
+func (arc Arcanist) queryUser(name string) (*user, error) {
+	return userCacheLookup(userCacheKey{arc.Conduit, name}, userQueryCache, func() (*user, error) {
 		emailQueryRequest := userQueryRequest{Emails: []string{name}}
 		var queryResponse userQueryResponse
-		runArcCommandOrDie("user.query", emailQueryRequest, &queryResponse)
+		if err := arc.callConduit("user.query", emailQueryRequest, &queryResponse); err != nil {
+			return nil, err
+		}
 		if queryResponse.Error != "" {
 			return nil, fmt.Errorf("Failed to query the Phabricator users: %s", queryResponse.ErrorMessage)
 		}
 		if len(queryResponse.Response) == 0 {
 			usernameQueryRequest := userQueryRequest{UserNames: []string{name}}
-			runArcCommandOrDie("user.query", usernameQueryRequest, &queryResponse)
+			if err := arc.callConduit("user.query", usernameQueryRequest, &queryResponse); err != nil {
+				return nil, err
+			}
 			if queryResponse.Error != "" {
 				return nil, fmt.Errorf("Failed to query the Phabricator users: %s", queryResponse.ErrorMessage)
 			}
@@ -106,11 +128,13 @@ func queryUser(name string) (*user, error) {
 type UserLookup func(userPHID string) (*user, error)
 
 // lookupUser reads the Phabricator user given the corresponding unique ID.
-func lookupUser(userPHID string) (*user, error) {
-	return userCacheLookup(userPHID, userLookupCache, func() (*user, error) {
+func (arc Arcanist) lookupUser(userPHID string) (*user, error) {
+	return userCacheLookup(userCacheKey{arc.Conduit, userPHID}, userLookupCache, func() (*user, error) {
 		queryRequest := userQueryRequest{IDs: []string{userPHID}}
 		var queryResponse userQueryResponse
-		runArcCommandOrDie("user.query", queryRequest, &queryResponse)
+		if err := arc.callConduit("user.query", queryRequest, &queryResponse); err != nil {
+			return nil, err
+		}
 		if queryResponse.Error != "" {
 			return nil, fmt.Errorf("Failed to query the Phabricator users: %s", queryResponse.ErrorMessage)
 		}
@@ -121,18 +145,33 @@ func lookupUser(userPHID string) (*user, error) {
 	})
 }
 
-var mirrorUser *user = nil
+// mirrorUsers holds the Phabricator user for the mirroring tool, for each ConduitCaller.
+var mirrorUsers = make(map[ConduitCaller]user)
+var mirrorUserMutex sync.Mutex
 
 // whoAmI returns the Phabricator user for the mirroring tool.
-func whoAmI() (user, error) {
-	if mirrorUser != nil {
-		return *mirrorUser, nil
+func (arc Arcanist) whoAmI() (user, error) {
+	mirrorUserMutex.Lock()
+	defer mirrorUserMutex.Unlock()
+	if mirrorUser, ok := mirrorUsers[arc.Conduit]; ok {
+		return mirrorUser, nil
 	}
 	var response whoAmIResponse
-	runArcCommandOrDie("user.whoami", struct{}{}, &response)
+	if err := arc.callConduit("user.whoami", struct{}{}, &response); err != nil {
+		return user{}, err
+	}
 	if response.Error != "" {
 		return user{}, fmt.Errorf("Failed to lookup the current user: %s", response.ErrorMessage)
 	}
-	mirrorUser = &response.Response
-	return *mirrorUser, nil
+	mirrorUsers[arc.Conduit] = response.Response
+	return response.Response, nil
+}
+
+// WhoAmI returns the username of the Phabricator user that the mirror acts as.
+func WhoAmI() (string, error) {
+	mirrorUser, err := Arcanist{}.whoAmI()
+	if err != nil {
+		return "", err
+	}
+	return mirrorUser.UserName, nil
 }
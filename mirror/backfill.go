@@ -0,0 +1,133 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"fmt"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	review_utils "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
+)
+
+// backfillPageSize is the number of closed reviews read from the review tool at a time.
+const backfillPageSize = 100
+
+// backfillReview imports the given closed review into the repo, if its commits are in the repo,
+// and then mirrors all of its comments. Reviews that have already been backfilled are skipped.
+func backfillReview(repo repository.Repo, tool review_utils.Tool, phabricatorReview review_utils.PhabricatorReview) error {
+	revision := phabricatorReview.GetFirstCommit(repo)
+	if revision == "" {
+		linked, err := tool.ImportReview(repo, phabricatorReview)
+		if err != nil || !linked {
+			return err
+		}
+		revision = phabricatorReview.GetFirstCommit(repo)
+		if revision == "" {
+			// The link was not actually written, because this is a dry run.
+			return nil
+		}
+	}
+	if store.IsBackfilled(repo.GetPath(), revision) {
+		return nil
+	}
+	if err := mirrorReviewComments(repo, phabricatorReview); err != nil {
+		return err
+	}
+	return store.MarkBackfilled(repo.GetPath(), revision)
+}
+
+// backfillRepo backfills every closed review in the review tool into the repo, and returns the
+// number of reviews that failed.
+//
+// The progress is recorded after every page of reviews, so that an interrupted backfill resumes
+// where it left off. Once a page has a failure, the progress stops being recorded, so that the
+// failed reviews are retried when the backfill is run again.
+func backfillRepo(repo repository.Repo, tool review_utils.Tool) (int, error) {
+	failures := 0
+	cursor := store.GetBackfillCursor(repo.GetPath())
+	if cursor != "" {
+		logger.Infof("Resuming the backfill of %s after %s", repo.GetPath(), cursor)
+	}
+	for {
+		reviews, next, err := tool.ListClosedReviews(repo, cursor, backfillPageSize)
+		if err != nil {
+			return failures, err
+		}
+		for _, phabricatorReview := range reviews {
+			if err := backfillReview(repo, tool, phabricatorReview); err != nil {
+				logger.Errorf("Failed to backfill %v into %s: %v", phabricatorReview, repo.GetPath(), err)
+				failures++
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+		if failures == 0 {
+			if err := store.SetBackfillCursor(repo.GetPath(), cursor); err != nil {
+				return failures, err
+			}
+		}
+	}
+	if failures > 0 {
+		return failures, nil
+	}
+	// Reviews are listed from the most recent, so the next backfill must start from the beginning.
+	return 0, store.SetBackfillCursor(repo.GetPath(), "")
+}
+
+// Backfill imports the history of every closed or abandoned revision in the review tool whose
+// commits are in the given repo, as git-appraise reviews and comments.
+//
+// The backfill is idempotent, so it can be safely interrupted and run again.
+func Backfill(repo repository.Repo, syncToRemote bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic while backfilling the repo %s: %v", repo.GetPath(), r)
+		}
+	}()
+	settings := settingsFor(repo)
+	if !settings.Enabled() {
+		logger.Infof("Skipping the repo %s, as mirroring is disabled for it", repo.GetPath())
+		return nil
+	}
+	repoArc, err := arcFor(settings)
+	if err != nil {
+		return err
+	}
+	repo = wrapRepo(repo)
+	unlock := lockRepo(repo.GetPath())
+	defer unlock()
+	if syncToRemote {
+		if err := repo.PullNotes(settings.Remote, settings.NotesRefPattern); err != nil {
+			logger.Errorf("Failed to pull updates for the repo %v: %v\n", repo, err)
+		}
+	}
+	failures, err := backfillRepo(repo, repoArc)
+	if syncToRemote {
+		if err := repo.PushNotes(settings.Remote, settings.NotesRefPattern); err != nil {
+			logger.Errorf("Failed to push updates to the repo %v: %v\n", repo, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if failures > 0 {
+		return fmt.Errorf("Failed to backfill %d reviews in %s", failures, repo.GetPath())
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review"
+	"github.com/akatrevorjay/git-appraise/review/comment"
+	"github.com/akatrevorjay/git-appraise/review/request"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/arcanist"
+	phabricatorReview "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
+)
+
+type backfillingReviewTool struct {
+	mockReviewTool
+	Closed    []phabricatorReview.PhabricatorReview
+	Cursors   []string
+	ImportErr error
+}
+
+// ListClosedReviews uses the index of the next review as the cursor.
+func (tool *backfillingReviewTool) ListClosedReviews(repo repository.Repo, after string, limit int) ([]phabricatorReview.PhabricatorReview, string, error) {
+	tool.Cursors = append(tool.Cursors, after)
+	start, _ := strconv.Atoi(after)
+	end := start + limit
+	if end >= len(tool.Closed) {
+		return tool.Closed[start:], "", nil
+	}
+	return tool.Closed[start:end], strconv.Itoa(end), nil
+}
+
+func (tool *backfillingReviewTool) ImportReview(repo repository.Repo, r phabricatorReview.PhabricatorReview) (bool, error) {
+	return false, tool.ImportErr
+}
+
+func TestBackfillRepo(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	tool := backfillingReviewTool{mockReviewTool: mockReviewTool{make(map[string]request.Request)}}
+	// Only the last review is in the repo, and the others fail to be imported while the tool is down.
+	for i := 0; i < backfillPageSize+10; i++ {
+		tool.Closed = append(tool.Closed, mockPhabricatorReview{})
+	}
+	tool.Closed = append(tool.Closed, mockPhabricatorReview{
+		Revision: "rev1",
+		Comments: []phabricatorReview.PhabricatorComment{{
+			PHID:    "PHID-XCMT-BACKFILL",
+			Comment: comment.Comment{Author: "foo@bar.com", Timestamp: "1", Description: "LGTM", Resolved: new(bool)},
+		}},
+	})
+
+	tool.ImportErr = errors.New("Phabricator is down")
+	failures, err := backfillRepo(repo, &tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != len(tool.Closed)-1 {
+		t.Errorf("Unexpected number of failures: %d", failures)
+	}
+	if cursor := store.GetBackfillCursor(repo.GetPath()); cursor != "" {
+		t.Errorf("Progress was recorded past the failed reviews: %q", cursor)
+	}
+
+	// Simulate an interrupted backfill that got through the first page.
+	tool.ImportErr = nil
+	tool.Cursors = nil
+	if err := store.SetBackfillCursor(repo.GetPath(), strconv.Itoa(backfillPageSize)); err != nil {
+		t.Fatal(err)
+	}
+	if failures, err := backfillRepo(repo, &tool); err != nil || failures != 0 {
+		t.Fatalf("Unexpected backfill result: %d, %v", failures, err)
+	}
+	if len(tool.Cursors) != 1 || tool.Cursors[0] != strconv.Itoa(backfillPageSize) {
+		t.Errorf("The backfill did not resume where it left off: %v", tool.Cursors)
+	}
+	if cursor := store.GetBackfillCursor(repo.GetPath()); cursor != "" {
+		t.Errorf("The progress was not reset after the backfill finished: %q", cursor)
+	}
+	if notes := repo.GetNotes(comment.Ref, "rev1"); len(notes) != 1 {
+		t.Errorf("Unexpected comment notes: %v", notes)
+	}
+	if !store.IsBackfilled(repo.GetPath(), "rev1") {
+		t.Errorf("The review was not marked as backfilled")
+	}
+
+	// Running the backfill again must not duplicate anything.
+	tool.Cursors = nil
+	if failures, err := backfillRepo(repo, &tool); err != nil || failures != 0 {
+		t.Fatalf("Unexpected backfill result: %d, %v", failures, err)
+	}
+	if len(tool.Cursors) != 2 || tool.Cursors[0] != "" {
+		t.Errorf("The backfill did not start from the beginning: %v", tool.Cursors)
+	}
+	if notes := repo.GetNotes(comment.Ref, "rev1"); len(notes) != 1 {
+		t.Errorf("The comments were backfilled twice: %v", notes)
+	}
+}
+
+// scriptedConduit replies to each Conduit call with the response for the first of the method's
+// patterns that appears in the encoded request, and records the methods that were called.
+type scriptedConduit struct {
+	Responses map[string][][2]string
+	Calls     []string
+}
+
+func (c *scriptedConduit) Call(method string, request interface{}, response interface{}) error {
+	c.Calls = append(c.Calls, method)
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for _, reply := range c.Responses[method] {
+		if strings.Contains(string(encoded), reply[0]) {
+			return json.Unmarshal([]byte(reply[1]), response)
+		}
+	}
+	return fmt.Errorf("Unexpected conduit call to %s with %s", method, encoded)
+}
+
+const testBackfillDiff = `{"response": {"%d": {"id": "%d", "changes": [], "properties": {
+  "arc:onto": "master",
+  "local:commits": {"%s": {"parents": ["BASE"], "time": "100"}}}}}}`
+
+func TestMirrorRepoAfterBackfill(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := pathRepo{repository.NewMockRepoForTest(), "/backfilled"}
+	conduit := &scriptedConduit{Responses: map[string][][2]string{
+		"differential.revision.search": {{"", `{"response": {"data": [{"id": 61}, {"id": 62}], "cursor": {"after": null}}}`}},
+		"differential.query": {
+			{`"ids":[61,62]`, `{"response": [
+  {"id": "61", "phid": "PHID-DREV-61", "title": "Abandoned", "status": "4", "authorPHID": "PHID-USER-BACKFILL",
+   "reviewers": [], "diffs": ["71"], "dateModified": "1000"},
+  {"id": "62", "phid": "PHID-DREV-62", "title": "Closed", "status": "3", "authorPHID": "PHID-USER-BACKFILL",
+   "reviewers": [], "diffs": ["72"], "commits": ["PHID-CMIT-62"], "dateModified": "1000"}]}`},
+			{`"ids":[61]`, `{"response": [{"id": "61", "phid": "PHID-DREV-61", "status": "4", "reviewers": [], "diffs": ["71"], "dateModified": "1000"}]}`},
+			{`"ids":[62]`, `{"response": [{"id": "62", "phid": "PHID-DREV-62", "status": "3", "reviewers": [], "diffs": ["72"], "dateModified": "1000"}]}`},
+			{"commitHashes", `{"response": []}`},
+			{"status-open", `{"response": []}`},
+		},
+		"differential.querydiffs": {
+			{`"ids":[71]`, fmt.Sprintf(testBackfillDiff, 71, 71, "ABANDONED")},
+			{`"ids":[72]`, fmt.Sprintf(testBackfillDiff, 72, 72, "CLOSED")},
+		},
+		"user.query":             {{"PHID-USER-BACKFILL", `{"response": [{"phid": "PHID-USER-BACKFILL", "userName": "backfill-author"}]}`}},
+		"diffusion.querycommits": {{"PHID-CMIT-62", `{"response": {"data": {"PHID-CMIT-62": {"identifier": "LANDED"}}}}`}},
+		"transaction.search":     {{"", `{"response": {"data": [], "cursor": {"after": null}}}`}},
+	}}
+	arc := arcanist.Arcanist{Conduit: conduit}
+
+	if failures, err := backfillRepo(repo, arc); err != nil || failures != 0 {
+		t.Fatalf("Unexpected backfill result: %d, %v", failures, err)
+	}
+	if r, err := review.GetSummary(repo, "ABANDONED"); err != nil || r == nil || !r.IsAbandoned() {
+		t.Errorf("The abandoned revision was not backfilled as an abandoned review: %+v, %v", r, err)
+	}
+	if r, err := review.GetSummary(repo, "CLOSED"); err != nil || r == nil || r.Request.Alias != "LANDED" {
+		t.Errorf("The closed revision was not backfilled as a submitted review: %+v, %v", r, err)
+	}
+
+	conduit.Calls = nil
+	if failures, err := mirrorRepo(repo, arc, false); err != nil || failures != 0 {
+		t.Fatalf("Unexpected mirror result: %d, %v", failures, err)
+	}
+	for _, method := range conduit.Calls {
+		if method == "differential.createcomment" || method == "differential.updaterevision" {
+			// These would reclaim, abandon, or update the historical revisions.
+			t.Errorf("Unexpected conduit call after the backfill: %s", method)
+		}
+	}
+}
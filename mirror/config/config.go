@@ -0,0 +1,226 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config reads the mirror's configuration file, which sets how repos are mirrored
+// both globally and for the repos whose paths match a given pattern.
+//
+// The configuration file is YAML, with the global settings at the top level, followed by a
+// list of overrides for specific repos, e.g.:
+//
+//	phabricator_uri: https://phabricator.example.com/
+//	remote: origin
+//	repos:
+//	- path: /var/repo/legacy-*
+//	  phabricator_uri: https://legacy-phabricator.example.com/
+//	- path: /var/repo/scratch
+//	  mirror: false
+//
+// When multiple overrides match a repo, they are applied in the order in which they are listed.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/arcanist"
+)
+
+// Settings describes how to mirror a repo. Unset fields are inherited from the enclosing settings.
+type Settings struct {
+	// PhabricatorURI and ConduitToken identify the Phabricator instance to mirror into, and how
+	// to authenticate with it. If the token is not set, it is read from the arcrc file.
+	PhabricatorURI string `yaml:"phabricator_uri,omitempty"`
+	ConduitToken   string `yaml:"conduit_token,omitempty"`
+	// ConduitTimeout is the number of seconds to wait for each Conduit call.
+	ConduitTimeout int `yaml:"conduit_timeout,omitempty"`
+	// Remote is the remote from which to pull, and to which to push, the git-notes.
+	Remote string `yaml:"remote,omitempty"`
+	// NotesRefPattern is the pattern for the git-notes refs to pull and push.
+	NotesRefPattern string `yaml:"notes_refs,omitempty"`
+	// SyncPeriod is the number of seconds between subsequent syncs of the repo.
+	SyncPeriod int `yaml:"sync_period,omitempty"`
+	// RepoDirPrefix is the parent directory in which Phabricator stores its repos.
+	RepoDirPrefix string `yaml:"repo_dir_prefix,omitempty"`
+	// Callsign is the identifier Phabricator uses for the repo. If it is not set, then it is
+	// guessed from the path of the repo relative to RepoDirPrefix.
+	Callsign string `yaml:"callsign,omitempty"`
+	// Reviewers are added to every Differential revision created for the repo.
+	Reviewers []string `yaml:"reviewers,omitempty"`
+	// Mirror can be set to false in order to stop mirroring a repo.
+	Mirror *bool `yaml:"mirror,omitempty"`
+	// ImportRevisions can be set to true in order to import revisions that were created directly
+	// in Phabricator into the repo as git-appraise reviews.
+	ImportRevisions *bool `yaml:"import_revisions,omitempty"`
+}
+
+// Override holds the settings for the repos whose paths match a pattern.
+type Override struct {
+	// Path is either the path of a repo, or a pattern as understood by filepath.Match.
+	Path     string `yaml:"path"`
+	Settings `yaml:",inline"`
+}
+
+// Config holds the global settings, and any overrides for specific repos.
+type Config struct {
+	Settings `yaml:",inline"`
+	Repos    []Override `yaml:"repos,omitempty"`
+}
+
+// Merge returns a copy of the settings with every field that is set in the given overrides replaced.
+func (s Settings) Merge(overrides Settings) Settings {
+	if overrides.PhabricatorURI != "" {
+		s.PhabricatorURI = overrides.PhabricatorURI
+	}
+	if overrides.ConduitToken != "" {
+		s.ConduitToken = overrides.ConduitToken
+	}
+	if overrides.ConduitTimeout != 0 {
+		s.ConduitTimeout = overrides.ConduitTimeout
+	}
+	if overrides.Remote != "" {
+		s.Remote = overrides.Remote
+	}
+	if overrides.NotesRefPattern != "" {
+		s.NotesRefPattern = overrides.NotesRefPattern
+	}
+	if overrides.SyncPeriod != 0 {
+		s.SyncPeriod = overrides.SyncPeriod
+	}
+	if overrides.RepoDirPrefix != "" {
+		s.RepoDirPrefix = overrides.RepoDirPrefix
+	}
+	if overrides.Callsign != "" {
+		s.Callsign = overrides.Callsign
+	}
+	if overrides.Reviewers != nil {
+		s.Reviewers = append([]string(nil), overrides.Reviewers...)
+	}
+	if overrides.Mirror != nil {
+		mirror := *overrides.Mirror
+		s.Mirror = &mirror
+	}
+	if overrides.ImportRevisions != nil {
+		importRevisions := *overrides.ImportRevisions
+		s.ImportRevisions = &importRevisions
+	}
+	return s
+}
+
+// Enabled reports whether the repo should be mirrored at all.
+func (s Settings) Enabled() bool {
+	return s.Mirror == nil || *s.Mirror
+}
+
+// Imports reports whether revisions created directly in Phabricator should be imported into the repo.
+func (s Settings) Imports() bool {
+	return s.ImportRevisions != nil && *s.ImportRevisions
+}
+
+// Timeout returns the amount of time to wait for each Conduit call, or 0 if there is no limit set.
+func (s Settings) Timeout() time.Duration {
+	return time.Duration(s.ConduitTimeout) * time.Second
+}
+
+// New returns a Config with the given global settings and no overrides.
+func New(settings Settings) *Config {
+	return &Config{Settings: settings}
+}
+
+// Load reads the configuration file at the given path.
+//
+// The given defaults are used for any global settings that the file does not set.
+func Load(path string, defaults Settings) (*Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(contents, defaults)
+}
+
+// Parse parses the contents of a configuration file.
+//
+// The given defaults are used for any global settings that the contents do not set.
+func Parse(contents []byte, defaults Settings) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(contents, &c); err != nil {
+		return nil, err
+	}
+	for _, override := range c.Repos {
+		if override.Path == "" {
+			return nil, fmt.Errorf("Every repo override must specify a path")
+		}
+		if _, err := filepath.Match(override.Path, ""); err != nil {
+			return nil, fmt.Errorf("Malformed repo path pattern %q: %v", override.Path, err)
+		}
+	}
+	c.Settings = defaults.Merge(c.Settings)
+	return &c, nil
+}
+
+// SameInstance reports whether the given settings mirror into the same Phabricator instance as these settings.
+//
+// The URIs are normalized first, as e.g. "https://phabricator.example.com/api/" is the same instance
+// as "https://phabricator.example.com".
+func (s Settings) SameInstance(other Settings) bool {
+	return arcanist.NormalizeConduitURI(s.PhabricatorURI) == arcanist.NormalizeConduitURI(other.PhabricatorURI)
+}
+
+// matches reports whether the override applies to the repo at the given path.
+func (o Override) matches(repoPath string) bool {
+	pattern := filepath.Clean(o.Path)
+	repoPath = filepath.Clean(repoPath)
+	if pattern == repoPath {
+		return true
+	}
+	matched, err := filepath.Match(pattern, repoPath)
+	return err == nil && matched
+}
+
+// ForRepo returns the settings for the repo at the given path.
+//
+// The given repo settings are those read from the repo itself. They take precedence over the
+// global settings, but not over the overrides in the config. Since the repo settings may come
+// from anyone who can push to the repo, a repo that chooses its own Phabricator instance does
+// not inherit the global Conduit token, so that the token is never sent to another host.
+func (c *Config) ForRepo(repoPath string, repoSettings Settings) Settings {
+	settings := c.Settings
+	if repoSettings.PhabricatorURI != "" && !repoSettings.SameInstance(settings) {
+		settings.ConduitToken = ""
+	}
+	repoSettings.ConduitToken = ""
+	settings = settings.Merge(repoSettings)
+	for _, override := range c.Repos {
+		if override.matches(repoPath) {
+			settings = settings.Merge(override.Settings)
+		}
+	}
+	return settings
+}
+
+// MinSyncPeriod returns the shortest sync period of any repo, in seconds.
+func (c *Config) MinSyncPeriod() int {
+	period := c.SyncPeriod
+	for _, override := range c.Repos {
+		if override.SyncPeriod != 0 && override.SyncPeriod < period {
+			period = override.SyncPeriod
+		}
+	}
+	return period
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+)
+
+const testConfig = `
+phabricator_uri: https://phabricator.example.com/
+sync_period: 60
+repos:
+- path: /var/repo/legacy-*
+  phabricator_uri: https://legacy.example.com/
+  remote: upstream
+- path: /var/repo/legacy-scratch
+  mirror: false
+  sync_period: 5
+`
+
+func TestForRepo(t *testing.T) {
+	defaults := Settings{Remote: "origin", NotesRefPattern: "refs/notes/devtools/*", SyncPeriod: 30}
+	c, err := Parse([]byte(testConfig), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := c.ForRepo("/var/repo/other", Settings{})
+	if settings.PhabricatorURI != "https://phabricator.example.com/" || settings.Remote != "origin" ||
+		settings.NotesRefPattern != "refs/notes/devtools/*" || settings.SyncPeriod != 60 || !settings.Enabled() {
+		t.Errorf("Unexpected global settings: %+v", settings)
+	}
+
+	settings = c.ForRepo("/var/repo/legacy-app/", Settings{})
+	if settings.PhabricatorURI != "https://legacy.example.com/" || settings.Remote != "upstream" ||
+		settings.SyncPeriod != 60 || !settings.Enabled() {
+		t.Errorf("Unexpected overridden settings: %+v", settings)
+	}
+
+	settings = c.ForRepo("/var/repo/legacy-scratch", Settings{})
+	if settings.PhabricatorURI != "https://legacy.example.com/" || settings.SyncPeriod != 5 || settings.Enabled() {
+		t.Errorf("Unexpected settings with multiple overrides: %+v", settings)
+	}
+
+	if period := c.MinSyncPeriod(); period != 5 {
+		t.Errorf("Unexpected minimum sync period: %d", period)
+	}
+}
+
+func TestForRepoConduitToken(t *testing.T) {
+	c, err := Parse([]byte(testConfig), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Settings.ConduitToken = "secret"
+
+	// The same instance may be written differently by the owners of a repo.
+	settings := c.ForRepo("/var/repo/other", Settings{PhabricatorURI: "https://phabricator.example.com/api"})
+	if settings.ConduitToken != "secret" || !settings.SameInstance(c.Settings) {
+		t.Errorf("The global token was not used for the global instance: %+v", settings)
+	}
+
+	settings = c.ForRepo("/var/repo/other", Settings{PhabricatorURI: "https://evil.example.com/", ConduitToken: "stolen"})
+	if settings.ConduitToken != "" || settings.SameInstance(c.Settings) {
+		t.Errorf("The global token was used for another instance: %+v", settings)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, contents := range []string{
+		"not_a_setting: true",
+		"repos:\n- remote: upstream",
+		"repos:\n- path: '/var/repo/['",
+	} {
+		if _, err := Parse([]byte(contents), Settings{}); err == nil {
+			t.Errorf("Expected an error for %q", contents)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+// The owners of a repo can change how it is mirrored by setting the following keys, either
+// in the repo's git config, or in an ".arcconfig" file committed to the repo. The git config
+// takes precedence over the ".arcconfig" file.
+//
+// The remote is only read from the git config. Anyone who can push to the repo can change its
+// ".arcconfig" file, and could otherwise have the mirror pull forged git-notes from, and push
+// the repo's git-notes to, a URL of their choosing.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The keys read from a repo's git config and ".arcconfig" file.
+const (
+	uriKey       = "phabricator.uri"
+	callsignKey  = "phabricator.callsign"
+	mirrorKey    = "phabricator.mirror"
+	reviewersKey = "phabricator.reviewers"
+	remoteKey    = "phabricator.remote"
+
+	// arcCallsignKey and arcConduitURIKey are the keys that arcanist itself reads from ".arcconfig".
+	arcCallsignKey   = "repository.callsign"
+	arcConduitURIKey = "conduit_uri"
+)
+
+// parseBool parses a boolean value as understood by git.
+func parseBool(key, value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid boolean value %q for %s", value, key)
+}
+
+// parseList splits a comma-separated list, dropping any empty items.
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ParseGitConfig returns the settings from the given git config values, keyed by their lowercase names.
+//
+// Keys may have multiple values; the last one is used, except for the reviewers, which are all used.
+func ParseGitConfig(values map[string][]string) (Settings, error) {
+	var s Settings
+	last := func(key string) string {
+		if len(values[key]) == 0 {
+			return ""
+		}
+		return values[key][len(values[key])-1]
+	}
+	s.PhabricatorURI = last(uriKey)
+	s.Callsign = last(callsignKey)
+	s.Remote = last(remoteKey)
+	if strings.HasPrefix(s.Remote, "-") {
+		// This would be passed to git as an option rather than a remote.
+		return s, fmt.Errorf("Invalid remote %q for %s", s.Remote, remoteKey)
+	}
+	if len(values[mirrorKey]) > 0 {
+		mirror, err := parseBool(mirrorKey, last(mirrorKey))
+		if err != nil {
+			return s, err
+		}
+		s.Mirror = &mirror
+	}
+	for _, value := range values[reviewersKey] {
+		s.Reviewers = append(s.Reviewers, parseList(value)...)
+	}
+	return s, nil
+}
+
+// ParseArcconfig returns the settings from the contents of an ".arcconfig" file.
+func ParseArcconfig(contents []byte) (Settings, error) {
+	var s Settings
+	var arcconfig map[string]interface{}
+	if err := json.Unmarshal(contents, &arcconfig); err != nil {
+		return s, err
+	}
+	str := func(keys ...string) (string, error) {
+		for _, key := range keys {
+			if value, ok := arcconfig[key]; ok {
+				if str, ok := value.(string); ok {
+					return str, nil
+				}
+				return "", fmt.Errorf("Invalid value %v for %s", value, key)
+			}
+		}
+		return "", nil
+	}
+	var err error
+	if s.PhabricatorURI, err = str(uriKey, arcConduitURIKey); err != nil {
+		return s, err
+	}
+	if s.Callsign, err = str(callsignKey, arcCallsignKey); err != nil {
+		return s, err
+	}
+	switch mirror := arcconfig[mirrorKey].(type) {
+	case nil:
+	case bool:
+		s.Mirror = &mirror
+	case string:
+		value, err := parseBool(mirrorKey, mirror)
+		if err != nil {
+			return s, err
+		}
+		s.Mirror = &value
+	default:
+		return s, fmt.Errorf("Invalid value %v for %s", mirror, mirrorKey)
+	}
+	switch reviewers := arcconfig[reviewersKey].(type) {
+	case nil:
+	case string:
+		s.Reviewers = parseList(reviewers)
+	case []interface{}:
+		for _, reviewer := range reviewers {
+			name, ok := reviewer.(string)
+			if !ok {
+				return s, fmt.Errorf("Invalid reviewer %v in %s", reviewer, reviewersKey)
+			}
+			s.Reviewers = append(s.Reviewers, name)
+		}
+	default:
+		return s, fmt.Errorf("Invalid value %v for %s", reviewers, reviewersKey)
+	}
+	return s, nil
+}
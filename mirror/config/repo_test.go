@@ -0,0 +1,102 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGitConfig(t *testing.T) {
+	s, err := ParseGitConfig(map[string][]string{
+		"phabricator.uri":       {"https://old.example.com/", "https://phabricator.example.com/"},
+		"phabricator.callsign":  {"APP"},
+		"phabricator.mirror":    {"no"},
+		"phabricator.reviewers": {"alice, bob", "carol"},
+		"phabricator.remote":    {"upstream"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.PhabricatorURI != "https://phabricator.example.com/" || s.Callsign != "APP" || s.Remote != "upstream" || s.Enabled() {
+		t.Errorf("Unexpected settings: %+v", s)
+	}
+	if !reflect.DeepEqual(s.Reviewers, []string{"alice", "bob", "carol"}) {
+		t.Errorf("Unexpected reviewers: %v", s.Reviewers)
+	}
+
+	if _, err := ParseGitConfig(map[string][]string{"phabricator.mirror": {"maybe"}}); err == nil {
+		t.Errorf("Expected an error for an invalid boolean")
+	}
+	if _, err := ParseGitConfig(map[string][]string{"phabricator.remote": {"--upload-pack=touch /tmp/pwned"}}); err == nil {
+		t.Errorf("Expected an error for a remote that looks like an option")
+	}
+}
+
+func TestParseArcconfig(t *testing.T) {
+	s, err := ParseArcconfig([]byte(`{
+		"conduit_uri": "https://phabricator.example.com/",
+		"repository.callsign": "APP",
+		"phabricator.mirror": true,
+		"phabricator.reviewers": ["alice", "bob"],
+		"phabricator.remote": "https://attacker.example.com/repo.git"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.PhabricatorURI != "https://phabricator.example.com/" || s.Callsign != "APP" || !s.Enabled() || s.Remote != "" {
+		t.Errorf("Unexpected settings: %+v", s)
+	}
+	if !reflect.DeepEqual(s.Reviewers, []string{"alice", "bob"}) {
+		t.Errorf("Unexpected reviewers: %v", s.Reviewers)
+	}
+
+	for _, contents := range []string{
+		"not json",
+		`{"phabricator.mirror": 2}`,
+		`{"phabricator.reviewers": [1]}`,
+		`{"phabricator.uri": false}`,
+	} {
+		if _, err := ParseArcconfig([]byte(contents)); err == nil {
+			t.Errorf("Expected an error for %s", contents)
+		}
+	}
+}
+
+func TestForRepoWithRepoSettings(t *testing.T) {
+	c, err := Parse([]byte(testConfig), Settings{ConduitToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := c.ForRepo("/var/repo/app", Settings{Remote: "upstream", ConduitToken: "ignored"})
+	if settings.Remote != "upstream" || settings.ConduitToken != "secret" {
+		t.Errorf("Unexpected settings: %+v", settings)
+	}
+
+	// The global token must not be sent to a Phabricator instance chosen by the repo.
+	settings = c.ForRepo("/var/repo/app", Settings{PhabricatorURI: "https://elsewhere.example.com/"})
+	if settings.PhabricatorURI != "https://elsewhere.example.com/" || settings.ConduitToken != "" {
+		t.Errorf("Unexpected settings for another instance: %+v", settings)
+	}
+
+	// The overrides in the config take precedence over the repo's own settings.
+	settings = c.ForRepo("/var/repo/legacy-app", Settings{Remote: "mine"})
+	if settings.Remote != "upstream" {
+		t.Errorf("Unexpected settings with an override: %+v", settings)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package discovery finds the git repos to mirror under a search directory.
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+)
+
+// newRepo returns the repo at the given path. It is a variable so that tests can replace it.
+var newRepo = func(path string) (repository.Repo, error) {
+	return repository.NewGitRepo(path)
+}
+
+// Finder searches a directory tree for git repos, including bare repos.
+//
+// Symbolic links to directories are followed, but each directory is only searched once,
+// so that a link cycle does not cause an infinite search, and a repo that can be reached
+// through multiple links is only found once.
+type Finder struct {
+	// Root is the directory under which to search for repos.
+	Root string
+	// Include, if not empty, limits the repos found to those whose paths match one of these patterns.
+	Include []string
+	// Exclude lists patterns for the repos, or directories, that should not be searched.
+	Exclude []string
+	// RescanPeriod is how long the repos found by a search are reused before searching again.
+	RescanPeriod time.Duration
+
+	mutex        sync.Mutex
+	repos        []repository.Repo
+	lastSearched time.Time
+}
+
+// NewFinder returns a Finder for the repos under the given directory.
+func NewFinder(root string, include, exclude []string, rescanPeriod time.Duration) *Finder {
+	return &Finder{
+		Root:         root,
+		Include:      include,
+		Exclude:      exclude,
+		RescanPeriod: rescanPeriod,
+	}
+}
+
+// matches reports whether the given path matches any of the given patterns.
+//
+// Each pattern, as understood by filepath.Match, is matched against both the full path and
+// the path relative to the given root, so that "team/*" and "/var/repo/team/*" are equivalent.
+func matches(patterns []string, root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, rel); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isFile reports whether the given path exists and is not a directory.
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// isDir reports whether the given path exists and is a directory.
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// IsBareRepo reports whether the given directory is the git directory of a bare repo.
+func IsBareRepo(dir string) bool {
+	return isFile(filepath.Join(dir, "HEAD")) && isDir(filepath.Join(dir, "objects")) && isDir(filepath.Join(dir, "refs"))
+}
+
+// IsWorkingTree reports whether the given directory is the top level of a non-bare repo.
+//
+// The ".git" entry may be a file rather than a directory for linked working trees and submodules.
+func IsWorkingTree(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// Find returns the repos under the root directory, in lexical order of their paths.
+//
+// The results of the previous search are returned if it was less than RescanPeriod ago,
+// after dropping any repos that have since been deleted.
+func (f *Finder) Find() ([]repository.Repo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.lastSearched.IsZero() && time.Since(f.lastSearched) < f.RescanPeriod {
+		var repos []repository.Repo
+		for _, repo := range f.repos {
+			if IsWorkingTree(repo.GetPath()) || IsBareRepo(repo.GetPath()) {
+				repos = append(repos, repo)
+			}
+		}
+		f.repos = repos
+		return repos, nil
+	}
+	root, err := filepath.EvalSymlinks(f.Root)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	s := search{finder: f, realRoot: root, visited: make(map[string]bool)}
+	s.walk(f.Root, root)
+	f.repos = s.repos
+	f.lastSearched = time.Now()
+	return s.repos, nil
+}
+
+// search holds the state of a single search for repos.
+type search struct {
+	finder   *Finder
+	realRoot string
+	// visited holds the real paths of the directories that have already been searched.
+	visited map[string]bool
+	repos   []repository.Repo
+}
+
+// matches reports whether the directory at the given path, or its real path, matches any of the given patterns.
+func (s *search) matches(patterns []string, path, realPath string) bool {
+	return matches(patterns, s.finder.Root, path) || matches(patterns, s.realRoot, realPath)
+}
+
+// walk searches the directory at the given path, whose real path (with every symbolic link resolved) is also given.
+func (s *search) walk(path, realPath string) {
+	if s.visited[realPath] {
+		return
+	}
+	s.visited[realPath] = true
+	if path != s.finder.Root && s.matches(s.finder.Exclude, path, realPath) {
+		return
+	}
+	if IsWorkingTree(path) || IsBareRepo(path) {
+		if len(s.finder.Include) > 0 && !s.matches(s.finder.Include, path, realPath) {
+			return
+		}
+		repo, err := newRepo(path)
+		if err != nil {
+			logger.Warningf("Skipping %s, which looks like a git repo but is not: %v", path, err)
+			return
+		}
+		s.repos = append(s.repos, repo)
+		// Since we have found a git repo, we don't need to traverse any of its child directories.
+		return
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		logger.Warningf("Failed to search %s for repos: %v", path, err)
+		return
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		logger.Warningf("Failed to search %s for repos: %v", path, err)
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			// Hidden directories (such as ".git" itself) never hold repos we want to mirror.
+			continue
+		}
+		childPath := filepath.Join(path, name)
+		info, err := os.Lstat(childPath)
+		if err != nil {
+			continue
+		}
+		childRealPath := filepath.Join(realPath, name)
+		if info.Mode()&os.ModeSymlink != 0 {
+			resolved, err := filepath.EvalSymlinks(childPath)
+			if err != nil {
+				logger.Debugf("Skipping the broken link %s: %v", childPath, err)
+				continue
+			}
+			if info, err = os.Stat(resolved); err != nil {
+				continue
+			}
+			childRealPath = resolved
+		}
+		if info.IsDir() {
+			s.walk(childPath, childRealPath)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+)
+
+func init() {
+	newRepo = func(path string) (repository.Repo, error) {
+		return &repository.GitRepo{Path: path}, nil
+	}
+}
+
+// setupTree creates a directory tree with a mix of repos, and returns its root.
+func setupTree(t *testing.T) string {
+	root, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{
+		"a/.git",
+		"a/sub/.git",
+		"b.git/objects",
+		"b.git/refs",
+		"nested/c/.git",
+		"excluded/d/.git",
+		"plain/dir",
+	} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "b.git", "HEAD"), []byte("ref: refs/heads/master\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A second path to the nested repo, and a link cycle.
+	if err := os.Symlink(filepath.Join(root, "nested"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(root, "plain", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func repoPaths(root string, repos []repository.Repo) []string {
+	var paths []string
+	for _, repo := range repos {
+		rel, _ := filepath.Rel(root, repo.GetPath())
+		paths = append(paths, rel)
+	}
+	return paths
+}
+
+func TestFind(t *testing.T) {
+	root := setupTree(t)
+	defer os.RemoveAll(root)
+
+	repos, err := NewFinder(root, nil, []string{"excluded"}, 0).Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := repoPaths(root, repos); !reflect.DeepEqual(paths, []string{"a", "b.git", "link/c"}) {
+		t.Errorf("Unexpected repos: %v", paths)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos, err = NewFinder(root, []string{"*.git", realRoot + "/nested/*"}, nil, 0).Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The nested repo is found through the link, but its real path matches the pattern.
+	if paths := repoPaths(root, repos); !reflect.DeepEqual(paths, []string{"b.git", "link/c"}) {
+		t.Errorf("Unexpected included repos: %v", paths)
+	}
+
+	if _, err := NewFinder(filepath.Join(root, "missing"), nil, nil, 0).Find(); err == nil {
+		t.Errorf("Expected an error for a missing search directory")
+	}
+}
+
+func TestFindCachesResults(t *testing.T) {
+	root := setupTree(t)
+	defer os.RemoveAll(root)
+
+	finder := NewFinder(root, nil, nil, time.Hour)
+	repos, err := finder.Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 4 {
+		t.Fatalf("Unexpected repos: %v", repoPaths(root, repos))
+	}
+	if err := os.MkdirAll(filepath.Join(root, "new", ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	}
+	repos, err = finder.Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := repoPaths(root, repos); !reflect.DeepEqual(paths, []string{"b.git", "excluded/d", "link/c"}) {
+		t.Errorf("Unexpected cached repos: %v", paths)
+	}
+}
@@ -0,0 +1,7 @@
+package discovery
+
+import (
+	"github.com/op/go-logging"
+)
+
+var logger = logging.MustGetLogger("mirror")
@@ -0,0 +1,124 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dryrun records the changes that the mirror would make, without making them.
+//
+// In a dry run, every Conduit call that could modify Phabricator and every change to the
+// git-notes of a repo is recorded in a Plan rather than being performed. Calls that only
+// read data are still made, so that the plan reflects the current state of both sides.
+package dryrun
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+)
+
+// The types of actions that can be recorded.
+const (
+	ConduitCall = "conduit"
+	AppendNote  = "note"
+	PushNotes   = "push"
+)
+
+// Action describes a single change that the mirror would have made.
+type Action struct {
+	Type string `json:"type"`
+	// Repo is the path of the repo being changed, and is empty for Conduit calls.
+	Repo string `json:"repo,omitempty"`
+	// Method and Params describe a Conduit call.
+	Method string      `json:"method,omitempty"`
+	Params interface{} `json:"params,omitempty"`
+	// Ref, Revision, and Note describe a git-notes append.
+	Ref      string `json:"ref,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	Note     string `json:"note,omitempty"`
+	// Remote is the remote that git-notes would be pushed to.
+	Remote string `json:"remote,omitempty"`
+}
+
+// Plan is the list of actions recorded during a dry run.
+type Plan struct {
+	mutex   sync.Mutex
+	actions []Action
+	encoder *json.Encoder
+}
+
+// NewPlan returns an empty Plan that writes each recorded action as a line of JSON to the given writer.
+//
+// The writer may be nil, in which case the actions are only kept in memory.
+func NewPlan(w io.Writer) *Plan {
+	plan := &Plan{}
+	if w != nil {
+		plan.encoder = json.NewEncoder(w)
+	}
+	return plan
+}
+
+// Record adds the given action to the plan.
+func (p *Plan) Record(action Action) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.actions = append(p.actions, action)
+	if p.encoder != nil {
+		return p.encoder.Encode(action)
+	}
+	return nil
+}
+
+// Actions returns every action recorded so far, in the order they were recorded.
+func (p *Plan) Actions() []Action {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]Action(nil), p.actions...)
+}
+
+// repo is a repository.Repo whose git-notes changes are recorded in a Plan rather than being made.
+type repo struct {
+	repository.Repo
+	plan *Plan
+}
+
+// NewRepo returns a copy of the given repo that records any changes to its git-notes in the given plan.
+//
+// Everything else, including pulling git-notes from the remote, is passed through to the given repo.
+func NewRepo(r repository.Repo, plan *Plan) repository.Repo {
+	if wrapped, ok := r.(*repo); ok {
+		r = wrapped.Repo
+	}
+	return &repo{Repo: r, plan: plan}
+}
+
+func (r *repo) AppendNote(ref, revision string, note repository.Note) error {
+	return r.plan.Record(Action{
+		Type:     AppendNote,
+		Repo:     r.GetPath(),
+		Ref:      ref,
+		Revision: revision,
+		Note:     string(note),
+	})
+}
+
+func (r *repo) PushNotes(remote, notesRefPattern string) error {
+	return r.plan.Record(Action{
+		Type:   PushNotes,
+		Repo:   r.GetPath(),
+		Ref:    notesRefPattern,
+		Remote: remote,
+	})
+}
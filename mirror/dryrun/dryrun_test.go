@@ -0,0 +1,74 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+)
+
+func TestRepoRecordsNoteChanges(t *testing.T) {
+	var output bytes.Buffer
+	plan := NewPlan(&output)
+	mockRepo := repository.NewMockRepoForTest()
+	repo := NewRepo(mockRepo, plan)
+
+	before := len(repo.GetNotes("refs/notes/devtools/reviews", "rev1"))
+	if err := repo.AppendNote("refs/notes/devtools/reviews", "rev1", repository.Note("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.PushNotes("origin", "refs/notes/devtools/*"); err != nil {
+		t.Fatal(err)
+	}
+	if after := len(mockRepo.GetNotes("refs/notes/devtools/reviews", "rev1")); after != before {
+		t.Errorf("A note was appended during a dry run: %d notes became %d", before, after)
+	}
+
+	actions := plan.Actions()
+	if len(actions) != 2 {
+		t.Fatalf("Unexpected actions: %+v", actions)
+	}
+	if actions[0].Type != AppendNote || actions[0].Revision != "rev1" || actions[0].Note != "new" {
+		t.Errorf("Unexpected note action: %+v", actions[0])
+	}
+	if actions[1].Type != PushNotes || actions[1].Remote != "origin" {
+		t.Errorf("Unexpected push action: %+v", actions[1])
+	}
+
+	// Each action is also written as a line of JSON.
+	decoder := json.NewDecoder(&output)
+	for i := range actions {
+		var action Action
+		if err := decoder.Decode(&action); err != nil {
+			t.Fatal(err)
+		}
+		if action.Type != actions[i].Type {
+			t.Errorf("Unexpected action written: %+v", action)
+		}
+	}
+
+	// Wrapping a repo twice must not record the same change twice.
+	if err := NewRepo(repo, plan).AppendNote("refs/notes/devtools/reviews", "rev2", repository.Note("new")); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions()) != 3 {
+		t.Errorf("Unexpected actions after wrapping twice: %+v", plan.Actions())
+	}
+}
@@ -18,100 +18,451 @@ limitations under the License.
 package mirror
 
 import (
+	"fmt"
 	"github.com/akatrevorjay/git-appraise/repository"
 	"github.com/akatrevorjay/git-appraise/review"
 	"github.com/akatrevorjay/git-appraise/review/comment"
 	"github.com/akatrevorjay/git-phabricator-mirror/mirror/arcanist"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/dryrun"
 	review_utils "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
+	"sync"
 )
 
 var arc = arcanist.Arcanist{}
 
-// processedStates is used to keep track of the state of each repository at the last time we processed it.
+// store is used to keep track of the state of each repository at the last time we processed it.
 // That, in turn, is used to avoid re-processing a repo if its state has not changed.
-var processedStates = make(map[string]string)
-var existingComments = make(map[string][]review.CommentThread)
-var openReviews = make(map[string][]review_utils.PhabricatorReview)
+var store state.Store = state.NewMemoryStore()
 
-func hasOverlap(newComment comment.Comment, existingComments []review.CommentThread) bool {
+// SetStore replaces the Store used to record the progress of the mirror, so that it can persist across restarts.
+func SetStore(s state.Store) {
+	store = s
+	arcanist.SetStore(s)
+}
+
+// plan records the changes that would have been made, or is nil if this is not a dry run.
+var plan *dryrun.Plan
+
+// SetDryRun makes the mirror record every change that it would make to Phabricator or
+// to the git-notes of a repo in the given plan, rather than making it.
+func SetDryRun(p *dryrun.Plan) {
+	plan = p
+	arcanist.SetDryRun(p)
+}
+
+// wrapRepo returns the repo through which the given repo should be modified.
+func wrapRepo(repo repository.Repo) repository.Repo {
+	if plan != nil {
+		return dryrun.NewRepo(repo, plan)
+	}
+	return repo
+}
+
+// repoLocks ensures that a repo is never mirrored by multiple goroutines at the same time.
+var repoLocks = make(map[string]*sync.Mutex)
+var repoLocksMutex sync.Mutex
+
+// lockRepo waits until no other goroutine is mirroring the given repo, and returns the function that releases it.
+func lockRepo(repoPath string) func() {
+	repoLocksMutex.Lock()
+	lock, ok := repoLocks[repoPath]
+	if !ok {
+		lock = &sync.Mutex{}
+		repoLocks[repoPath] = lock
+	}
+	repoLocksMutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// findOverlap returns the hash of an existing comment that overlaps with the new one, or "" if there is none.
+//
+// Existing comments that are already linked to a different Phabricator comment are skipped, so that
+// identical comments made more than once in Phabricator are each mirrored.
+func findOverlap(repoPath string, newComment review_utils.PhabricatorComment, existingComments []review.CommentThread) string {
 	for _, existing := range existingComments {
-		if review_utils.Overlaps(newComment, existing.Comment) {
-			return true
-		} else if hasOverlap(newComment, existing.Children) {
-			return true
+		phid := store.GetCommentPHID(repoPath, existing.Hash)
+		if (phid == "" || phid == newComment.PHID) && review_utils.Overlaps(newComment.Comment, existing.Comment) {
+			return existing.Hash
+		} else if hash := findOverlap(repoPath, newComment, existing.Children); hash != "" {
+			return hash
 		}
 	}
-	return false
+	return ""
 }
 
-func mirrorRepoToReview(repo repository.Repo, tool review_utils.Tool, syncToRemote bool) {
+// isMirrored determines if the given Phabricator comment already exists in git-notes.
+//
+// Comments are matched using the links recorded whenever a comment is mirrored in either
+// direction. Comments that were mirrored before we started recording those links are matched
+// by comparing their contents with the existing comments, and then linked to the match.
+func isMirrored(repo repository.Repo, c review_utils.PhabricatorComment, existingComments []review.CommentThread) (bool, error) {
+	if store.GetCommentHash(repo.GetPath(), c.PHID) != "" {
+		return true, nil
+	}
+	hash := findOverlap(repo.GetPath(), c, existingComments)
+	if hash == "" {
+		return false, nil
+	}
+	if err := store.LinkComment(repo.GetPath(), hash, c.PHID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mirrorRequest mirrors a single git-notes review request into the review tool.
+func mirrorRequest(repo repository.Repo, tool review_utils.Tool, r review.Summary) error {
+	reviewJson, err := r.GetJSON()
+	if err != nil {
+		return err
+	}
+	logger.Infof("Mirroring review: %s", reviewJson)
+	reviewDetails, err := r.Details()
+	if err != nil {
+		// The review's details could not be loaded, so there is nothing for us to mirror.
+		return nil
+	}
+	return tool.EnsureRequestExists(repo, *reviewDetails)
+}
+
+// mirrorReviewComments mirrors the comments from a single review in the review tool into git-notes.
+func mirrorReviewComments(repo repository.Repo, phabricatorReview review_utils.PhabricatorReview) error {
+	reviewCommit := phabricatorReview.GetFirstCommit(repo)
+	if reviewCommit == "" {
+		return nil
+	}
+	logger.Infof("Processing review: %s", reviewCommit)
+	r, err := review.GetSummary(repo, reviewCommit)
+	if err != nil {
+		return err
+	} else if r == nil {
+		logger.Infof("Skipping unknown review %q", reviewCommit)
+		return nil
+	}
+	revisionComments := r.Comments
+	logger.Infof("Loaded %d comments for %v\n", len(revisionComments), reviewCommit)
+	comments, err := phabricatorReview.LoadComments()
+	if err != nil {
+		return err
+	}
+	for _, c := range comments {
+		mirrored, err := isMirrored(repo, c, revisionComments)
+		if err != nil {
+			return err
+		}
+		if mirrored {
+			logger.Infof("Skipping '%v', as it has already been written\n", c)
+			continue
+		}
+		// The comment is new.
+		note, err := c.Write()
+		if err != nil {
+			return err
+		}
+		logger.Infof("Appending a comment: %s", string(note))
+		if err := repo.AppendNote(comment.Ref, reviewCommit, note); err != nil {
+			return err
+		}
+		hash, err := c.Hash()
+		if err != nil {
+			return err
+		}
+		if err := store.LinkComment(repo.GetPath(), hash, c.PHID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mirrorStatuses updates the open reviews in the repo that are not among the given open reviews in
+// the review tool, in case they have been closed or abandoned there, and the abandoned reviews that
+// are among them, in case they have been reclaimed there. It returns the number of reviews that failed.
+func mirrorStatuses(repo repository.Repo, tool review_utils.Tool, openReviews []review_utils.PhabricatorReview) int {
+	open := make(map[string]bool)
+	for _, phabricatorReview := range openReviews {
+		if revision := phabricatorReview.GetFirstCommit(repo); revision != "" {
+			open[revision] = true
+		}
+	}
+	failures := 0
+	for _, r := range review.ListAll(repo) {
+		if r.Submitted || r.IsAbandoned() != open[r.Revision] {
+			continue
+		}
+		if err := tool.MirrorStatus(repo, r); err != nil {
+			logger.Errorf("Failed to mirror the status of the review %s in %s: %v", r.Revision, repo.GetPath(), err)
+			failures++
+		}
+	}
+	return failures
+}
+
+// mirrorRepoToReview mirrors every review in the given repository.
+//
+// Failures to mirror an individual review are logged and skipped, so that one malformed
+// review does not prevent the rest of the repository from being mirrored. The returned
+// error only reports failures that affect the repository as a whole.
+func mirrorRepoToReview(repo repository.Repo, tool review_utils.Tool, syncToRemote bool) error {
+	_, err := mirrorRepo(repo, tool, syncToRemote)
+	return err
+}
+
+// mirrorRepo mirrors every review in the given repository, and returns the number of reviews that failed.
+func mirrorRepo(repo repository.Repo, tool review_utils.Tool, syncToRemote bool) (int, error) {
+	failures := 0
 	logger.Infof("Start repo=%s tool=%s syncToRemote=%s", repo, tool, syncToRemote)
+	settings := settingsFor(repo)
 
 	if syncToRemote {
-		repo.PullNotes("origin", "refs/notes/devtools/*")
+		if err := repo.PullNotes(settings.Remote, settings.NotesRefPattern); err != nil {
+			logger.Errorf("Failed to pull updates for the repo %v: %v\n", repo, err)
+		}
 	}
+	// The links are read once per pass, since they may have been changed by the pull or by another process.
+	arcanist.ResetLinks(repo)
 
 	stateHash, err := repo.GetRepoStateHash()
 	if err != nil {
-		orPanic(err)
+		return 0, err
 	}
-	if processedStates[repo.GetPath()] != stateHash {
+	if store.GetRepoState(repo.GetPath()) != stateHash {
 		logger.Infof("Mirroring repo: %s", repo)
+		allMirrored := true
 		for _, r := range review.ListAll(repo) {
-			reviewJson, err := r.GetJSON()
-			if err != nil {
-				orPanic(err)
-			}
-			logger.Infof("Mirroring review: %s", reviewJson)
-			existingComments[r.Revision] = r.Comments
-			reviewDetails, err := r.Details()
-			if err == nil {
-				tool.EnsureRequestExists(repo, *reviewDetails)
+			if err := mirrorRequest(repo, tool, r); err != nil {
+				logger.Errorf("Failed to mirror the review %s in %s: %v", r.Revision, repo.GetPath(), err)
+				allMirrored = false
+				failures++
 			}
 		}
-		openReviews[repo.GetPath()] = tool.ListOpenReviews(repo)
-		processedStates[repo.GetPath()] = stateHash
-		tool.Refresh(repo)
-	}
-
-ReviewLoop:
-	for _, phabricatorReview := range openReviews[repo.GetPath()] {
-		if reviewCommit := phabricatorReview.GetFirstCommit(repo); reviewCommit != "" {
-			logger.Infof("Processing review: %s", reviewCommit)
-			r, err := review.GetSummary(repo, reviewCommit)
-			if err != nil {
-				orPanic(err)
-			} else if r == nil {
-				logger.Infof("Skipping unknown review %q", reviewCommit)
-				continue ReviewLoop
+		// Failed reviews are retried on the next pass, even if the repo has not changed.
+		if allMirrored {
+			if err := store.SetRepoState(repo.GetPath(), stateHash); err != nil {
+				return failures, err
 			}
-			revisionComments := existingComments[reviewCommit]
-			logger.Infof("Loaded %d comments for %v\n", len(revisionComments), reviewCommit)
-			for _, c := range phabricatorReview.LoadComments() {
-				if !hasOverlap(c, revisionComments) {
-					// The comment is new.
-					note, err := c.Write()
-					if err != nil {
-						orPanic(err)
-					}
-					logger.Infof("Appending a comment: %s", string(note))
-					repo.AppendNote(comment.Ref, reviewCommit, note)
-				} else {
-					logger.Infof("Skipping '%v', as it has already been written\n", c)
-				}
+		}
+		if err := tool.Refresh(repo); err != nil {
+			logger.Errorf("Failed to refresh the repo %v: %v\n", repo, err)
+		}
+	}
+
+	// The open reviews are read on every pass, since revisions may be created, closed, abandoned,
+	// or reclaimed in the review tool without the repo changing.
+	reviews, err := tool.ListOpenReviews(repo)
+	if err != nil {
+		return failures, err
+	}
+	failures += mirrorStatuses(repo, tool, reviews)
+	for _, phabricatorReview := range reviews {
+		if settings.Imports() && phabricatorReview.GetFirstCommit(repo) == "" {
+			if _, err := tool.ImportReview(repo, phabricatorReview); err != nil {
+				logger.Errorf("Failed to import %v into %s: %v", phabricatorReview, repo.GetPath(), err)
+				failures++
+				continue
 			}
 		}
+		if err := tool.MirrorReviewers(repo, phabricatorReview); err != nil {
+			logger.Errorf("Failed to mirror the reviewers for %v in %s: %v", phabricatorReview, repo.GetPath(), err)
+			failures++
+		}
+		if err := mirrorReviewComments(repo, phabricatorReview); err != nil {
+			logger.Errorf("Failed to mirror the comments for %v in %s: %v", phabricatorReview, repo.GetPath(), err)
+			failures++
+		}
 	}
 	if syncToRemote {
-		if err := repo.PushNotes("origin", "refs/notes/devtools/*"); err != nil {
+		if err := repo.PushNotes(settings.Remote, settings.NotesRefPattern); err != nil {
 			logger.Errorf("Failed to push updates to the repo %v: %v\n", repo, err)
 		}
 	}
+	return failures, nil
 }
 
 // Repo mirrors the given repository using the system-wide installation of
 // the "arcanist" command line tool.
-func Repo(repo repository.Repo, syncToRemote bool) {
-	arc.Refresh(repo)
-	mirrorRepoToReview(repo, arc, syncToRemote)
+//
+// Any failure, including a panic, is returned to the caller so that it can move on to other repositories.
+func Repo(repo repository.Repo, syncToRemote bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic while mirroring the repo %s: %v", repo.GetPath(), r)
+		}
+	}()
+	settings := settingsFor(repo)
+	if !settings.Enabled() {
+		logger.Debugf("Skipping the repo %s, as mirroring is disabled for it", repo.GetPath())
+		return nil
+	}
+	repoArc, err := arcFor(settings)
+	if err != nil {
+		return err
+	}
+	repo = wrapRepo(repo)
+	unlock := lockRepo(repo.GetPath())
+	defer unlock()
+	if err := repoArc.Refresh(repo); err != nil {
+		logger.Errorf("Failed to refresh the repo %v: %v\n", repo, err)
+	}
+	return mirrorRepoToReview(repo, repoArc, syncToRemote)
+}
+
+// mirrorSingleReview mirrors the review of the given revision, along with its comments in the review tool.
+func mirrorSingleReview(repo repository.Repo, tool review_utils.Tool, revision string, syncToRemote bool) error {
+	settings := settingsFor(repo)
+	if syncToRemote {
+		if err := repo.PullNotes(settings.Remote, settings.NotesRefPattern); err != nil {
+			logger.Errorf("Failed to pull updates for the repo %v: %v\n", repo, err)
+		}
+	}
+	arcanist.ResetLinks(repo)
+	r, err := review.GetSummary(repo, revision)
+	if err != nil {
+		return err
+	} else if r == nil {
+		return fmt.Errorf("There is no review for the revision %q in %s", revision, repo.GetPath())
+	}
+	if err := mirrorRequest(repo, tool, *r); err != nil {
+		return err
+	}
+	phabricatorReview, err := tool.FindReview(repo, revision)
+	if err != nil {
+		return err
+	}
+	if phabricatorReview != nil {
+		if err := mirrorReviewComments(repo, phabricatorReview); err != nil {
+			return err
+		}
+	}
+	if syncToRemote {
+		return repo.PushNotes(settings.Remote, settings.NotesRefPattern)
+	}
+	return nil
+}
+
+// Once mirrors the given repository a single time, and reports any failure to do so.
+//
+// If a revision is given, then only the review of that revision is mirrored. Otherwise,
+// every review in the repository is mirrored, and the failure of any one of them is reported.
+func Once(repo repository.Repo, revision string, syncToRemote bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic while mirroring the repo %s: %v", repo.GetPath(), r)
+		}
+	}()
+	settings := settingsFor(repo)
+	if !settings.Enabled() {
+		logger.Infof("Skipping the repo %s, as mirroring is disabled for it", repo.GetPath())
+		return nil
+	}
+	repoArc, err := arcFor(settings)
+	if err != nil {
+		return err
+	}
+	repo = wrapRepo(repo)
+	unlock := lockRepo(repo.GetPath())
+	defer unlock()
+	if revision != "" {
+		return mirrorSingleReview(repo, repoArc, revision, syncToRemote)
+	}
+	if err := repoArc.Refresh(repo); err != nil {
+		logger.Errorf("Failed to refresh the repo %v: %v\n", repo, err)
+	}
+	failures, err := mirrorRepo(repo, repoArc, syncToRemote)
+	if err != nil {
+		return err
+	}
+	if failures > 0 {
+		return fmt.Errorf("Failed to mirror %d reviews in %s", failures, repo.GetPath())
+	}
+	return nil
+}
+
+// mirrorRevision mirrors the reviewers, comments, and status from a single review in the review tool into the repo linked to it.
+//
+// The repos are searched in the given order, and only the first one linked to the review is mirrored.
+func mirrorRevision(repos []repository.Repo, tool review_utils.Tool, phabricatorReview review_utils.PhabricatorReview, syncToRemote bool) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		for _, repo := range repos {
+			revision := phabricatorReview.GetFirstCommit(repo)
+			if !settingsFor(repo).Enabled() || revision == "" {
+				continue
+			}
+			return mirrorRevisionIntoRepo(repo, tool, phabricatorReview, revision, syncToRemote)
+		}
+		// The review may have been linked by another process since the links were last read.
+		for _, repo := range repos {
+			arcanist.ResetLinks(repo)
+		}
+	}
+	logger.Infof("Ignoring %v, as it is not linked to a review in any repo", phabricatorReview)
+	return nil
+}
+
+// mirrorRevisionIntoRepo mirrors the reviewers, comments, and status from a single review in the review tool into
+// the review of the given revision.
+func mirrorRevisionIntoRepo(repo repository.Repo, tool review_utils.Tool, phabricatorReview review_utils.PhabricatorReview, revision string, syncToRemote bool) error {
+	unlock := lockRepo(repo.GetPath())
+	defer unlock()
+	if err := tool.MirrorReviewers(repo, phabricatorReview); err != nil {
+		return err
+	}
+	if err := mirrorReviewComments(repo, phabricatorReview); err != nil {
+		return err
+	}
+	if r, err := review.GetSummary(repo, revision); err != nil {
+		return err
+	} else if r != nil && r.IsOpen() {
+		if err := tool.MirrorStatus(repo, *r); err != nil {
+			return err
+		}
+	}
+	if syncToRemote {
+		settings := settingsFor(repo)
+		if err := repo.PushNotes(settings.Remote, settings.NotesRefPattern); err != nil {
+			logger.Errorf("Failed to push updates to the repo %v: %v\n", repo, err)
+		}
+	}
+	return nil
+}
+
+// reposForRevision returns the repos that may hold the review of the revision with the given ID in the default
+// Phabricator instance, with the repos that are already known to hold it first.
+//
+// Revision IDs are only unique within an instance, so the repos mirrored into other instances are left out.
+func reposForRevision(repos []repository.Repo, id string) []repository.Repo {
+	// Trying the linked repos first means that we rarely need to read the links from every repo.
+	var linkedRepos, otherRepos []repository.Repo
+	for _, repo := range repos {
+		repo = wrapRepo(repo)
+		if !usesDefaultInstance(settingsFor(repo)) {
+			continue
+		}
+		if store.GetReviewRevision(repo.GetPath(), id) != "" {
+			linkedRepos = append(linkedRepos, repo)
+		} else {
+			otherRepos = append(otherRepos, repo)
+		}
+	}
+	return append(linkedRepos, otherRepos...)
+}
+
+// Revision mirrors the comments from the Differential revision with the given PHID into whichever
+// of the given repos holds its review, without waiting for the next time that repo is mirrored.
+//
+// The revision is looked up in the default Phabricator instance.
+func Revision(repos []repository.Repo, revisionPHID string, syncToRemote bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic while mirroring the revision %s: %v", revisionPHID, r)
+		}
+	}()
+	differentialReview, err := arc.LookupRevision(revisionPHID)
+	if err != nil {
+		return err
+	}
+	if differentialReview == nil {
+		return fmt.Errorf("Unknown differential revision %s", revisionPHID)
+	}
+	return mirrorRevision(reposForRevision(repos, differentialReview.ID), arc, *differentialReview, syncToRemote)
 }
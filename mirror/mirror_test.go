@@ -17,10 +17,22 @@ limitations under the License.
 package mirror
 
 import (
+	"errors"
+	"fmt"
 	"github.com/akatrevorjay/git-appraise/repository"
 	"github.com/akatrevorjay/git-appraise/review"
+	"github.com/akatrevorjay/git-appraise/review/comment"
 	"github.com/akatrevorjay/git-appraise/review/request"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/arcanist"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/config"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/dryrun"
 	phabricatorReview "github.com/akatrevorjay/git-phabricator-mirror/mirror/review"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/state"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
 )
 
@@ -28,22 +40,553 @@ type mockReviewTool struct {
 	Requests map[string]request.Request
 }
 
-func (tool *mockReviewTool) EnsureRequestExists(repo repository.Repo, r review.Review) {
+func (tool *mockReviewTool) EnsureRequestExists(repo repository.Repo, r review.Review) error {
 	tool.Requests[r.Revision] = r.Request
+	return nil
+}
+
+func (tool *mockReviewTool) FindReview(repo repository.Repo, revision string) (phabricatorReview.PhabricatorReview, error) {
+	return nil, nil
+}
+
+func (tool *mockReviewTool) ListOpenReviews(repo repository.Repo) ([]phabricatorReview.PhabricatorReview, error) {
+	return nil, nil
+}
+
+func (tool *mockReviewTool) Refresh(repo repository.Repo) error {
+	return nil
+}
+
+func (tool *mockReviewTool) ListClosedReviews(repo repository.Repo, after string, limit int) ([]phabricatorReview.PhabricatorReview, string, error) {
+	return nil, "", nil
+}
+
+func (tool *mockReviewTool) MirrorReviewers(repo repository.Repo, r phabricatorReview.PhabricatorReview) error {
+	return nil
 }
 
-func (tool *mockReviewTool) ListOpenReviews(repo repository.Repo) []phabricatorReview.PhabricatorReview {
+func (tool *mockReviewTool) MirrorStatus(repo repository.Repo, r review.Summary) error {
 	return nil
 }
 
-func (tool *mockReviewTool) Refresh(repo repository.Repo) {}
+func (tool *mockReviewTool) ImportReview(repo repository.Repo, r phabricatorReview.PhabricatorReview) (bool, error) {
+	return false, nil
+}
 
 func TestMirrorRepo(t *testing.T) {
 	repo := repository.NewMockRepoForTest()
 	tool := mockReviewTool{make(map[string]request.Request)}
 	syncToRemote := true
-	mirrorRepoToReview(repo, &tool, syncToRemote)
+	if err := mirrorRepoToReview(repo, &tool, syncToRemote); err != nil {
+		t.Fatal(err)
+	}
 	if len(tool.Requests) != len(review.ListAll(repo)) {
 		t.Errorf("Review requests are not what we expected: %v", tool.Requests)
 	}
 }
+
+type failingReviewTool struct {
+	mockReviewTool
+	FailRevision string
+	ListErr      error
+}
+
+func (tool *failingReviewTool) EnsureRequestExists(repo repository.Repo, r review.Review) error {
+	if r.Revision == tool.FailRevision {
+		return errors.New("Malformed review")
+	}
+	return tool.mockReviewTool.EnsureRequestExists(repo, r)
+}
+
+func (tool *failingReviewTool) ListOpenReviews(repo repository.Repo) ([]phabricatorReview.PhabricatorReview, error) {
+	return nil, tool.ListErr
+}
+
+func TestMirrorRepoIsolatesFailures(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	tool := failingReviewTool{
+		mockReviewTool: mockReviewTool{make(map[string]request.Request)},
+		FailRevision:   "rev2",
+	}
+	SetStore(state.NewMemoryStore())
+	if err := mirrorRepoToReview(repo, &tool, false); err != nil {
+		t.Errorf("Review failures should not fail the whole repo: %v", err)
+	}
+	if _, ok := tool.Requests["rev1"]; !ok || len(tool.Requests) != 1 {
+		t.Errorf("A failed review prevented the others from being mirrored: %v", tool.Requests)
+	}
+	if repoState := store.GetRepoState(repo.GetPath()); repoState != "" {
+		t.Errorf("The repo state was recorded despite failed reviews: %q", repoState)
+	}
+
+	tool.ListErr = errors.New("Phabricator is down")
+	if err := mirrorRepoToReview(repo, &tool, false); err == nil {
+		t.Errorf("Expected the repo to fail when the open reviews cannot be listed")
+	}
+}
+
+func TestMirrorRepoResumesAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+
+	repo := repository.NewMockRepoForTest()
+	fileStore, err := state.NewFileStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetStore(fileStore)
+	tool := mockReviewTool{make(map[string]request.Request)}
+	if err := mirrorRepoToReview(repo, &tool, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(tool.Requests) != len(review.ListAll(repo)) {
+		t.Errorf("Review requests are not what we expected: %v", tool.Requests)
+	}
+
+	// Simulate a restart by dropping everything held in memory.
+	fileStore, err = state.NewFileStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetStore(fileStore)
+	restartedTool := mockReviewTool{make(map[string]request.Request)}
+	if err := mirrorRepoToReview(repo, &restartedTool, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(restartedTool.Requests) != 0 {
+		t.Errorf("Unchanged reviews were mirrored again after a restart: %v", restartedTool.Requests)
+	}
+}
+
+type mockPhabricatorReview struct {
+	Repo     repository.Repo
+	Revision string
+	Comments []phabricatorReview.PhabricatorComment
+}
+
+func (r mockPhabricatorReview) LoadComments() ([]phabricatorReview.PhabricatorComment, error) {
+	return r.Comments, nil
+}
+
+func (r mockPhabricatorReview) GetFirstCommit(repo repository.Repo) string {
+	if r.Repo != nil && r.Repo != repo {
+		return ""
+	}
+	return r.Revision
+}
+
+func TestMirrorReviewCommentsUsesLinks(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	phabricatorComment := phabricatorReview.PhabricatorComment{
+		PHID:    "PHID-XCMT-1",
+		Comment: comment.Comment{Author: "foo@bar.com", Timestamp: "1", Description: "Original"},
+	}
+	r := mockPhabricatorReview{Revision: "rev1", Comments: []phabricatorReview.PhabricatorComment{phabricatorComment}}
+	if err := mirrorReviewComments(repo, r); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes(comment.Ref, "rev1"); len(notes) != 1 {
+		t.Fatalf("Unexpected comment notes: %v", notes)
+	}
+	hash, err := phabricatorComment.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phid := store.GetCommentPHID(repo.GetPath(), hash); phid != "PHID-XCMT-1" {
+		t.Errorf("The mirrored comment was not linked: %q", phid)
+	}
+
+	// An edit in Phabricator must not be mirrored as a new comment.
+	r.Comments[0].Description = "Edited"
+	if err := mirrorReviewComments(repo, r); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes(comment.Ref, "rev1"); len(notes) != 1 {
+		t.Errorf("An edited comment was mirrored again: %v", notes)
+	}
+}
+
+func TestIsMirroredRepeatedComments(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	first := phabricatorReview.PhabricatorComment{
+		PHID:    "PHID-XCMT-1",
+		Comment: comment.Comment{Author: "foo@bar.com", Timestamp: "1", Description: "Please add a test"},
+	}
+	existing := []review.CommentThread{review.CommentThread{Hash: "first", Comment: first.Comment}}
+	if mirrored, err := isMirrored(repo, first, existing); err != nil || !mirrored {
+		t.Fatalf("The overlapping comment was not matched: %v, %v", mirrored, err)
+	}
+	if phid := store.GetCommentPHID(repo.GetPath(), "first"); phid != "PHID-XCMT-1" {
+		t.Errorf("The overlapping comment was not linked: %q", phid)
+	}
+
+	// The same comment made again later is a new comment, even though its contents overlap with the first one.
+	repeated := first
+	repeated.PHID = "PHID-XCMT-2"
+	repeated.Timestamp = "2"
+	if mirrored, err := isMirrored(repo, repeated, existing); err != nil || mirrored {
+		t.Errorf("The repeated comment was matched to a comment that is linked to another: %v, %v", mirrored, err)
+	}
+}
+
+type importingReviewTool struct {
+	mockReviewTool
+	Open     []phabricatorReview.PhabricatorReview
+	Imported []phabricatorReview.PhabricatorReview
+}
+
+func (tool *importingReviewTool) ListOpenReviews(repo repository.Repo) ([]phabricatorReview.PhabricatorReview, error) {
+	return tool.Open, nil
+}
+
+func (tool *importingReviewTool) ImportReview(repo repository.Repo, r phabricatorReview.PhabricatorReview) (bool, error) {
+	tool.Imported = append(tool.Imported, r)
+	return true, nil
+}
+
+func TestMirrorRepoImportsReviews(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	linked := mockPhabricatorReview{Revision: "rev1"}
+	unlinked := mockPhabricatorReview{}
+	tool := importingReviewTool{
+		mockReviewTool: mockReviewTool{make(map[string]request.Request)},
+		Open:           []phabricatorReview.PhabricatorReview{linked, unlinked},
+	}
+	SetStore(state.NewMemoryStore())
+	if err := mirrorRepoToReview(repo, &tool, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(tool.Imported) != 0 {
+		t.Errorf("Reviews were imported without being enabled: %v", tool.Imported)
+	}
+
+	importRevisions := true
+	SetConfig(config.New(config.Settings{ImportRevisions: &importRevisions}), nil)
+	defer SetConfig(config.New(defaultSettings), nil)
+	if err := mirrorRepoToReview(repo, &tool, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(tool.Imported) != 1 || tool.Imported[0].GetFirstCommit(repo) != "" {
+		t.Errorf("Unexpected imported reviews: %v", tool.Imported)
+	}
+}
+
+func TestMirrorReviewCommentsDryRun(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	plan := dryrun.NewPlan(nil)
+	phabricatorComment := phabricatorReview.PhabricatorComment{
+		PHID:    "PHID-XCMT-1",
+		Comment: comment.Comment{Author: "foo@bar.com", Timestamp: "1", Description: "Original"},
+	}
+	r := mockPhabricatorReview{Revision: "rev1", Comments: []phabricatorReview.PhabricatorComment{phabricatorComment}}
+	if err := mirrorReviewComments(dryrun.NewRepo(repo, plan), r); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes(comment.Ref, "rev1"); len(notes) != 0 {
+		t.Errorf("A comment was written during a dry run: %v", notes)
+	}
+	actions := plan.Actions()
+	if len(actions) != 1 || actions[0].Type != dryrun.AppendNote || actions[0].Ref != comment.Ref || actions[0].Revision != "rev1" {
+		t.Errorf("Unexpected planned actions: %+v", actions)
+	}
+}
+
+// pathRepo overrides the path of a repo, so that multiple mock repos can be told apart.
+type pathRepo struct {
+	repository.Repo
+	path string
+}
+
+func (r pathRepo) GetPath() string {
+	return r.path
+}
+
+type countingReviewTool struct {
+	mockReviewTool
+	Calls int
+}
+
+func (tool *countingReviewTool) EnsureRequestExists(repo repository.Repo, r review.Review) error {
+	tool.Calls++
+	return tool.mockReviewTool.EnsureRequestExists(repo, r)
+}
+
+func TestMirrorReposConcurrently(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	var repos []repository.Repo
+	var tools []*countingReviewTool
+	for i := 0; i < 8; i++ {
+		repos = append(repos, pathRepo{repository.NewMockRepoForTest(), fmt.Sprintf("/repo%d", i)})
+		tools = append(tools, &countingReviewTool{mockReviewTool: mockReviewTool{make(map[string]request.Request)}})
+	}
+	var wg sync.WaitGroup
+	for i := range repos {
+		wg.Add(1)
+		go func(repo repository.Repo, tool *countingReviewTool) {
+			defer wg.Done()
+			if err := mirrorRepoToReview(repo, tool, false); err != nil {
+				t.Error(err)
+			}
+		}(repos[i], tools[i])
+	}
+	wg.Wait()
+	for i, repo := range repos {
+		reviews := review.ListAll(repo)
+		if tools[i].Calls != len(reviews) || len(tools[i].Requests) != len(reviews) {
+			t.Errorf("The reviews in %s were not each mirrored once: %d calls for %v", repo.GetPath(), tools[i].Calls, tools[i].Requests)
+		}
+		if store.GetRepoState(repo.GetPath()) == "" {
+			t.Errorf("The state of %s was not recorded", repo.GetPath())
+		}
+	}
+}
+
+func TestMirrorRevision(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	otherRepo := repository.NewMockRepoForTest()
+	repo := repository.NewMockRepoForTest()
+	r := mockPhabricatorReview{
+		Repo:     repo,
+		Revision: "rev1",
+		Comments: []phabricatorReview.PhabricatorComment{
+			phabricatorReview.PhabricatorComment{
+				PHID:    "PHID-XCMT-1",
+				Comment: comment.Comment{Author: "foo@bar.com", Timestamp: "1", Description: "Hello"},
+			},
+		},
+	}
+	tool := statusReviewTool{mockReviewTool: mockReviewTool{make(map[string]request.Request)}}
+	if err := mirrorRevision([]repository.Repo{otherRepo, repo}, &tool, r, false); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes(comment.Ref, "rev1"); len(notes) != 1 {
+		t.Errorf("The revision was not mirrored into its repo: %v", notes)
+	}
+	if notes := otherRepo.GetNotes(comment.Ref, "rev1"); len(notes) != 0 {
+		t.Errorf("The revision was mirrored into the wrong repo: %v", notes)
+	}
+	if len(tool.Statuses) != 1 || tool.Statuses[0] != "rev1" {
+		t.Errorf("The status of the revision was not mirrored: %v", tool.Statuses)
+	}
+}
+
+func TestReposForRevision(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	c := config.New(defaultSettings)
+	c.Repos = []config.Override{
+		{Path: "/legacy", Settings: config.Settings{PhabricatorURI: "https://legacy.example.com/"}},
+	}
+	SetConfig(c, nil)
+	defer SetConfig(config.New(defaultSettings), nil)
+	previousReadGitConfig := readGitConfig
+	readGitConfig = func(repoPath string) (map[string][]string, error) {
+		return nil, nil
+	}
+	defer func() { readGitConfig = previousReadGitConfig }()
+
+	legacyRepo := pathRepo{repository.NewMockRepoForTest(), "/legacy"}
+	otherRepo := pathRepo{repository.NewMockRepoForTest(), "/other"}
+	linkedRepo := pathRepo{repository.NewMockRepoForTest(), "/linked"}
+	store.LinkRevision("/linked", "rev1", "1")
+	repos := reposForRevision([]repository.Repo{legacyRepo, otherRepo, linkedRepo}, "1")
+	if len(repos) != 2 || repos[0].GetPath() != "/linked" || repos[1].GetPath() != "/other" {
+		t.Errorf("Unexpected repos for a revision in the default instance: %v", repos)
+	}
+}
+
+type statusReviewTool struct {
+	mockReviewTool
+	Open     []phabricatorReview.PhabricatorReview
+	Statuses []string
+}
+
+func (tool *statusReviewTool) ListOpenReviews(repo repository.Repo) ([]phabricatorReview.PhabricatorReview, error) {
+	return tool.Open, nil
+}
+
+func (tool *statusReviewTool) MirrorStatus(repo repository.Repo, r review.Summary) error {
+	tool.Statuses = append(tool.Statuses, r.Revision)
+	return nil
+}
+
+func TestMirrorRepoStatuses(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	tool := statusReviewTool{
+		mockReviewTool: mockReviewTool{make(map[string]request.Request)},
+		Open:           []phabricatorReview.PhabricatorReview{mockPhabricatorReview{Revision: "rev1"}},
+	}
+	if err := mirrorRepoToReview(repo, &tool, false); err != nil {
+		t.Fatal(err)
+	}
+	// Only the reviews that are no longer open in the tool may have been closed.
+	if len(tool.Statuses) != 1 || tool.Statuses[0] != "rev2" {
+		t.Errorf("Unexpected reviews whose statuses were mirrored: %v", tool.Statuses)
+	}
+
+	// The statuses are mirrored even when the repo has not changed.
+	tool.Statuses = nil
+	if err := mirrorRepoToReview(repo, &tool, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(tool.Statuses) != 1 || tool.Statuses[0] != "rev2" {
+		t.Errorf("The statuses were not mirrored for an unchanged repo: %v", tool.Statuses)
+	}
+
+	// A revision that is closed in the tool is noticed without the repo changing.
+	tool.Statuses = nil
+	tool.Open = nil
+	if err := mirrorRepoToReview(repo, &tool, false); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tool.Statuses)
+	if len(tool.Statuses) != 2 || tool.Statuses[0] != "rev1" || tool.Statuses[1] != "rev2" {
+		t.Errorf("The statuses were not mirrored for a newly closed revision: %v", tool.Statuses)
+	}
+}
+
+func TestMirrorRepoCountsFailures(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	tool := failingReviewTool{
+		mockReviewTool: mockReviewTool{make(map[string]request.Request)},
+		FailRevision:   "rev1",
+	}
+	failures, err := mirrorRepo(repo, &tool, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 {
+		t.Errorf("Unexpected number of failures: %d", failures)
+	}
+}
+
+func TestMirrorSingleReview(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	tool := mockReviewTool{make(map[string]request.Request)}
+	if err := mirrorSingleReview(repo, &tool, "rev1", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tool.Requests["rev1"]; !ok || len(tool.Requests) != 1 {
+		t.Errorf("Unexpected reviews mirrored: %v", tool.Requests)
+	}
+	if err := mirrorSingleReview(repo, &tool, "unknown", false); err == nil {
+		t.Errorf("Expected an error for an unknown review")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	SetStore(state.NewMemoryStore())
+	repo := repository.NewMockRepoForTest()
+	status, err := Status(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.UpToDate() || len(status.Reviews) != len(review.ListAll(repo)) {
+		t.Errorf("Unexpected status for an unmirrored repo: %v", status)
+	}
+
+	tool := mockReviewTool{make(map[string]request.Request)}
+	if err := mirrorRepoToReview(repo, &tool, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkRevisionClosed(repo.GetPath(), "rev1"); err != nil {
+		t.Fatal(err)
+	}
+	status, err = Status(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.UpToDate() {
+		t.Errorf("The repo is not up to date after being mirrored: %v", status)
+	}
+	for _, reviewStatus := range status.Reviews {
+		if reviewStatus.Closed != (reviewStatus.Revision == "rev1") {
+			t.Errorf("Unexpected review status: %v", reviewStatus)
+		}
+	}
+}
+
+type mockConduit struct {
+	URI string
+}
+
+func (c *mockConduit) Call(method string, request interface{}, response interface{}) error {
+	return errors.New("Unexpected conduit call")
+}
+
+func TestRepoSettings(t *testing.T) {
+	disabled := false
+	c := config.New(defaultSettings)
+	c.Repos = []config.Override{
+		{Path: "/legacy-*", Settings: config.Settings{PhabricatorURI: "https://legacy.example.com/", Remote: "upstream"}},
+		{Path: "/disabled", Settings: config.Settings{Mirror: &disabled}},
+	}
+	var created []string
+	SetConfig(c, func(settings config.Settings) (arcanist.ConduitCaller, error) {
+		created = append(created, settings.PhabricatorURI)
+		return &mockConduit{settings.PhabricatorURI}, nil
+	})
+	defer SetConfig(config.New(defaultSettings), nil)
+	gitConfigs := map[string]map[string][]string{
+		"/team": {
+			"phabricator.callsign":  {"TEAM"},
+			"phabricator.reviewers": {"alice,bob"},
+		},
+		"/team-disabled": {"phabricator.mirror": {"false"}},
+	}
+	previousReadGitConfig := readGitConfig
+	readGitConfig = func(repoPath string) (map[string][]string, error) {
+		return gitConfigs[repoPath], nil
+	}
+	defer func() { readGitConfig = previousReadGitConfig }()
+
+	defaultArc, err := arcFor(settingsFor(&repository.GitRepo{Path: "/other"}))
+	if err != nil || defaultArc.Conduit != nil {
+		t.Errorf("Unexpected Arcanist for the default instance: %v, %v", defaultArc, err)
+	}
+	for _, path := range []string{"/legacy-a", "/legacy-b"} {
+		repo := &repository.GitRepo{Path: path}
+		if remote := settingsFor(repo).Remote; remote != "upstream" {
+			t.Errorf("Unexpected remote for %s: %q", path, remote)
+		}
+		legacyArc, err := arcFor(settingsFor(repo))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conduit, ok := legacyArc.Conduit.(*mockConduit); !ok || conduit.URI != "https://legacy.example.com/" {
+			t.Errorf("Unexpected Arcanist for %s: %v", path, legacyArc)
+		}
+	}
+	if len(created) != 1 {
+		t.Errorf("The conduit for each instance should only be created once: %v", created)
+	}
+
+	disabledRepo := &repository.GitRepo{Path: "/disabled"}
+	if Enabled(disabledRepo) {
+		t.Errorf("Mirroring was not disabled for %s", disabledRepo.Path)
+	}
+	if err := Once(disabledRepo, "", false); err != nil {
+		t.Errorf("Unexpected error mirroring a disabled repo: %v", err)
+	}
+
+	// The owners of a repo can change how it is mirrored using its git config.
+	teamArc, err := arcFor(settingsFor(&repository.GitRepo{Path: "/team"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if teamArc.Callsign != "TEAM" || len(teamArc.Reviewers) != 2 || teamArc.Conduit != nil {
+		t.Errorf("Unexpected Arcanist for a repo with its own settings: %+v", teamArc)
+	}
+	if Enabled(&repository.GitRepo{Path: "/team-disabled"}) {
+		t.Errorf("Mirroring was not disabled by the git config")
+	}
+}
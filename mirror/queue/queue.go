@@ -0,0 +1,105 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package queue defines a work queue that hands each of its keys to at most one worker at a time.
+package queue
+
+import (
+	"sync"
+)
+
+// Queue holds the keys that are waiting to be processed.
+//
+// A key is only queued once no matter how many times it is added before being processed,
+// and is never handed to more than one worker at a time. If a key is added while it is
+// being processed, then it is queued again once that worker is done with it.
+type Queue struct {
+	mutex      sync.Mutex
+	ready      *sync.Cond
+	pending    []string
+	queued     map[string]bool
+	inProgress map[string]bool
+	requeue    map[string]bool
+	closed     bool
+}
+
+// New returns an empty Queue.
+func New() *Queue {
+	q := &Queue{
+		queued:     make(map[string]bool),
+		inProgress: make(map[string]bool),
+		requeue:    make(map[string]bool),
+	}
+	q.ready = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Add queues the given key to be processed.
+func (q *Queue) Add(key string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed || q.queued[key] {
+		return
+	}
+	if q.inProgress[key] {
+		q.requeue[key] = true
+		return
+	}
+	q.queued[key] = true
+	q.pending = append(q.pending, key)
+	q.ready.Signal()
+}
+
+// Next waits for a key to be queued, and returns it.
+//
+// The caller must call Done once it has finished processing the key. The returned bool is
+// false if the queue has been closed.
+func (q *Queue) Next() (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.pending) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if q.closed {
+		return "", false
+	}
+	key := q.pending[0]
+	q.pending = q.pending[1:]
+	delete(q.queued, key)
+	q.inProgress[key] = true
+	return key, true
+}
+
+// Done records that the given key, previously returned by Next, has been processed.
+func (q *Queue) Done(key string) {
+	q.mutex.Lock()
+	delete(q.inProgress, key)
+	requeue := q.requeue[key]
+	delete(q.requeue, key)
+	q.mutex.Unlock()
+	if requeue {
+		q.Add(key)
+	}
+}
+
+// Close wakes up all of the callers waiting in Next, and discards any keys that are still queued.
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.pending = nil
+	q.ready.Broadcast()
+}
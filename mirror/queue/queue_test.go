@@ -0,0 +1,56 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	q := New()
+	q.Add("first")
+	q.Add("second")
+	q.Add("first")
+
+	key, ok := q.Next()
+	if !ok || key != "first" {
+		t.Fatalf("Unexpected first key: %q", key)
+	}
+	// The first key is in progress, so it must not be handed out again until it is done.
+	q.Add("first")
+	key, ok = q.Next()
+	if !ok || key != "second" {
+		t.Fatalf("Unexpected second key: %q", key)
+	}
+	q.Done(key)
+	q.Done("first")
+	key, ok = q.Next()
+	if !ok || key != "first" {
+		t.Fatalf("A key added while being processed was not queued again: %q", key)
+	}
+	q.Done(key)
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.Next()
+		done <- ok
+	}()
+	q.Close()
+	if ok := <-done; ok {
+		t.Errorf("Next returned a key after the queue was closed")
+	}
+}
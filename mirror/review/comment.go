@@ -18,6 +18,7 @@ limitations under the License.
 package review
 
 import (
+	"fmt"
 	"github.com/akatrevorjay/git-appraise/review"
 	"github.com/akatrevorjay/git-appraise/review/comment"
 	"strings"
@@ -31,6 +32,40 @@ func QuoteDescription(comment comment.Comment) string {
 	return comment.Author + ":\n\n" + comment.Description
 }
 
+// TopLevelDescription generates the description of the top-level Phabricator comment
+// that mirrors the given review-wide or commit-level comment.
+//
+// Top-level Phabricator comments have neither a location nor a resolved bit, so the
+// commit is noted in the description, and comments that only set the resolved bit,
+// such as an LGTM, are described instead.
+func TopLevelDescription(c comment.Comment) string {
+	description := c.Description
+	if description == "" && c.Resolved != nil {
+		if *c.Resolved {
+			description = "LGTM"
+		} else {
+			description = "Needs work"
+		}
+	}
+	if c.Location != nil && c.Location.Commit != "" {
+		description = fmt.Sprintf("(On commit %s)\n\n%s", c.Location.Commit, description)
+	}
+	return description
+}
+
+// ReplyDescription generates the description of the Phabricator inline comment that mirrors
+// the given reply to the parent comment.
+//
+// Differential cannot thread inline comments that are posted through its API, so the reply
+// names the parent's author and quotes the first line of the parent's description.
+func ReplyDescription(reply, parent comment.Comment) string {
+	reference := "In reply to " + parent.Author + ":"
+	if quoted := strings.SplitN(strings.TrimSpace(parent.Description), "\n", 2)[0]; quoted != "" {
+		reference += "\n> " + quoted
+	}
+	return reference + "\n\n" + reply.Description
+}
+
 // isQuote determines if the given comment is a quote of the other comment.
 //
 // For these purposes, a quote is a sequence of:
@@ -97,6 +132,17 @@ func resolvedOverlaps(comment, other comment.Comment) bool {
 	return true
 }
 
+// mirrorsTopLevel determines if the given comment is the top-level Phabricator comment
+// that mirrors the other, review-wide or commit-level, comment.
+func mirrorsTopLevel(comment, other comment.Comment) bool {
+	if comment.Location != nil || comment.Resolved != nil || (other.Location != nil && other.Location.Path != "") {
+		return false
+	}
+	described := other
+	described.Description = TopLevelDescription(other)
+	return comment.Description == described.Description || isQuote(comment, described)
+}
+
 // Overlaps compares two comments to see if they are roughly the same.
 //
 // This is necessary because the internal data models used by Phabricator and
@@ -105,8 +151,12 @@ func resolvedOverlaps(comment, other comment.Comment) bool {
 // We define overlap to mean that two comments are anchored at the same location,
 // and that the two descriptions are either identical, or one is a quote of the other
 // and (if they are top-level comments), if their resolved bits are unset or set but
-// with the same value.
+// with the same value. A top-level Phabricator comment also overlaps the review-wide or
+// commit-level comment that it mirrors, as described by TopLevelDescription.
 func Overlaps(comment, other comment.Comment) bool {
+	if mirrorsTopLevel(comment, other) || mirrorsTopLevel(other, comment) {
+		return true
+	}
 	if !descriptionOverlaps(comment, other) {
 		return false
 	}
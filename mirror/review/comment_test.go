@@ -56,6 +56,55 @@ With some text in it.`
 
 }
 
+func TestReplyDescription(t *testing.T) {
+	parent := comment.Comment{Author: "foo@bar.com", Description: "First line\n\nSecond line"}
+	reply := comment.Comment{Author: "baz@bar.com", Description: "A reply"}
+	if description := ReplyDescription(reply, parent); description != "In reply to foo@bar.com:\n> First line\n\nA reply" {
+		t.Errorf("Unexpected reply description: %q", description)
+	}
+
+	parent.Description = ""
+	if description := ReplyDescription(reply, parent); description != "In reply to foo@bar.com:\n\nA reply" {
+		t.Errorf("Unexpected reply description for a parent without a description: %q", description)
+	}
+}
+
+func TestTopLevelOverlaps(t *testing.T) {
+	accept := true
+	lgtm := comment.Comment{
+		Author:   "foo@bar.com",
+		Resolved: &accept,
+	}
+	commitComment := comment.Comment{
+		Author:      "foo@bar.com",
+		Location:    &comment.Location{Commit: "ABCDEFG"},
+		Description: "Split this up",
+	}
+	for _, original := range []comment.Comment{lgtm, commitComment} {
+		mirrored := comment.Comment{
+			Author:      "bot@robots-r-us.com",
+			Description: QuoteDescription(comment.Comment{Author: original.Author, Description: TopLevelDescription(original)}),
+		}
+		if !Overlaps(original, mirrored) {
+			t.Errorf("%v and %v do not overlap", original, mirrored)
+		}
+		if !Overlaps(mirrored, original) {
+			t.Errorf("%v and %v do not overlap", mirrored, original)
+		}
+	}
+
+	reject := false
+	mirrored := comment.Comment{
+		Author:      "bot@robots-r-us.com",
+		Description: QuoteDescription(comment.Comment{Author: lgtm.Author, Description: TopLevelDescription(lgtm)}),
+	}
+	lgtm.Resolved = &reject
+	// should not overlap because the mirrored comment describes a different resolved bit
+	if Overlaps(lgtm, mirrored) {
+		t.Errorf("%v and %v overlap", lgtm, mirrored)
+	}
+}
+
 func TestResolvedOverlaps(t *testing.T) {
 	reject := false
 	accept := true
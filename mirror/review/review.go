@@ -23,12 +23,20 @@ import (
 	"github.com/akatrevorjay/git-appraise/review/comment"
 )
 
+// PhabricatorComment represents a review comment stored in Phabricator.
+type PhabricatorComment struct {
+	// PHID uniquely identifies the comment within Phabricator.
+	PHID string
+	comment.Comment
+}
+
 // PhabricatorReview represents a code review stored in Phabricator.
 type PhabricatorReview interface {
 	// LoadComments returns the comments for a review
-	LoadComments() []comment.Comment
+	LoadComments() ([]PhabricatorComment, error)
 
-	// GetFirstCommit returns the first commit that is included in the review
+	// GetFirstCommit returns the revision of the git-appraise review linked to this review,
+	// or the empty string if there is none.
 	GetFirstCommit(repo repository.Repo) string
 }
 
@@ -37,11 +45,32 @@ type PhabricatorReview interface {
 // The default implementation wraps calls to Phabricator's "arcanist" command-line tool.
 type Tool interface {
 	// EnsureRequestExists mirrors a review from git-notes into Phabricator.
-	EnsureRequestExists(repo repository.Repo, review review.Review)
+	EnsureRequestExists(repo repository.Repo, review review.Review) error
+
+	// FindReview returns the review that mirrors the git-notes review of the given revision, or nil if there is none.
+	FindReview(repo repository.Repo, revision string) (PhabricatorReview, error)
 
 	// ListOpenReviews returns the list of reviews that the tool knows about that have not yet been closed.
-	ListOpenReviews(repo repository.Repo) []PhabricatorReview
+	ListOpenReviews(repo repository.Repo) ([]PhabricatorReview, error)
+
+	// ListClosedReviews returns a page of at most limit reviews for the given repo that have been closed
+	// or abandoned, starting after the given cursor ("" for the first page). Reviews are ordered from the
+	// most recently created, and the returned cursor is that of the next page, or "" if there are no more.
+	ListClosedReviews(repo repository.Repo, after string, limit int) ([]PhabricatorReview, string, error)
+
+	// MirrorReviewers updates the reviewers of the git-notes review linked to the given review, if
+	// they have been changed in the tool.
+	MirrorReviewers(repo repository.Repo, review PhabricatorReview) error
+
+	// MirrorStatus updates the given review if it has been closed or abandoned in the tool, so that
+	// it is reported as submitted or abandoned respectively.
+	MirrorStatus(repo repository.Repo, r review.Summary) error
+
+	// ImportReview writes a git-notes review request for a review that was created directly in the
+	// tool, if its commits are in the given repo. It reports whether the review is now linked to a
+	// request in the repo.
+	ImportReview(repo repository.Repo, review PhabricatorReview) (bool, error)
 
 	// Refresh advises the review tool that the code being reviewed has changed, and to reload it.
-	Refresh(repo repository.Repo)
+	Refresh(repo repository.Repo) error
 }
@@ -0,0 +1,214 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/arcanist"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/config"
+)
+
+// defaultSettings are the settings used for every repo unless SetConfig is called.
+var defaultSettings = config.Settings{
+	Remote:          "origin",
+	NotesRefPattern: "refs/notes/devtools/*",
+}
+
+// DefaultSettings returns the settings used for every repo unless SetConfig is called.
+func DefaultSettings() config.Settings {
+	return defaultSettings
+}
+
+// repoConfig holds the settings for each repo.
+var repoConfig = config.New(defaultSettings)
+
+// ConduitFactory returns a ConduitCaller for the Phabricator instance described by the given settings.
+type ConduitFactory func(settings config.Settings) (arcanist.ConduitCaller, error)
+
+// newConduit is used to create the ConduitCallers for repos that are mirrored into a
+// Phabricator instance other than the default one.
+var newConduit ConduitFactory
+
+// instance identifies a Phabricator instance, along with how to connect to it.
+type instance struct {
+	uri     string
+	token   string
+	timeout int
+}
+
+// arcs caches the Arcanist used for each Phabricator instance other than the default one.
+var arcs = make(map[instance]arcanist.Arcanist)
+var arcsMutex sync.Mutex
+
+// SetConfig replaces the settings used for each repo.
+//
+// The default ConduitCaller set in the arcanist package is used for the repos whose settings
+// match the global settings, and the given factory is used for every other Phabricator instance.
+func SetConfig(c *config.Config, factory ConduitFactory) {
+	repoConfig = c
+	newConduit = factory
+	arcsMutex.Lock()
+	defer arcsMutex.Unlock()
+	arcs = make(map[instance]arcanist.Arcanist)
+}
+
+// repoSettingsCacheDuration is how long the settings read from a repo are used before reading them again.
+const repoSettingsCacheDuration = time.Minute
+
+type cachedRepoSettings struct {
+	Settings config.Settings
+	Time     time.Time
+}
+
+// repoSettingsCache holds the settings read from each repo, keyed by the path of the repo.
+var repoSettingsCache = make(map[string]cachedRepoSettings)
+var repoSettingsMutex sync.Mutex
+
+// readGitConfig returns the "phabricator.*" keys in the git config of the repo at the given path.
+//
+// It is a variable so that tests can avoid reading the git config of the repo they run in.
+var readGitConfig = func(repoPath string) (map[string][]string, error) {
+	cmd := exec.Command("git", "config", "--null", "--get-regexp", `^phabricator\.`)
+	cmd.Dir = repoPath
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && !exitErr.Success() && stdout.Len() == 0 {
+			// Git exits with a status of 1 when no keys match.
+			return nil, nil
+		}
+		return nil, err
+	}
+	values := make(map[string][]string)
+	// With "--null", each entry is the key, a newline, and then the value, terminated by a NUL.
+	for _, entry := range strings.Split(stdout.String(), "\x00") {
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "\n", 2)
+		key := strings.ToLower(parts[0])
+		var value string
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		values[key] = append(values[key], value)
+	}
+	return values, nil
+}
+
+// readRepoSettings reads the settings that the owners of the given repo have set in it.
+//
+// Malformed settings are logged and ignored, so that a bad commit cannot stop the repo from being mirrored.
+func readRepoSettings(repo repository.Repo) config.Settings {
+	var settings config.Settings
+	if contents, err := repo.Show("HEAD", ".arcconfig"); err == nil && strings.TrimSpace(contents) != "" {
+		arcconfigSettings, err := config.ParseArcconfig([]byte(contents))
+		if err != nil {
+			logger.Warningf("Ignoring the malformed .arcconfig file in %s: %v", repo.GetPath(), err)
+		} else {
+			settings = arcconfigSettings
+		}
+	}
+	if repo.GetPath() == "" {
+		return settings
+	}
+	values, err := readGitConfig(repo.GetPath())
+	if err != nil {
+		logger.Warningf("Failed to read the git config of %s: %v", repo.GetPath(), err)
+		return settings
+	}
+	gitSettings, err := config.ParseGitConfig(values)
+	if err != nil {
+		logger.Warningf("Ignoring the malformed git config of %s: %v", repo.GetPath(), err)
+		return settings
+	}
+	return settings.Merge(gitSettings)
+}
+
+// settingsFor returns the settings for the given repo.
+func settingsFor(repo repository.Repo) config.Settings {
+	repoSettingsMutex.Lock()
+	cached, ok := repoSettingsCache[repo.GetPath()]
+	repoSettingsMutex.Unlock()
+	if !ok || cached.Time.Before(time.Now().Add(-repoSettingsCacheDuration)) {
+		cached = cachedRepoSettings{
+			Settings: readRepoSettings(repo),
+			Time:     time.Now(),
+		}
+		repoSettingsMutex.Lock()
+		repoSettingsCache[repo.GetPath()] = cached
+		repoSettingsMutex.Unlock()
+	}
+	return repoConfig.ForRepo(repo.GetPath(), cached.Settings)
+}
+
+// arcFor returns the Arcanist used to mirror the repos with the given settings.
+func arcFor(settings config.Settings) (arcanist.Arcanist, error) {
+	key := instance{
+		uri:     arcanist.NormalizeConduitURI(settings.PhabricatorURI),
+		token:   settings.ConduitToken,
+		timeout: settings.ConduitTimeout,
+	}
+	global := repoConfig.Settings
+	var a arcanist.Arcanist
+	if key != (instance{arcanist.NormalizeConduitURI(global.PhabricatorURI), global.ConduitToken, global.ConduitTimeout}) {
+		arcsMutex.Lock()
+		defer arcsMutex.Unlock()
+		var ok bool
+		if a, ok = arcs[key]; !ok {
+			if newConduit == nil {
+				return a, fmt.Errorf("No way to connect to the Phabricator instance %s", settings.PhabricatorURI)
+			}
+			caller, err := newConduit(config.Settings{
+				PhabricatorURI: key.uri,
+				ConduitToken:   key.token,
+				ConduitTimeout: key.timeout,
+			})
+			if err != nil {
+				return a, err
+			}
+			a = arcanist.Arcanist{Conduit: caller}
+			arcs[key] = a
+		}
+	}
+	a.RepoDirPrefix = settings.RepoDirPrefix
+	a.Callsign = settings.Callsign
+	a.Reviewers = settings.Reviewers
+	return a, nil
+}
+
+// usesDefaultInstance reports whether the repos with the given settings are mirrored into the default Phabricator instance.
+func usesDefaultInstance(settings config.Settings) bool {
+	return settings.SameInstance(repoConfig.Settings)
+}
+
+// Enabled reports whether the given repo should be mirrored.
+func Enabled(repo repository.Repo) bool {
+	return settingsFor(repo).Enabled()
+}
+
+// SyncPeriod returns the number of seconds between subsequent syncs of the given repo.
+func SyncPeriod(repo repository.Repo) int {
+	return settingsFor(repo).SyncPeriod
+}
@@ -0,0 +1,519 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package state provides storage for the mirror's progress, so that it can survive restarts.
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store records what the mirror has already done for each repo.
+//
+// All of the methods are keyed by the path of the repo, since the same review revision
+// may be present in multiple clones of a repo.
+type Store interface {
+	// GetRepoState returns the state hash of the repo when it was last mirrored, or "" if it never was.
+	GetRepoState(repoPath string) string
+
+	// SetRepoState records the state hash of the repo after it has been mirrored.
+	SetRepoState(repoPath, stateHash string) error
+
+	// IsRevisionClosed reports whether the Differential revisions for a review have been closed.
+	IsRevisionClosed(repoPath, revision string) bool
+
+	// MarkRevisionClosed records that the Differential revisions for a review have been closed.
+	MarkRevisionClosed(repoPath, revision string) error
+
+	// IsRevisionAbandoned reports whether the Differential revisions for a review were abandoned by the mirror.
+	IsRevisionAbandoned(repoPath, revision string) bool
+
+	// MarkRevisionAbandoned records whether the Differential revisions for a review were abandoned by the mirror.
+	MarkRevisionAbandoned(repoPath, revision string, abandoned bool) error
+
+	// GetDifferentialID returns the ID of the Differential revision for the given review, or "" if unknown.
+	GetDifferentialID(repoPath, revision string) string
+
+	// GetReviewRevision returns the review revision for the given Differential revision ID, or "" if unknown.
+	GetReviewRevision(repoPath, differentialID string) string
+
+	// LinkRevision records that the given review is mirrored by the given Differential revision.
+	LinkRevision(repoPath, revision, differentialID string) error
+
+	// GetSyncedRequest returns the hash of the review request whose fields were last mirrored into
+	// the Differential revision for the given review, or "" if unknown.
+	GetSyncedRequest(repoPath, revision string) string
+
+	// SetSyncedRequest records the hash of the review request whose fields were mirrored into the
+	// Differential revision for the given review.
+	SetSyncedRequest(repoPath, revision, requestHash string) error
+
+	// GetCommentPHID returns the PHID of the Phabricator comment for the given git-appraise comment hash, or "" if unknown.
+	GetCommentPHID(repoPath, commentHash string) string
+
+	// GetCommentHash returns the git-appraise comment hash for the given Phabricator comment PHID, or "" if unknown.
+	GetCommentHash(repoPath, commentPHID string) string
+
+	// LinkComment records that the given git-appraise comment and Phabricator comment are copies of each other.
+	LinkComment(repoPath, commentHash, commentPHID string) error
+
+	// ForgetReview drops everything recorded about the given review and its comments.
+	ForgetReview(repoPath, revision string, commentHashes []string) error
+
+	// IsBackfilled reports whether the history of the given review has been backfilled from its Differential revision.
+	IsBackfilled(repoPath, revision string) bool
+
+	// MarkBackfilled records that the history of the given review has been backfilled from its Differential revision.
+	MarkBackfilled(repoPath, revision string) error
+
+	// GetBackfillCursor returns the cursor after which an unfinished backfill of the repo should
+	// continue listing the closed Differential revisions, or "" if there is no backfill in progress.
+	GetBackfillCursor(repoPath string) string
+
+	// SetBackfillCursor records the cursor after which a backfill of the repo should continue.
+	SetBackfillCursor(repoPath, cursor string) error
+
+	// IsImportSkipped reports whether the given diff of the given Differential revision could not be imported into the repo.
+	IsImportSkipped(repoPath, differentialID, diffID string) bool
+
+	// MarkImportSkipped records that the given diff of the given Differential revision could not be imported into the repo.
+	MarkImportSkipped(repoPath, differentialID, diffID string) error
+}
+
+// repoState is the state recorded for a single repo.
+type repoState struct {
+	StateHash string            `json:"stateHash,omitempty"`
+	Closed    map[string]bool   `json:"closed,omitempty"`
+	Abandoned map[string]bool   `json:"abandoned,omitempty"`
+	Reviews   map[string]string `json:"reviews,omitempty"`
+	Requests  map[string]string `json:"requests,omitempty"`
+	Comments  map[string]string `json:"comments,omitempty"`
+	// Backfilled holds the reviews whose history has been backfilled, and BackfillCursor the
+	// progress of an unfinished backfill.
+	Backfilled     map[string]bool `json:"backfilled,omitempty"`
+	BackfillCursor string          `json:"backfillCursor,omitempty"`
+	// ImportSkipped holds, for each Differential revision ID, the latest diff that could not be imported.
+	ImportSkipped map[string]string `json:"importSkipped,omitempty"`
+	// commentHashes is the reverse of Comments, keyed by the Phabricator comment PHIDs.
+	commentHashes map[string]string
+}
+
+// indexComments builds the reverse mapping of the comment links.
+func (state *repoState) indexComments() {
+	state.commentHashes = make(map[string]string)
+	for commentHash, phid := range state.Comments {
+		state.commentHashes[phid] = commentHash
+	}
+}
+
+// memoryStore is a Store that keeps everything in memory, and optionally persists it in a file.
+type memoryStore struct {
+	mutex sync.RWMutex
+	Repos map[string]*repoState `json:"repos"`
+	// file is the file in which the store is persisted, or nil if it is only kept in memory.
+	file *storeFile
+}
+
+// storeFile is the file in which a store is persisted.
+//
+// The file may be shared by multiple processes (e.g. the mirror daemon and the "once" command run
+// from a git hook), so every change is made while holding an exclusive lock on a separate lock file,
+// and the file is read again whenever another process has replaced it.
+type storeFile struct {
+	path string
+	// info describes the file as it was when it was last read or written, or is nil if it did not exist.
+	info os.FileInfo
+}
+
+// NewMemoryStore returns a Store that does not persist anything across restarts.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		Repos: make(map[string]*repoState),
+	}
+}
+
+// rlock acquires the read lock, after reading the store's file again if another process has changed it,
+// and returns the function that releases the lock.
+//
+// If the file cannot be read, the contents that were last read from it are used.
+func (s *memoryStore) rlock() func() {
+	if s.file != nil {
+		s.mutex.Lock()
+		s.reload()
+		s.mutex.Unlock()
+	}
+	s.mutex.RLock()
+	return s.mutex.RUnlock
+}
+
+// update calls the given function with the write lock held, and then persists the store if the function
+// reports that it changed anything.
+func (s *memoryStore) update(f func() bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		f()
+		return nil
+	}
+	unlock, err := lockFile(s.file.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Read any changes made by other processes first, so that we do not overwrite them.
+	if err := s.reload(); err != nil {
+		return err
+	}
+	if !f() {
+		return nil
+	}
+	if err := writeFileAtomically(s.file.path, s); err != nil {
+		return err
+	}
+	info, err := os.Stat(s.file.path)
+	if err != nil {
+		return err
+	}
+	s.file.info = info
+	return nil
+}
+
+// reload reads the store's file again if it has changed since it was last read or written. The caller must hold the write lock.
+func (s *memoryStore) reload() error {
+	info, err := os.Stat(s.file.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// The file is always replaced rather than modified in place, so it is unchanged if it is still the same file.
+	if previous := s.file.info; previous != nil && os.SameFile(previous, info) &&
+		previous.ModTime().Equal(info.ModTime()) && previous.Size() == info.Size() {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(s.file.path)
+	if err != nil {
+		return err
+	}
+	var loaded struct {
+		Repos map[string]*repoState `json:"repos"`
+	}
+	if err := json.Unmarshal(contents, &loaded); err != nil {
+		return err
+	}
+	s.Repos = loaded.Repos
+	if s.Repos == nil {
+		s.Repos = make(map[string]*repoState)
+	}
+	for _, state := range s.Repos {
+		state.indexComments()
+	}
+	s.file.info = info
+	return nil
+}
+
+// repo returns the state for the given repo, creating it if necessary. The caller must hold the write lock.
+func (s *memoryStore) repo(repoPath string) *repoState {
+	state, ok := s.Repos[repoPath]
+	if !ok {
+		state = &repoState{}
+		s.Repos[repoPath] = state
+	}
+	if state.Closed == nil {
+		state.Closed = make(map[string]bool)
+	}
+	if state.Abandoned == nil {
+		state.Abandoned = make(map[string]bool)
+	}
+	if state.Reviews == nil {
+		state.Reviews = make(map[string]string)
+	}
+	if state.Requests == nil {
+		state.Requests = make(map[string]string)
+	}
+	if state.Comments == nil {
+		state.Comments = make(map[string]string)
+	}
+	if state.commentHashes == nil {
+		state.indexComments()
+	}
+	if state.Backfilled == nil {
+		state.Backfilled = make(map[string]bool)
+	}
+	if state.ImportSkipped == nil {
+		state.ImportSkipped = make(map[string]string)
+	}
+	return state
+}
+
+func (s *memoryStore) GetRepoState(repoPath string) string {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		return state.StateHash
+	}
+	return ""
+}
+
+func (s *memoryStore) SetRepoState(repoPath, stateHash string) error {
+	return s.update(func() bool {
+		s.repo(repoPath).StateHash = stateHash
+		return true
+	})
+}
+
+func (s *memoryStore) IsRevisionClosed(repoPath, revision string) bool {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		return state.Closed[revision]
+	}
+	return false
+}
+
+func (s *memoryStore) MarkRevisionClosed(repoPath, revision string) error {
+	return s.update(func() bool {
+		s.repo(repoPath).Closed[revision] = true
+		return true
+	})
+}
+
+func (s *memoryStore) IsRevisionAbandoned(repoPath, revision string) bool {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		return state.Abandoned[revision]
+	}
+	return false
+}
+
+func (s *memoryStore) MarkRevisionAbandoned(repoPath, revision string, abandoned bool) error {
+	return s.update(func() bool {
+		state := s.repo(repoPath)
+		if state.Abandoned[revision] == abandoned {
+			return false
+		}
+		if abandoned {
+			state.Abandoned[revision] = true
+		} else {
+			delete(state.Abandoned, revision)
+		}
+		return true
+	})
+}
+
+func (s *memoryStore) GetDifferentialID(repoPath, revision string) string {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		return state.Reviews[revision]
+	}
+	return ""
+}
+
+func (s *memoryStore) GetReviewRevision(repoPath, differentialID string) string {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		for revision, id := range state.Reviews {
+			if id == differentialID {
+				return revision
+			}
+		}
+	}
+	return ""
+}
+
+func (s *memoryStore) LinkRevision(repoPath, revision, differentialID string) error {
+	return s.update(func() bool {
+		state := s.repo(repoPath)
+		if state.Reviews[revision] == differentialID {
+			return false
+		}
+		state.Reviews[revision] = differentialID
+		return true
+	})
+}
+
+func (s *memoryStore) GetSyncedRequest(repoPath, revision string) string {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		return state.Requests[revision]
+	}
+	return ""
+}
+
+func (s *memoryStore) SetSyncedRequest(repoPath, revision, requestHash string) error {
+	return s.update(func() bool {
+		state := s.repo(repoPath)
+		if state.Requests[revision] == requestHash {
+			return false
+		}
+		state.Requests[revision] = requestHash
+		return true
+	})
+}
+
+func (s *memoryStore) GetCommentPHID(repoPath, commentHash string) string {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		return state.Comments[commentHash]
+	}
+	return ""
+}
+
+func (s *memoryStore) GetCommentHash(repoPath, commentPHID string) string {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		return state.commentHashes[commentPHID]
+	}
+	return ""
+}
+
+func (s *memoryStore) LinkComment(repoPath, commentHash, commentPHID string) error {
+	return s.update(func() bool {
+		state := s.repo(repoPath)
+		previous, ok := state.Comments[commentHash]
+		if previous == commentPHID {
+			return false
+		}
+		if ok && state.commentHashes[previous] == commentHash {
+			delete(state.commentHashes, previous)
+		}
+		state.Comments[commentHash] = commentPHID
+		state.commentHashes[commentPHID] = commentHash
+		return true
+	})
+}
+
+func (s *memoryStore) ForgetReview(repoPath, revision string, commentHashes []string) error {
+	return s.update(func() bool {
+		state := s.repo(repoPath)
+		delete(state.Closed, revision)
+		delete(state.Abandoned, revision)
+		delete(state.Reviews, revision)
+		delete(state.Requests, revision)
+		delete(state.Backfilled, revision)
+		for _, commentHash := range commentHashes {
+			if phid, ok := state.Comments[commentHash]; ok && state.commentHashes[phid] == commentHash {
+				delete(state.commentHashes, phid)
+			}
+			delete(state.Comments, commentHash)
+		}
+		return true
+	})
+}
+
+func (s *memoryStore) IsBackfilled(repoPath, revision string) bool {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		return state.Backfilled[revision]
+	}
+	return false
+}
+
+func (s *memoryStore) MarkBackfilled(repoPath, revision string) error {
+	return s.update(func() bool {
+		s.repo(repoPath).Backfilled[revision] = true
+		return true
+	})
+}
+
+func (s *memoryStore) GetBackfillCursor(repoPath string) string {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		return state.BackfillCursor
+	}
+	return ""
+}
+
+func (s *memoryStore) SetBackfillCursor(repoPath, cursor string) error {
+	return s.update(func() bool {
+		s.repo(repoPath).BackfillCursor = cursor
+		return true
+	})
+}
+
+func (s *memoryStore) IsImportSkipped(repoPath, differentialID, diffID string) bool {
+	defer s.rlock()()
+	if state, ok := s.Repos[repoPath]; ok {
+		skipped, ok := state.ImportSkipped[differentialID]
+		return ok && skipped == diffID
+	}
+	return false
+}
+
+func (s *memoryStore) MarkImportSkipped(repoPath, differentialID, diffID string) error {
+	return s.update(func() bool {
+		s.repo(repoPath).ImportSkipped[differentialID] = diffID
+		return true
+	})
+}
+
+// DefaultPath returns the default path of the file in which the state is persisted, in the user's home directory.
+func DefaultPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".git-phabricator-mirror-state.json")
+}
+
+// NewFileStore returns a Store that persists its contents as JSON in the file at the given path.
+//
+// The file is created if it does not already exist, and is rewritten after every change. The file
+// can safely be shared by multiple processes, each of which sees the changes made by the others.
+func NewFileStore(path string) (Store, error) {
+	s := &memoryStore{
+		Repos: make(map[string]*repoState),
+		file:  &storeFile{path: path},
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewReadOnlyFileStore returns a Store initialized from the JSON file at the given path, as
+// written by a Store returned from NewFileStore.
+//
+// Changes are kept in memory and never written back to the file.
+func NewReadOnlyFileStore(path string) (Store, error) {
+	s, err := NewFileStore(path)
+	if err != nil {
+		return nil, err
+	}
+	s.(*memoryStore).file = nil
+	return s, nil
+}
+
+// writeFileAtomically writes the JSON encoding of the given value to a temporary file,
+// and then moves that file into place so that a crash never leaves a partial file behind.
+func writeFileAtomically(path string, value interface{}) error {
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(contents); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
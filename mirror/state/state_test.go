@@ -0,0 +1,220 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func verifyStore(t *testing.T, s Store) {
+	if s.GetRepoState("/repo") != "ABCD" || s.GetRepoState("/other") != "" {
+		t.Errorf("Unexpected repo states: %v", s)
+	}
+	if !s.IsRevisionClosed("/repo", "closed") || s.IsRevisionClosed("/repo", "open") || s.IsRevisionClosed("/other", "closed") {
+		t.Errorf("Unexpected closed revisions: %v", s)
+	}
+	if !s.IsRevisionAbandoned("/repo", "abandoned") || s.IsRevisionAbandoned("/repo", "reclaimed") || s.IsRevisionAbandoned("/other", "abandoned") {
+		t.Errorf("Unexpected abandoned revisions: %v", s)
+	}
+	if s.GetDifferentialID("/repo", "rev") != "42" || s.GetReviewRevision("/repo", "42") != "rev" {
+		t.Errorf("Unexpected revision links: %v", s)
+	}
+	if s.GetDifferentialID("/other", "rev") != "" || s.GetReviewRevision("/other", "42") != "" {
+		t.Errorf("Revision links leaked between repos: %v", s)
+	}
+	if s.GetSyncedRequest("/repo", "rev") != "request" || s.GetSyncedRequest("/other", "rev") != "" {
+		t.Errorf("Unexpected synced requests: %v", s)
+	}
+	if s.GetCommentPHID("/repo", "hash") != "PHID-XCMT-1" || s.GetCommentHash("/repo", "PHID-XCMT-1") != "hash" {
+		t.Errorf("Unexpected comment links: %v", s)
+	}
+	if s.GetCommentPHID("/other", "hash") != "" || s.GetCommentHash("/repo", "PHID-XCMT-2") != "" {
+		t.Errorf("Unexpected comment links: %v", s)
+	}
+	if !s.IsBackfilled("/repo", "rev") || s.IsBackfilled("/repo", "closed") || s.IsBackfilled("/other", "rev") {
+		t.Errorf("Unexpected backfilled reviews: %v", s)
+	}
+	if s.GetBackfillCursor("/repo") != "200" || s.GetBackfillCursor("/other") != "" {
+		t.Errorf("Unexpected backfill cursors: %v", s)
+	}
+	if !s.IsImportSkipped("/repo", "43", "12") || s.IsImportSkipped("/repo", "43", "13") || s.IsImportSkipped("/other", "43", "12") {
+		t.Errorf("Unexpected skipped imports: %v", s)
+	}
+}
+
+func populateStore(t *testing.T, s Store) {
+	if err := s.SetRepoState("/repo", "ABCD"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkRevisionClosed("/repo", "closed"); err != nil {
+		t.Fatal(err)
+	}
+	for _, revision := range []string{"abandoned", "reclaimed"} {
+		if err := s.MarkRevisionAbandoned("/repo", revision, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.MarkRevisionAbandoned("/repo", "reclaimed", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LinkRevision("/repo", "rev", "42"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetSyncedRequest("/repo", "rev", "request"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LinkComment("/repo", "hash", "PHID-XCMT-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkBackfilled("/repo", "rev"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetBackfillCursor("/repo", "200"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkImportSkipped("/repo", "43", "12"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	populateStore(t, s)
+	verifyStore(t, s)
+
+	if err := s.ForgetReview("/repo", "rev", []string{"hash"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetDifferentialID("/repo", "rev") != "" || s.GetCommentPHID("/repo", "hash") != "" || s.GetCommentHash("/repo", "PHID-XCMT-1") != "" ||
+		s.IsBackfilled("/repo", "rev") || s.GetSyncedRequest("/repo", "rev") != "" {
+		t.Errorf("The review was not forgotten: %v", s)
+	}
+	if s.GetRepoState("/repo") != "ABCD" || !s.IsRevisionClosed("/repo", "closed") {
+		t.Errorf("Forgetting a review affected the rest of the repo: %v", s)
+	}
+}
+
+func TestRelinkComment(t *testing.T) {
+	s := NewMemoryStore()
+	if err := s.LinkComment("/repo", "hash", "PHID-XCMT-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LinkComment("/repo", "hash", "PHID-XCMT-2"); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetCommentHash("/repo", "PHID-XCMT-1") != "" || s.GetCommentHash("/repo", "PHID-XCMT-2") != "hash" {
+		t.Errorf("The comment link was not replaced: %v", s)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	populateStore(t, s)
+	verifyStore(t, s)
+
+	reloaded, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyStore(t, reloaded)
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(path); err == nil {
+		t.Errorf("Expected an error for a corrupt state file")
+	}
+}
+
+func TestSharedFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	daemon, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.LinkComment("/repo", "daemon", "PHID-XCMT-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.LinkComment("/repo", "hook", "PHID-XCMT-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.SetRepoState("/repo", "ABCD"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Store{daemon, hook} {
+		if s.GetCommentPHID("/repo", "daemon") != "PHID-XCMT-1" || s.GetCommentPHID("/repo", "hook") != "PHID-XCMT-2" ||
+			s.GetRepoState("/repo") != "ABCD" {
+			t.Errorf("A change made through another store was lost: %v", s)
+		}
+	}
+}
+
+func TestReadOnlyFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	populateStore(t, s)
+
+	readOnly, err := NewReadOnlyFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyStore(t, readOnly)
+	if err := readOnly.SetRepoState("/repo", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOnly.GetRepoState("/repo"); got != "changed" {
+		t.Errorf("The change was not kept in memory: %q", got)
+	}
+
+	reloaded, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyStore(t, reloaded)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-appraise/review"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/arcanist"
+)
+
+// ReviewStatus describes how far a single review has been mirrored.
+type ReviewStatus struct {
+	Revision    string
+	Description string
+	// DifferentialID is the ID of the linked Differential revision, or "" if the review has not been mirrored.
+	DifferentialID string
+	Closed         bool
+	Comments       int
+	// LinkedComments is the number of comments that are known to have been mirrored.
+	LinkedComments int
+}
+
+// RepoStatus describes how far a single repo has been mirrored.
+type RepoStatus struct {
+	Path string
+	// StateHash is the current state of the repo, and MirroredStateHash is its state when it was last mirrored.
+	StateHash         string
+	MirroredStateHash string
+	Reviews           []ReviewStatus
+}
+
+// UpToDate reports whether the repo has not changed since it was last mirrored.
+func (s RepoStatus) UpToDate() bool {
+	return s.StateHash == s.MirroredStateHash
+}
+
+// commentHashes returns the hashes of every comment in the given threads.
+func commentHashes(threads []review.CommentThread) []string {
+	var hashes []string
+	for _, thread := range threads {
+		hashes = append(hashes, thread.Hash)
+		hashes = append(hashes, commentHashes(thread.Children)...)
+	}
+	return hashes
+}
+
+// Status reports the recorded progress of mirroring the given repo.
+func Status(repo repository.Repo) (*RepoStatus, error) {
+	stateHash, err := repo.GetRepoStateHash()
+	if err != nil {
+		return nil, err
+	}
+	status := &RepoStatus{
+		Path:              repo.GetPath(),
+		StateHash:         stateHash,
+		MirroredStateHash: store.GetRepoState(repo.GetPath()),
+	}
+	for _, r := range review.ListAll(repo) {
+		reviewStatus := ReviewStatus{
+			Revision:       r.Revision,
+			Description:    strings.Split(r.Request.Description, "\n")[0],
+			DifferentialID: arcanist.LinkedRevisionID(repo, r.Revision),
+			Closed:         store.IsRevisionClosed(repo.GetPath(), r.Revision),
+		}
+		for _, hash := range commentHashes(r.Comments) {
+			reviewStatus.Comments++
+			if store.GetCommentPHID(repo.GetPath(), hash) != "" {
+				reviewStatus.LinkedComments++
+			}
+		}
+		status.Reviews = append(status.Reviews, reviewStatus)
+	}
+	return status, nil
+}
+
+// Resync drops everything recorded about the review of the given revision, and then mirrors it again.
+//
+// The links between the review and its Differential revision are kept, since they are stored in
+// git-notes rather than being recorded by the mirror.
+func Resync(repo repository.Repo, revision string, syncToRemote bool) error {
+	r, err := review.GetSummary(repo, revision)
+	if err != nil {
+		return err
+	} else if r == nil {
+		return fmt.Errorf("There is no review for the revision %q in %s", revision, repo.GetPath())
+	}
+	if err := store.ForgetReview(repo.GetPath(), revision, commentHashes(r.Comments)); err != nil {
+		return err
+	}
+	return Once(repo, revision, syncToRemote)
+}
@@ -0,0 +1,7 @@
+package watcher
+
+import (
+	"github.com/op/go-logging"
+)
+
+var logger = logging.MustGetLogger("mirror")
@@ -0,0 +1,75 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watcher
+
+import (
+	"sync"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/akatrevorjay/git-phabricator-mirror/mirror/queue"
+)
+
+// Queue holds the repos that are waiting to be mirrored, keyed by their paths.
+//
+// A repo is never handed to more than one worker at a time, as described by queue.Queue.
+type Queue struct {
+	paths *queue.Queue
+	mutex sync.Mutex
+	// repos maps each queued path to the repo most recently added for it.
+	repos map[string]repository.Repo
+}
+
+// NewQueue returns an empty Queue.
+func NewQueue() *Queue {
+	return &Queue{
+		paths: queue.New(),
+		repos: make(map[string]repository.Repo),
+	}
+}
+
+// Add queues the given repo to be mirrored.
+func (q *Queue) Add(repo repository.Repo) {
+	path := repo.GetPath()
+	q.mutex.Lock()
+	q.repos[path] = repo
+	q.mutex.Unlock()
+	q.paths.Add(path)
+}
+
+// Next waits for a repo to be queued, and returns it.
+//
+// The caller must call Done once it has finished mirroring the repo. The returned bool is
+// false if the queue has been closed.
+func (q *Queue) Next() (repository.Repo, bool) {
+	path, ok := q.paths.Next()
+	if !ok {
+		return nil, false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.repos[path], true
+}
+
+// Done records that the given repo, previously returned by Next, has been mirrored.
+func (q *Queue) Done(repo repository.Repo) {
+	q.paths.Done(repo.GetPath())
+}
+
+// Close wakes up all of the callers waiting in Next, and discards any repos that are still queued.
+func (q *Queue) Close() {
+	q.paths.Close()
+}
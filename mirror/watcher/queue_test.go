@@ -0,0 +1,46 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watcher
+
+import (
+	"testing"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue()
+	q.Add(&repository.GitRepo{Path: "/first"})
+	latest := &repository.GitRepo{Path: "/first"}
+	q.Add(latest)
+
+	repo, ok := q.Next()
+	if !ok || repo != latest {
+		t.Fatalf("Unexpected repo: %v", repo)
+	}
+	q.Done(repo)
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.Next()
+		done <- ok
+	}()
+	q.Close()
+	if ok := <-done; ok {
+		t.Errorf("Next returned a repo after the queue was closed")
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package watcher detects changes to the git-notes of the mirrored repos, so that a repo
+// can be mirrored as soon as its metadata changes rather than on the next full sweep.
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+	"github.com/fsnotify/fsnotify"
+)
+
+// notesDir is the directory, relative to a git directory, holding the loose refs for the git-notes we mirror.
+var notesDir = filepath.Join("refs", "notes", "devtools")
+
+// packedRefsFile is the file, relative to a git directory, in which git packs refs together.
+const packedRefsFile = "packed-refs"
+
+// Watcher watches the git-notes refs of a set of repos.
+type Watcher struct {
+	watcher *fsnotify.Watcher
+	mutex   sync.Mutex
+	// repos maps each git directory to the repo that it belongs to.
+	repos map[string]repository.Repo
+	// dirs maps each watched directory to the git directory that contains it.
+	dirs map[string]string
+}
+
+// New returns a Watcher that is not yet watching any repos.
+func New() (*Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{
+		watcher: watcher,
+		repos:   make(map[string]repository.Repo),
+		dirs:    make(map[string]string),
+	}, nil
+}
+
+// gitDir returns the directory that holds the refs of the repo at the given path.
+func gitDir(repoPath string) string {
+	dotGit := filepath.Join(repoPath, ".git")
+	if info, err := os.Stat(dotGit); err == nil && info.IsDir() {
+		return dotGit
+	}
+	// The repo is bare.
+	return repoPath
+}
+
+// Watch starts watching the given repo for changes. Watching the same repo multiple times has no effect.
+func (w *Watcher) Watch(repo repository.Repo) error {
+	dir := gitDir(repo.GetPath())
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.repos[dir]; ok {
+		return nil
+	}
+	w.repos[dir] = repo
+	// The notes directory may not exist yet, in which case we watch the closest
+	// existing parent, and add the missing directories as they are created.
+	for _, watched := range []string{"", "refs", filepath.Join("refs", "notes"), notesDir} {
+		if err := w.watchDir(dir, filepath.Join(dir, watched)); err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// watchDir adds a watch for the given directory in the given git directory. The caller must hold the lock.
+func (w *Watcher) watchDir(gitDir, dir string) error {
+	if _, ok := w.dirs[dir]; ok {
+		return nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	if err := w.watcher.Add(dir); err != nil {
+		return err
+	}
+	w.dirs[dir] = gitDir
+	return nil
+}
+
+// handle returns the repo that changed because of the given event, or nil if the event is not relevant.
+func (w *Watcher) handle(event fsnotify.Event) repository.Repo {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	gitDir, ok := w.dirs[filepath.Dir(event.Name)]
+	if !ok {
+		return nil
+	}
+	rel, err := filepath.Rel(gitDir, event.Name)
+	if err != nil {
+		return nil
+	}
+	if event.Op&fsnotify.Create != 0 {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			if rel == notesDir || strings.HasPrefix(notesDir, rel+string(filepath.Separator)) || strings.HasPrefix(rel, notesDir+string(filepath.Separator)) {
+				if err := w.watchDir(gitDir, event.Name); err != nil {
+					logger.Errorf("Failed to watch %s: %v", event.Name, err)
+				}
+				// Refs may have been written to the new directory before we started watching it.
+				return w.repos[gitDir]
+			}
+			return nil
+		}
+	}
+	// Git updates refs by writing a lock file and renaming it into place, so we ignore the lock files.
+	if strings.HasSuffix(rel, ".lock") {
+		return nil
+	}
+	if rel == packedRefsFile || strings.HasPrefix(rel, notesDir+string(filepath.Separator)) {
+		return w.repos[gitDir]
+	}
+	return nil
+}
+
+// Run adds each repo with changed git-notes to the given queue, until the Watcher is closed.
+func (w *Watcher) Run(queue *Queue) {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if repo := w.handle(event); repo != nil {
+				logger.Debugf("Queueing %s because of %v", repo.GetPath(), event)
+				queue.Add(repo)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Errorf("Error watching the repos: %v", err)
+		}
+	}
+}
+
+// Close stops watching every repo.
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
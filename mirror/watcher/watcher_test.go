@@ -0,0 +1,94 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/akatrevorjay/git-appraise/repository"
+)
+
+// expectQueued verifies that the given repo is queued within a reasonable amount of time.
+func expectQueued(t *testing.T, q *Queue, path string) {
+	queued := make(chan repository.Repo)
+	go func() {
+		repo, _ := q.Next()
+		queued <- repo
+	}()
+	select {
+	case repo := <-queued:
+		if repo == nil || repo.GetPath() != path {
+			t.Errorf("Unexpected repo queued: %v", repo)
+		} else {
+			q.Done(repo)
+		}
+	case <-time.After(5 * time.Second):
+		q.Close()
+		t.Fatalf("The repo %s was not queued", path)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "refs", "notes"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	repo := &repository.GitRepo{Path: dir}
+	if err := w.Watch(repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Watch(repo); err != nil {
+		t.Fatal(err)
+	}
+	q := NewQueue()
+	go w.Run(q)
+
+	// Changes outside of the notes refs are ignored.
+	if err := ioutil.WriteFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/master\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devtools := filepath.Join(dir, "refs", "notes", "devtools")
+	if err := os.Mkdir(devtools, 0755); err != nil {
+		t.Fatal(err)
+	}
+	expectQueued(t, q, dir)
+
+	if err := ioutil.WriteFile(filepath.Join(devtools, "reviews"), []byte("ABCD\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectQueued(t, q, dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "packed-refs"), []byte("ABCD refs/notes/devtools/discuss\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectQueued(t, q, dir)
+}
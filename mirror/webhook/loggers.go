@@ -0,0 +1,7 @@
+package webhook
+
+import (
+	"github.com/op/go-logging"
+)
+
+var logger = logging.MustGetLogger("mirror")
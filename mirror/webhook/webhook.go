@@ -0,0 +1,113 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook receives the webhooks that Phabricator's Herald sends when an object changes.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// SignatureHeader is the HTTP header in which Phabricator sends the signature of a webhook payload.
+const SignatureHeader = "X-Phabricator-Webhook-Signature"
+
+// revisionObjectType is the object type that Phabricator reports for Differential revisions.
+const revisionObjectType = "DREV"
+
+// maxPayloadSize is the largest webhook payload that we are willing to read.
+const maxPayloadSize = 1 << 20
+
+// Payload models the body of a Phabricator webhook request.
+type Payload struct {
+	Object struct {
+		Type string `json:"type"`
+		PHID string `json:"phid"`
+	} `json:"object"`
+	Action struct {
+		Test   bool  `json:"test"`
+		Silent bool  `json:"silent"`
+		Secure bool  `json:"secure"`
+		Epoch  int64 `json:"epoch"`
+	} `json:"action"`
+	Transactions []struct {
+		PHID string `json:"phid"`
+	} `json:"transactions"`
+}
+
+// Sign returns the signature that Phabricator computes for the given payload with the given HMAC key.
+func Sign(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether the given signature is valid for the given payload.
+func VerifySignature(key, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(key, body)), []byte(signature))
+}
+
+// Handler is an http.Handler that accepts Phabricator webhooks for Differential revisions.
+type Handler struct {
+	key    []byte
+	handle func(revisionPHID string)
+}
+
+// NewHandler returns a Handler that verifies each webhook using the given HMAC key, and then
+// calls the given function with the PHID of the revision that changed.
+//
+// The function is called before the response is sent, so it should not block for long.
+func NewHandler(key string, handle func(revisionPHID string)) *Handler {
+	return &Handler{
+		key:    []byte(key),
+		handle: handle,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Webhooks must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		http.Error(w, "Failed to read the payload", http.StatusBadRequest)
+		return
+	}
+	if !VerifySignature(h.key, body, r.Header.Get(SignatureHeader)) {
+		logger.Warningf("Rejecting a webhook with an invalid signature from %s", r.RemoteAddr)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Malformed payload", http.StatusBadRequest)
+		return
+	}
+	if payload.Action.Test {
+		logger.Infof("Received a test webhook for %s", payload.Object.PHID)
+	} else if payload.Object.Type == revisionObjectType && payload.Object.PHID != "" {
+		logger.Infof("Received a webhook for %s", payload.Object.PHID)
+		h.handle(payload.Object.PHID)
+	} else {
+		logger.Debugf("Ignoring a webhook for %s %s", payload.Object.Type, payload.Object.PHID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
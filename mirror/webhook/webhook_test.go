@@ -0,0 +1,75 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testKey = "hmac-key"
+
+func sendWebhook(h http.Handler, method, body, signature string) int {
+	request := httptest.NewRequest(method, "/", strings.NewReader(body))
+	request.Header.Set(SignatureHeader, signature)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestHandler(t *testing.T) {
+	var handled []string
+	h := NewHandler(testKey, func(revisionPHID string) {
+		handled = append(handled, revisionPHID)
+	})
+
+	revisionPayload := `{"object": {"type": "DREV", "phid": "PHID-DREV-1"},
+  "triggers": [{"phid": "PHID-HRUL-1"}],
+  "action": {"test": false, "silent": false, "secure": false, "epoch": 1500000000},
+  "transactions": [{"phid": "PHID-XACT-DREV-1"}]}`
+	if code := sendWebhook(h, "POST", revisionPayload, Sign([]byte(testKey), []byte(revisionPayload))); code != http.StatusOK {
+		t.Errorf("Unexpected status for a valid webhook: %d", code)
+	}
+	if code := sendWebhook(h, "POST", revisionPayload, Sign([]byte("wrong-key"), []byte(revisionPayload))); code != http.StatusForbidden {
+		t.Errorf("Unexpected status for a forged webhook: %d", code)
+	}
+	if code := sendWebhook(h, "POST", revisionPayload, ""); code != http.StatusForbidden {
+		t.Errorf("Unexpected status for an unsigned webhook: %d", code)
+	}
+	if code := sendWebhook(h, "GET", "", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status for a GET request: %d", code)
+	}
+
+	taskPayload := `{"object": {"type": "TASK", "phid": "PHID-TASK-1"}, "action": {"test": false}}`
+	if code := sendWebhook(h, "POST", taskPayload, Sign([]byte(testKey), []byte(taskPayload))); code != http.StatusOK {
+		t.Errorf("Unexpected status for a task webhook: %d", code)
+	}
+	testPayload := `{"object": {"type": "DREV", "phid": "PHID-DREV-2"}, "action": {"test": true}}`
+	if code := sendWebhook(h, "POST", testPayload, Sign([]byte(testKey), []byte(testPayload))); code != http.StatusOK {
+		t.Errorf("Unexpected status for a test webhook: %d", code)
+	}
+	malformedPayload := `{"object": `
+	if code := sendWebhook(h, "POST", malformedPayload, Sign([]byte(testKey), []byte(malformedPayload))); code != http.StatusBadRequest {
+		t.Errorf("Unexpected status for a malformed webhook: %d", code)
+	}
+
+	if len(handled) != 1 || handled[0] != "PHID-DREV-1" {
+		t.Errorf("Unexpected revisions handled: %v", handled)
+	}
+}